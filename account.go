@@ -0,0 +1,463 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"golang-songs/model"
+	"golang-songs/service"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	verifyEmailTokenTTL   = 24 * time.Hour
+	resetPasswordTokenTTL = time.Hour
+)
+
+// 投稿前にメールアドレスの確認を必須にするかどうか
+func emailVerificationRequired() bool {
+	return os.Getenv("REQUIRE_EMAIL_VERIFICATION") == "true"
+}
+
+// 確認用リンクを載せたメールを送る
+func sendVerificationMail(db *gorm.DB, mailer service.Mailer, user model.User) error {
+	token, err := createActionToken(db, user, tokenPurposeVerifyEmail, verifyEmailTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	body := "以下のリンクからメールアドレスの確認を完了してください。\n\n" +
+		os.Getenv("APP_URL") + "/email/verify?token=" + token + "\n\n" +
+		"このリンクの有効期限は24時間です。\n"
+
+	return mailer.Send(user.Email, "メールアドレスの確認", body)
+}
+
+type ForgotPasswordHandler struct {
+	DB     *gorm.DB
+	Mailer service.Mailer
+}
+
+// パスワード再設定用のメールを送る
+// 登録の有無が分からないよう、アカウントが無くても同じレスポンスを返す
+func (f *ForgotPasswordHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dec := json.NewDecoder(r.Body)
+	var d model.Form
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if d.Email == "" {
+		var error model.Error
+		error.Message = "Emailは必須です。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	var user model.User
+	if err := f.DB.Where("email = ?", d.Email).Find(&user).Error; err != nil {
+		return
+	}
+
+	token, err := createActionToken(f.DB, user, tokenPurposeResetPassword, resetPasswordTokenTTL)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	body := "以下のリンクからパスワードを再設定してください。\n\n" +
+		os.Getenv("APP_URL") + "/password/reset?token=" + token + "\n\n" +
+		"このリンクの有効期限は1時間です。心当たりがない場合はこのメールを破棄してください。\n"
+
+	if err := f.Mailer.Send(user.Email, "パスワードの再設定", body); err != nil {
+		log.Println(err)
+		return
+	}
+}
+
+type ResetPasswordHandler struct {
+	DB *gorm.DB
+}
+
+func (f *ResetPasswordHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dec := json.NewDecoder(r.Body)
+	var d model.ResetPasswordForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if d.Password == "" {
+		var error model.Error
+		error.Message = "パスワードは必須です。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(d.Password), 10)
+	if err != nil {
+		var error model.Error
+		error.Message = "パスワードの値が不正です。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	userID, err := consumeActionToken(f.DB, d.Token, tokenPurposeResetPassword)
+	if err != nil {
+		var error model.Error
+		error.Message = "トークンが無効か、有効期限が切れています。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	if err := f.DB.Model(&model.User{}).Where("id = ?", userID).Updates(map[string]interface{}{
+		"password":      string(hash),
+		"token_version": gorm.Expr("token_version + 1")}).Error; err != nil {
+		var error model.Error
+		error.Message = "パスワードの更新に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err := revokeSessions(f.DB, userID); err != nil {
+		var error model.Error
+		error.Message = "セッションの削除に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type VerifyEmailHandler struct {
+	DB *gorm.DB
+}
+
+func (f *VerifyEmailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dec := json.NewDecoder(r.Body)
+	var d model.TokenForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	userID, err := consumeActionToken(f.DB, d.Token, tokenPurposeVerifyEmail)
+	if err != nil {
+		var error model.Error
+		error.Message = "トークンが無効か、有効期限が切れています。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	if err := f.DB.Model(&model.User{}).Where("id = ?", userID).Update("email_verified_at", time.Now()).Error; err != nil {
+		var error model.Error
+		error.Message = "メールアドレスの確認に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type ResendVerificationHandler struct {
+	DB     *gorm.DB
+	Mailer service.Mailer
+}
+
+// リクエストユーザーに確認メールを再送する
+func (f *ResendVerificationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	if user.EmailVerifiedAt != nil {
+		var error model.Error
+		error.Message = "メールアドレスは確認済みです。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	if err := sendVerificationMail(f.DB, f.Mailer, user); err != nil {
+		var error model.Error
+		error.Message = "確認メールの送信に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type ChangePasswordHandler struct {
+	DB *gorm.DB
+}
+
+// 現在のパスワードを確認してから変更し、発行済みのトークンを失効させる
+func (f *ChangePasswordHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.ChangePasswordForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if d.NewPassword == "" {
+		var error model.Error
+		error.Message = "パスワードは必須です。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(d.CurrentPassword)); err != nil {
+		var error model.Error
+		error.Message = "無効なパスワードです。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(d.NewPassword), 10)
+	if err != nil {
+		var error model.Error
+		error.Message = "パスワードの値が不正です。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	if err := f.DB.Model(&user).Updates(map[string]interface{}{
+		"password":      string(hash),
+		"token_version": gorm.Expr("token_version + 1")}).Error; err != nil {
+		var error model.Error
+		error.Message = "パスワードの更新に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err := revokeSessions(f.DB, user.ID); err != nil {
+		var error model.Error
+		error.Message = "セッションの削除に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	// 変更した端末はそのまま使えるよう、新しいトークンを返す
+	if err := f.DB.Where("id = ?", user.ID).Find(&user).Error; err != nil {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	token, err := startSession(f.DB, user, r)
+	if err != nil {
+		var error model.Error
+		error.Message = "トークンの作成に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	v, err := json.Marshal(model.JWT{Token: token})
+	if err != nil {
+		var error model.Error
+		error.Message = "JSONへの変換に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if _, err := w.Write(v); err != nil {
+		var error model.Error
+		error.Message = "JWTトークンの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+// hashEmail はトークンに持たせるメールアドレスのハッシュを返す。
+func hashEmail(email string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(sum[:])
+}
+
+type ChangeEmailHandler struct {
+	DB     *gorm.DB
+	Mailer service.Mailer
+}
+
+// 新しいメールアドレスに確認メールを送る
+// 確認が済むまでは元のメールアドレスのまま変更しない
+func (f *ChangeEmailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.Form
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if d.Email == "" {
+		var error model.Error
+		error.Message = "Emailは必須です。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(d.Password)); err != nil {
+		var error model.Error
+		error.Message = "無効なパスワードです。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	var count int
+	if err := f.DB.Model(&model.User{}).Where("email = ?", d.Email).Count(&count).Error; err != nil {
+		var error model.Error
+		error.Message = "メールアドレスの確認に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if count > 0 {
+		var error model.Error
+		error.Message = "このEmailは既に使われています。"
+		errorInResponse(w, http.StatusConflict, error)
+		return
+	}
+
+	if err := f.DB.Model(&user).Update("pending_email", d.Email).Error; err != nil {
+		var error model.Error
+		error.Message = "ユーザー情報の更新に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	// 前の申請のリンクで今回のアドレスが確認済みにならないよう、前のトークンは無効にする
+	if err := f.DB.Model(&model.UserToken{}).Where("user_id = ? AND purpose = ? AND used_at IS NULL", user.ID, tokenPurposeChangeEmail).
+		Update("used_at", time.Now()).Error; err != nil {
+		var error model.Error
+		error.Message = "トークンの作成に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	token, err := createActionTokenWith(f.DB, user, tokenPurposeChangeEmail, verifyEmailTokenTTL,
+		map[string]string{"email_hash": hashEmail(d.Email)})
+	if err != nil {
+		var error model.Error
+		error.Message = "トークンの作成に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	body := "以下のリンクから新しいメールアドレスの確認を完了してください。\n\n" +
+		os.Getenv("APP_URL") + "/user/email/confirm?token=" + token + "\n\n" +
+		"このリンクの有効期限は24時間です。\n"
+
+	if err := f.Mailer.Send(d.Email, "メールアドレス変更の確認", body); err != nil {
+		var error model.Error
+		error.Message = "確認メールの送信に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	// 乗っ取りに気付けるよう、元のアドレスにも知らせる
+	notice := "メールアドレスの変更が申請されました。心当たりがない場合はパスワードを変更してください。\n"
+	if err := f.Mailer.Send(user.Email, "メールアドレス変更の申請", notice); err != nil {
+		log.Println(err)
+	}
+}
+
+type ConfirmEmailChangeHandler struct {
+	DB *gorm.DB
+}
+
+func (f *ConfirmEmailChangeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dec := json.NewDecoder(r.Body)
+	var d model.TokenForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	userID, values, err := consumeActionTokenWith(f.DB, d.Token, tokenPurposeChangeEmail)
+	if err != nil {
+		var error model.Error
+		error.Message = "トークンが無効か、有効期限が切れています。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	var user model.User
+	if err := f.DB.Where("id = ?", userID).Find(&user).Error; err != nil {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	if user.PendingEmail == "" {
+		var error model.Error
+		error.Message = "変更するメールアドレスが見つかりません。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	// リンクを送ったアドレスと、今申請中のアドレスが同じときだけ変更する
+	if values["email_hash"] != hashEmail(user.PendingEmail) {
+		var error model.Error
+		error.Message = "トークンが無効か、有効期限が切れています。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	// 申請後に同じアドレスで登録された場合は email の unique 制約で失敗する
+	if err := f.DB.Model(&user).Updates(map[string]interface{}{
+		"email":             user.PendingEmail,
+		"pending_email":     "",
+		"email_verified_at": time.Now(),
+		"token_version":     gorm.Expr("token_version + 1")}).Error; err != nil {
+		var error model.Error
+		error.Message = "メールアドレスの変更に失敗しました。"
+		errorInResponse(w, http.StatusConflict, error)
+		return
+	}
+
+	if err := revokeSessions(f.DB, user.ID); err != nil {
+		var error model.Error
+		error.Message = "セッションの削除に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
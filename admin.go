@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"golang-songs/model"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+const adminUsersPerPage = 50
+
+// writeJSON は v を JSON にしてレスポンスに書き込む。
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		var error model.Error
+		error.Message = "JSONへの変換に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if _, err := w.Write(b); err != nil {
+		var error model.Error
+		error.Message = "レスポンスの書き込みに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type AdminUsersHandler struct {
+	DB *gorm.DB
+}
+
+// ユーザー一覧を返す。q で名前かメールアドレスを部分一致で検索できる
+func (f *AdminUsersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	query := f.DB.Order("id asc").Limit(adminUsersPerPage).Offset((page - 1) * adminUsersPerPage)
+
+	if q := r.URL.Query().Get("q"); q != "" {
+		like := "%" + q + "%"
+		query = query.Where("name LIKE ? OR email LIKE ?", like, like)
+	}
+
+	users := []model.User{}
+
+	if err := query.Find(&users).Error; err != nil {
+		var error model.Error
+		error.Message = "ユーザー一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	for i := range users {
+		roles, err := userRoles(f.DB, users[i].ID)
+		if err != nil {
+			var error model.Error
+			error.Message = "ロールの取得に失敗しました。"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+		users[i].Roles = roles
+	}
+
+	writeJSON(w, users)
+}
+
+type SuspendUserHandler struct {
+	DB      *gorm.DB
+	Suspend bool
+}
+
+// アカウントを利用停止、または停止を解除する
+// 停止したユーザーはログイン中の端末からもログアウトさせる
+func (f *SuspendUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		var error model.Error
+		error.Message = "idの取得に失敗しました"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	requestUser, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	var user model.User
+	if err := f.DB.Where("id = ?", id).Find(&user).Error; err != nil {
+		var error model.Error
+		error.Message = "該当するユーザーが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	if user.ID == requestUser.ID {
+		var error model.Error
+		error.Message = "自分のアカウントは利用停止できません。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	allowed, err := canSuspend(f.DB, r, user)
+	if err != nil {
+		var error model.Error
+		error.Message = "ユーザー情報の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+	if !allowed {
+		var error model.Error
+		error.Message = "モデレーター・管理者のアカウントを利用停止する権限がありません。"
+		errorInResponse(w, http.StatusForbidden, error)
+		return
+	}
+
+	if err := setSuspended(f.DB, &user, f.Suspend); err != nil {
+		var error model.Error
+		error.Message = "アカウントの更新に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, user)
+}
+
+// setSuspended はアカウントの利用停止を切り替える。停止した場合はログイン中の端末もログアウトさせる。
+func setSuspended(db *gorm.DB, user *model.User, suspend bool) error {
+	var suspendedAt *time.Time
+	if suspend {
+		now := time.Now()
+		suspendedAt = &now
+	}
+
+	if err := db.Model(user).UpdateColumn("suspended_at", suspendedAt).Error; err != nil {
+		return err
+	}
+
+	user.SuspendedAt = suspendedAt
+
+	if suspend {
+		return revokeSessions(db, user.ID)
+	}
+
+	return nil
+}
+
+type UpdateUserRolesHandler struct {
+	DB *gorm.DB
+}
+
+// ユーザーのロールを置き換える
+func (f *UpdateUserRolesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		var error model.Error
+		error.Message = "idの取得に失敗しました"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.RolesForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	for _, role := range d.Roles {
+		if _, ok := rolePermissions[role]; !ok {
+			var error model.Error
+			error.Message = "存在しないロールです: " + role
+			errorInResponse(w, http.StatusBadRequest, error)
+			return
+		}
+	}
+
+	var user model.User
+	if err := f.DB.Where("id = ?", id).Find(&user).Error; err != nil {
+		var error model.Error
+		error.Message = "該当するユーザーが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	err = f.DB.Transaction(func(tx *gorm.DB) error {
+		// (user_id, role) に一意制約があるため論理削除ではなく物理削除する
+		if err := tx.Unscoped().Where("user_id = ?", user.ID).Delete(&model.UserRole{}).Error; err != nil {
+			return err
+		}
+
+		seen := map[string]bool{roleUser: true}
+		for _, role := range d.Roles {
+			if seen[role] {
+				continue
+			}
+			seen[role] = true
+
+			if err := tx.Create(&model.UserRole{UserID: user.ID, Role: role}).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		var error model.Error
+		error.Message = "ロールの更新に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	roles, err := userRoles(f.DB, user.ID)
+	if err != nil {
+		var error model.Error
+		error.Message = "ロールの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+	user.Roles = roles
+
+	writeJSON(w, user)
+}
+
+type AdminDeleteSongHandler struct {
+	DB *gorm.DB
+}
+
+// 投稿者に関係なく曲を削除する。ブックマーク・リアクション・タグ・プレイリストの曲・コメントも合わせて物理削除する
+func (f *AdminDeleteSongHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		var error model.Error
+		error.Message = "idの取得に失敗しました"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	admin, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	var song model.Song
+	if err := f.DB.Unscoped().Where("id = ?", id).Find(&song).Error; err != nil {
+		var error model.Error
+		error.Message = "該当する曲が見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	err := f.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("song_id = ?", song.ID).Delete(&model.Bookmark{}).Error; err != nil {
+			return err
+		}
+
+		var items []model.PlaylistItem
+		if err := tx.Where("song_id = ?", song.ID).Find(&items).Error; err != nil {
+			return err
+		}
+		for _, item := range items {
+			playlist, lockErr := lockPlaylist(tx, item.PlaylistID)
+			if lockErr != nil && lockErr != errPlaylistNotFound {
+				return lockErr
+			}
+			if err := tx.Unscoped().Delete(&item).Error; err != nil {
+				return err
+			}
+			if err := compactPlaylistPositions(tx, item.PlaylistID); err != nil {
+				return err
+			}
+			if lockErr == nil {
+				if err := recordPlaylistActivity(tx, &playlist, admin, playlistActivityRemove, &item.SongID); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err := tx.Unscoped().Where("song_id = ?", song.ID).Delete(&model.SongTag{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("song_id = ?", song.ID).Delete(&model.SongHashtag{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("song_id = ?", song.ID).Delete(&model.SongReaction{}).Error; err != nil {
+			return err
+		}
+
+		comments := tx.New().Model(&model.SongComment{}).Unscoped().Select("id").Where("song_id = ?", song.ID).QueryExpr()
+		if err := tx.Unscoped().Where("comment_id IN (?)", comments).Delete(&model.SongCommentMention{}).Error; err != nil {
+			return err
+		}
+		// 返信が親を参照しているため、返信から先に消す
+		if err := tx.Unscoped().Where("song_id = ? AND parent_id IS NOT NULL", song.ID).Delete(&model.SongComment{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("song_id = ?", song.ID).Delete(&model.SongComment{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Unscoped().Delete(&song).Error
+	})
+	if err != nil {
+		var error model.Error
+		error.Message = "曲の削除に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type AdminStatsHandler struct {
+	DB *gorm.DB
+}
+
+// ユーザー数・曲数などの件数を返す
+func (f *AdminStatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var stats model.AdminStats
+
+	counts := []struct {
+		query *gorm.DB
+		count *int
+	}{
+		{f.DB.Model(&model.User{}), &stats.Users},
+		{f.DB.Model(&model.User{}).Where("suspended_at IS NOT NULL"), &stats.SuspendedUsers},
+		{f.DB.Model(&model.Song{}), &stats.Songs},
+		{f.DB.Model(&model.Bookmark{}), &stats.Bookmarks},
+		{f.DB.Model(&model.UserFollow{}), &stats.Follows},
+	}
+
+	for _, c := range counts {
+		if err := c.query.Count(c.count).Error; err != nil {
+			var error model.Error
+			error.Message = "件数の取得に失敗しました。"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+	}
+
+	writeJSON(w, stats)
+}
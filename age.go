@@ -0,0 +1,104 @@
+package main
+
+import (
+	"golang-songs/model"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// 10代として扱う年齢
+const (
+	teenFromAge = 13
+	teenToAge   = 19
+)
+
+// validBirthDate は生まれ年と月が現実的な値かを返す。どちらも未指定なら true。
+func validBirthDate(year *int, month *int) bool {
+	if month != nil && (year == nil || *month < 1 || *month > 12) {
+		return false
+	}
+
+	if year != nil && (*year < 1900 || *year > time.Now().Year()) {
+		return false
+	}
+
+	return true
+}
+
+type TeenSongsHandler struct {
+	DB *gorm.DB
+}
+
+// 指定されたユーザーが10代だった頃に出た曲を返す
+// 生まれ年が分かってしまうため、年齢を見られる相手にだけ返す
+func (f *TeenSongsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestUser, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	var user model.User
+	if err := f.DB.Where("id = ?", mux.Vars(r)["id"]).Find(&user).Error; err != nil {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	if blocked, err := isBlocked(f.DB, requestUser.ID, user.ID); err != nil || blocked || (user.HiddenAt != nil && !canSeeHidden(r, user.ID)) {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	profiles, err := profilesFor(f.DB, requestUser.ID, []model.User{user})
+	if err != nil {
+		var error model.Error
+		error.Message = "ユーザー情報の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if user.BirthYear == nil || profiles[0].Age == nil {
+		var error model.Error
+		error.Message = "このユーザーの年齢は公開されていません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	hiddenIDs, err := hiddenUserIDs(f.DB, requestUser.ID)
+	if err != nil {
+		var error model.Error
+		error.Message = "曲一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	// music_age は曲が出た年
+	songs := []model.Song{}
+	if err := excludePrivateUsers(excludeUsers(f.DB, "user_id", hiddenIDs), "user_id", requestUser.ID).
+		Where("hidden_at IS NULL AND music_age BETWEEN ? AND ?", *user.BirthYear+teenFromAge, *user.BirthYear+teenToAge).
+		Order("music_age asc").
+		Find(&songs).Error; err != nil {
+		var error model.Error
+		error.Message = "曲一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err := loadSongDetails(f.DB, songs); err != nil {
+		var error model.Error
+		error.Message = "曲一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, songs)
+}
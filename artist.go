@@ -0,0 +1,492 @@
+package main
+
+import (
+	"encoding/json"
+	"golang-songs/model"
+	"golang-songs/service"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+const (
+	artistSongsPerPage = 20
+	// artistFansShown はアーティストのページに載せる、お気に入りにしているユーザーの人数
+	artistFansShown = 50
+	// artistMatchBatch は既存の曲とユーザーをアーティストに結び付けるときに1回で読む件数
+	artistMatchBatch = 500
+)
+
+var errArtistConflict = errors.New("artist name is used by another artist")
+
+// artistByName は正規化した名前か別名が normalized のアーティストを返す。
+func artistByName(db *gorm.DB, normalized string) (model.Artist, error) {
+	var artist model.Artist
+	err := db.Where("normalized_name = ?", normalized).Find(&artist).Error
+	if !gorm.IsRecordNotFoundError(err) {
+		return artist, err
+	}
+
+	var alias model.ArtistAlias
+	if err := db.Where("normalized_name = ?", normalized).Find(&alias).Error; err != nil {
+		return artist, err
+	}
+
+	err = db.Where("id = ?", alias.ArtistID).Find(&artist).Error
+
+	return artist, err
+}
+
+// findOrCreateArtist は name のアーティストの ID を返す。無ければ name の表記で作る。
+// 名前が空なら nil を返す。
+func findOrCreateArtist(db *gorm.DB, name string) (*uint, error) {
+	name = service.CleanArtist(name)
+	normalized := service.NormalizeArtist(name)
+	if normalized == "" {
+		return nil, nil
+	}
+
+	artist, err := artistByName(db, normalized)
+	if gorm.IsRecordNotFoundError(err) {
+		err = db.Where(model.Artist{NormalizedName: normalized}).
+			Attrs(model.Artist{Name: name}).FirstOrCreate(&artist).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &artist.ID, nil
+}
+
+func sameArtistID(a *uint, b *uint) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
+// linkSongArtist は曲をアーティスト名の文字列に合うアーティストに結び付ける。
+func linkSongArtist(db *gorm.DB, song *model.Song) error {
+	id, err := findOrCreateArtist(db, song.Artist)
+	if err != nil {
+		return err
+	}
+	if sameArtistID(song.ArtistID, id) {
+		return nil
+	}
+
+	if err := db.Model(song).UpdateColumn("artist_id", id).Error; err != nil {
+		return err
+	}
+	song.ArtistID = id
+
+	return nil
+}
+
+// linkFavoriteArtist はユーザーのお気に入りのアーティストを文字列に合うアーティストに結び付ける。
+func linkFavoriteArtist(db *gorm.DB, user *model.User) error {
+	id, err := findOrCreateArtist(db, user.FavoriteArtist)
+	if err != nil {
+		return err
+	}
+	if sameArtistID(user.FavoriteArtistID, id) {
+		return nil
+	}
+
+	if err := db.Model(user).UpdateColumn("favorite_artist_id", id).Error; err != nil {
+		return err
+	}
+	user.FavoriteArtistID = id
+
+	return nil
+}
+
+// catalogID は空の ID を nil にする。
+func catalogID(id *string) *string {
+	if id == nil || strings.TrimSpace(*id) == "" {
+		return nil
+	}
+
+	trimmed := strings.TrimSpace(*id)
+	return &trimmed
+}
+
+type ArtistHandler struct {
+	DB *gorm.DB
+}
+
+// アーティストのページを返す。投稿された曲を新しい順に、お気に入りにしているユーザーと曲の年代ごとの数と合わせて返す
+// お気に入りのアーティストを見せていないユーザーは含めない
+func (f *ArtistHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	var page model.ArtistPage
+	if err := f.DB.Preload("Aliases").Where("id = ?", mux.Vars(r)["id"]).Find(&page.Artist).Error; err != nil {
+		var error model.Error
+		error.Message = "該当するアーティストが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+	if page.Artist.Aliases == nil {
+		page.Artist.Aliases = []model.ArtistAlias{}
+	}
+
+	p, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || p < 1 {
+		p = 1
+	}
+
+	hiddenIDs, err := hiddenUserIDs(f.DB, user.ID)
+	if err != nil {
+		var error model.Error
+		error.Message = "アーティストの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	visible := func() *gorm.DB {
+		return excludePrivateUsers(excludeUsers(f.DB, "songs.user_id", hiddenIDs), "songs.user_id", user.ID).
+			Where("songs.artist_id = ? AND songs.hidden_at IS NULL", page.Artist.ID)
+	}
+
+	if err := visible().Model(&model.Song{}).Count(&page.SongCount).Error; err != nil {
+		var error model.Error
+		error.Message = "アーティストの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	page.Songs = []model.Song{}
+	err = visible().Order("songs.created_at desc").
+		Limit(artistSongsPerPage).Offset((p - 1) * artistSongsPerPage).
+		Find(&page.Songs).Error
+	if err != nil {
+		var error model.Error
+		error.Message = "アーティストの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err := loadSongDetails(f.DB, page.Songs); err != nil {
+		var error model.Error
+		error.Message = "アーティストの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	// music_age は曲が出た年。年が分からない曲は数えない
+	page.Decades = []model.ArtistDecade{}
+	err = visible().Model(&model.Song{}).
+		Select("FLOOR(songs.music_age / 10) * 10 AS decade, COUNT(*) AS count").
+		Where("songs.music_age > 0").
+		Group("decade").Order("decade asc").
+		Scan(&page.Decades).Error
+	if err != nil {
+		var error model.Error
+		error.Message = "アーティストの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	following := f.DB.New().Model(&model.UserFollow{}).Select("follow_id").Where("user_id = ?", user.ID).QueryExpr()
+
+	var fans []model.User
+	err = excludeUsers(f.DB, "id", hiddenIDs).
+		Where("favorite_artist_id = ? AND hidden_at IS NULL AND suspended_at IS NULL", page.Artist.ID).
+		Where("favorite_artist_visibility = ? OR id = ? OR (favorite_artist_visibility = ? AND id IN (?))",
+			visibilityPublic, user.ID, visibilityFollowers, following).
+		Order("id asc").Limit(artistFansShown).
+		Find(&fans).Error
+	if err != nil {
+		var error model.Error
+		error.Message = "アーティストの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	page.Fans, err = profilesFor(f.DB, user.ID, fans)
+	if err != nil {
+		var error model.Error
+		error.Message = "アーティストの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, page)
+}
+
+type UpdateArtistHandler struct {
+	DB *gorm.DB
+}
+
+// アーティストの名前・カタログの ID・別名を変更する。ほかのアーティストの名前や別名と重なる場合は変更しない
+func (f *UpdateArtistHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var artist model.Artist
+	if err := f.DB.Where("id = ?", mux.Vars(r)["id"]).Find(&artist).Error; err != nil {
+		var error model.Error
+		error.Message = "該当するアーティストが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.ArtistForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	name := service.CleanArtist(d.Name)
+	normalized := service.NormalizeArtist(name)
+	if normalized == "" {
+		var error model.Error
+		error.Message = "アーティスト名を入力してください。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	seen := map[string]bool{normalized: true}
+	aliases := []model.ArtistAlias{}
+	for _, alias := range d.Aliases {
+		alias = service.CleanArtist(alias)
+		n := service.NormalizeArtist(alias)
+		if n == "" || seen[n] {
+			continue
+		}
+		seen[n] = true
+		aliases = append(aliases, model.ArtistAlias{ArtistID: artist.ID, Name: alias, NormalizedName: n})
+	}
+
+	spotifyID := catalogID(d.SpotifyArtistId)
+	musicBrainzID := catalogID(d.MusicBrainzId)
+
+	err := f.DB.Transaction(func(tx *gorm.DB) error {
+		for n := range seen {
+			owner, err := artistByName(tx, n)
+			if err != nil && !gorm.IsRecordNotFoundError(err) {
+				return err
+			}
+			if err == nil && owner.ID != artist.ID {
+				return errArtistConflict
+			}
+		}
+
+		var count int
+		err := tx.Model(&model.Artist{}).Where("id <> ?", artist.ID).
+			Where("spotify_artist_id = ? OR music_brainz_id = ?", spotifyID, musicBrainzID).
+			Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			return errArtistConflict
+		}
+
+		err = tx.Model(&artist).Updates(map[string]interface{}{
+			"name":              name,
+			"normalized_name":   normalized,
+			"spotify_artist_id": spotifyID,
+			"music_brainz_id":   musicBrainzID,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		// normalized_name に一意制約があるため物理削除する
+		if err := tx.Unscoped().Where("artist_id = ?", artist.ID).Delete(&model.ArtistAlias{}).Error; err != nil {
+			return err
+		}
+		for i := range aliases {
+			if err := tx.Create(&aliases[i]).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err == errArtistConflict {
+		var error model.Error
+		error.Message = "ほかのアーティストと名前・別名・IDが重なっています。統合してください。"
+		errorInResponse(w, http.StatusConflict, error)
+		return
+	}
+	if err != nil {
+		var error model.Error
+		error.Message = "アーティストの更新に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	artist.Aliases = aliases
+	writeJSON(w, artist)
+}
+
+type MergeArtistHandler struct {
+	DB *gorm.DB
+}
+
+// アーティストを別のアーティストにまとめる。曲・ユーザー・別名を移し、元の名前は別名として残す
+// まとめる先に無いカタログの ID は元のアーティストのものを引き継ぐ
+func (f *MergeArtistHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var source model.Artist
+	if err := f.DB.Where("id = ?", mux.Vars(r)["id"]).Find(&source).Error; err != nil {
+		var error model.Error
+		error.Message = "該当するアーティストが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.ArtistMergeForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if d.TargetID == source.ID {
+		var error model.Error
+		error.Message = "同じアーティストにはまとめられません。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	var target model.Artist
+	if err := f.DB.Where("id = ?", d.TargetID).Find(&target).Error; err != nil {
+		var error model.Error
+		error.Message = "まとめる先のアーティストが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	err := f.DB.Transaction(func(tx *gorm.DB) error {
+		// 削除済みの曲やユーザーも外部キーで元のアーティストを指しているので、まとめて移す
+		if err := tx.Unscoped().Model(&model.Song{}).Where("artist_id = ?", source.ID).UpdateColumn("artist_id", target.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Model(&model.User{}).Where("favorite_artist_id = ?", source.ID).UpdateColumn("favorite_artist_id", target.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Model(&model.ArtistAlias{}).Where("artist_id = ?", source.ID).UpdateColumn("artist_id", target.ID).Error; err != nil {
+			return err
+		}
+
+		// normalized_name とカタログの ID に一意制約があるため、引き継ぐ前に物理削除する
+		if err := tx.Unscoped().Delete(&source).Error; err != nil {
+			return err
+		}
+
+		alias := model.ArtistAlias{ArtistID: target.ID, Name: source.Name, NormalizedName: source.NormalizedName}
+		if err := tx.Create(&alias).Error; err != nil {
+			return err
+		}
+
+		updates := map[string]interface{}{}
+		if target.SpotifyArtistId == nil && source.SpotifyArtistId != nil {
+			updates["spotify_artist_id"] = *source.SpotifyArtistId
+		}
+		if target.MusicBrainzId == nil && source.MusicBrainzId != nil {
+			updates["music_brainz_id"] = *source.MusicBrainzId
+		}
+		if len(updates) > 0 {
+			return tx.Model(&target).Updates(updates).Error
+		}
+
+		return nil
+	})
+	if err != nil {
+		var error model.Error
+		error.Message = "アーティストの統合に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err := f.DB.Preload("Aliases").Where("id = ?", target.ID).Find(&target).Error; err != nil {
+		var error model.Error
+		error.Message = "アーティストの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, target)
+}
+
+type MatchArtistsHandler struct {
+	DB *gorm.DB
+}
+
+// アーティストに結び付いていない曲とユーザーを、アーティスト名の文字列から結び付ける。
+// 無いアーティストは作るので、表記の違いで分かれたものは後から統合する
+func (f *MatchArtistsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	result := map[string]int{"songs": 0, "users": 0}
+
+	var lastID uint
+	for {
+		var songs []model.Song
+		err := f.DB.Where("id > ? AND artist_id IS NULL AND artist <> ''", lastID).
+			Order("id asc").Limit(artistMatchBatch).Find(&songs).Error
+		if err != nil {
+			var error model.Error
+			error.Message = "曲の取得に失敗しました。"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+		if len(songs) == 0 {
+			break
+		}
+
+		for i := range songs {
+			if err := linkSongArtist(f.DB, &songs[i]); err != nil {
+				var error model.Error
+				error.Message = "アーティストの照合に失敗しました。"
+				errorInResponse(w, http.StatusInternalServerError, error)
+				return
+			}
+			lastID = songs[i].ID
+			result["songs"]++
+		}
+	}
+
+	lastID = 0
+	for {
+		var users []model.User
+		err := f.DB.Where("id > ? AND favorite_artist_id IS NULL AND favorite_artist <> ''", lastID).
+			Order("id asc").Limit(artistMatchBatch).Find(&users).Error
+		if err != nil {
+			var error model.Error
+			error.Message = "ユーザーの取得に失敗しました。"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+		if len(users) == 0 {
+			break
+		}
+
+		for i := range users {
+			if err := linkFavoriteArtist(f.DB, &users[i]); err != nil {
+				var error model.Error
+				error.Message = "アーティストの照合に失敗しました。"
+				errorInResponse(w, http.StatusInternalServerError, error)
+				return
+			}
+			lastID = users[i].ID
+			result["users"]++
+		}
+	}
+
+	writeJSON(w, result)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"golang-songs/model"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// isBlocked は2人のどちらかがもう一方をブロックしているかを返す。
+func isBlocked(db *gorm.DB, userID uint, otherID uint) (bool, error) {
+	var count int
+	err := db.Model(&model.UserBlock{}).
+		Where("(user_id = ? AND blocked_id = ?) OR (user_id = ? AND blocked_id = ?)", userID, otherID, otherID, userID).
+		Count(&count).Error
+
+	return count > 0, err
+}
+
+// blockedUserIDs はブロックした・されたユーザーのIDを返す。互いのプロフィールを見せないために使う。
+func blockedUserIDs(db *gorm.DB, userID uint) ([]uint, error) {
+	var blocks []model.UserBlock
+	if err := db.Where("user_id = ? OR blocked_id = ?", userID, userID).Find(&blocks).Error; err != nil {
+		return nil, err
+	}
+
+	ids := []uint{}
+	for _, b := range blocks {
+		if b.UserID == userID {
+			ids = append(ids, b.BlockedID)
+		} else {
+			ids = append(ids, b.UserID)
+		}
+	}
+
+	return ids, nil
+}
+
+// hiddenUserIDs は曲一覧から除くユーザーのIDを返す。ブロックに加えてミュートしたユーザーも含む。
+func hiddenUserIDs(db *gorm.DB, userID uint) ([]uint, error) {
+	ids, err := blockedUserIDs(db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var mutes []model.UserMute
+	if err := db.Where("user_id = ?", userID).Find(&mutes).Error; err != nil {
+		return nil, err
+	}
+
+	for _, m := range mutes {
+		ids = append(ids, m.MutedID)
+	}
+
+	return ids, nil
+}
+
+// excludeUsers は column が ids に含まれるレコードを除く。
+// 空のスライスを NOT IN に渡すと全件が除かれるため、その場合は何もしない。
+func excludeUsers(db *gorm.DB, column string, ids []uint) *gorm.DB {
+	if len(ids) == 0 {
+		return db
+	}
+
+	return db.Where(column+" NOT IN (?)", ids)
+}
+
+// pathTargetUser はURLの id のユーザーを返す。自分自身は対象にできない。
+func pathTargetUser(w http.ResponseWriter, r *http.Request, db *gorm.DB, requestUser model.User) (model.User, bool) {
+	var targetUser model.User
+
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		var error model.Error
+		error.Message = "ユーザーのidを取得できません。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return targetUser, false
+	}
+
+	if err := db.Where("id = ?", id).Find(&targetUser).Error; err != nil {
+		var error model.Error
+		error.Message = "該当するユーザーが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return targetUser, false
+	}
+
+	if targetUser.ID == requestUser.ID {
+		var error model.Error
+		error.Message = "自分自身は指定できません。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return targetUser, false
+	}
+
+	return targetUser, true
+}
+
+type BlockUserHandler struct {
+	DB *gorm.DB
+}
+
+// ユーザーをブロックする。お互いのフォローとフォロー申請も解除する
+func (f *BlockUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestUser, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	targetUser, ok := pathTargetUser(w, r, f.DB, requestUser)
+	if !ok {
+		return
+	}
+
+	err := f.DB.Transaction(func(tx *gorm.DB) error {
+		var block model.UserBlock
+		if err := tx.Where(model.UserBlock{UserID: requestUser.ID, BlockedID: targetUser.ID}).FirstOrCreate(&block).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Unscoped().
+			Where("(user_id = ? AND follow_id = ?) OR (user_id = ? AND follow_id = ?)", requestUser.ID, targetUser.ID, targetUser.ID, requestUser.ID).
+			Delete(&model.FollowRequest{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Unscoped().
+			Where("(user_id = ? AND follow_id = ?) OR (user_id = ? AND follow_id = ?)", requestUser.ID, targetUser.ID, targetUser.ID, requestUser.ID).
+			Delete(&model.UserFollow{}).Error
+	})
+	if err != nil {
+		var error model.Error
+		error.Message = "ユーザーのブロックに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type UnblockUserHandler struct {
+	DB *gorm.DB
+}
+
+func (f *UnblockUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestUser, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	targetUser, ok := pathTargetUser(w, r, f.DB, requestUser)
+	if !ok {
+		return
+	}
+
+	// (user_id, blocked_id) に一意制約があるため物理削除する
+	if err := f.DB.Unscoped().Where("user_id = ? AND blocked_id = ?", requestUser.ID, targetUser.ID).Delete(&model.UserBlock{}).Error; err != nil {
+		var error model.Error
+		error.Message = "ブロックの解除に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type MuteUserHandler struct {
+	DB *gorm.DB
+}
+
+// ユーザーをミュートする。相手には通知せず、曲一覧から相手の曲を除くだけ
+func (f *MuteUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestUser, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	targetUser, ok := pathTargetUser(w, r, f.DB, requestUser)
+	if !ok {
+		return
+	}
+
+	var mute model.UserMute
+	if err := f.DB.Where(model.UserMute{UserID: requestUser.ID, MutedID: targetUser.ID}).FirstOrCreate(&mute).Error; err != nil {
+		var error model.Error
+		error.Message = "ユーザーのミュートに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type UnmuteUserHandler struct {
+	DB *gorm.DB
+}
+
+func (f *UnmuteUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestUser, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	targetUser, ok := pathTargetUser(w, r, f.DB, requestUser)
+	if !ok {
+		return
+	}
+
+	if err := f.DB.Unscoped().Where("user_id = ? AND muted_id = ?", requestUser.ID, targetUser.ID).Delete(&model.UserMute{}).Error; err != nil {
+		var error model.Error
+		error.Message = "ミュートの解除に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type BlockedUsersHandler struct {
+	DB *gorm.DB
+}
+
+// ブロックしているユーザーの一覧を返す
+func (f *BlockedUsersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestUser, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	users := []model.User{}
+	if err := f.DB.Where("id IN (?)", f.DB.Model(&model.UserBlock{}).Select("blocked_id").Where("user_id = ?", requestUser.ID).QueryExpr()).Find(&users).Error; err != nil {
+		var error model.Error
+		error.Message = "ユーザー一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	profiles, err := profilesFor(f.DB, requestUser.ID, users)
+	if err != nil {
+		var error model.Error
+		error.Message = "ユーザー一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, profiles)
+}
+
+type MutedUsersHandler struct {
+	DB *gorm.DB
+}
+
+// ミュートしているユーザーの一覧を返す
+func (f *MutedUsersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	requestUser, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	users := []model.User{}
+	if err := f.DB.Where("id IN (?)", f.DB.Model(&model.UserMute{}).Select("muted_id").Where("user_id = ?", requestUser.ID).QueryExpr()).Find(&users).Error; err != nil {
+		var error model.Error
+		error.Message = "ユーザー一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	profiles, err := profilesFor(f.DB, requestUser.ID, users)
+	if err != nil {
+		var error model.Error
+		error.Message = "ユーザー一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, profiles)
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"encoding/json"
+	"golang-songs/model"
+	"golang-songs/service"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+const (
+	songCommentsPerPage  = 20
+	songCommentMaxLength = 1000
+	// songCommentEditWindow を過ぎたコメントは本人でも編集できない
+	songCommentEditWindow = 15 * time.Minute
+)
+
+var errSongNotFound = errors.New("song not found")
+
+// mentionPattern はコメント中の @ユーザー名。名前は空白か句読点までとする
+var mentionPattern = regexp.MustCompile(`@([^\s@,.!?、。！？]+)`)
+
+// visibleSong は id の曲のうち、リクエストユーザーが見られるものを返す。
+// ブロック関係にある投稿者、非表示にされた曲、フォローしていない非公開アカウントの曲は見つからない扱いにする。
+func visibleSong(db *gorm.DB, r *http.Request, user model.User, id interface{}) (model.Song, error) {
+	var song model.Song
+	if err := db.Where("id = ?", id).Find(&song).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return song, errSongNotFound
+		}
+		return song, err
+	}
+
+	if song.HiddenAt != nil && !canSeeHidden(r, song.UserID) {
+		return song, errSongNotFound
+	}
+
+	visible, err := canSeeSong(db, user.ID, song)
+	if err != nil {
+		return song, err
+	}
+	if !visible {
+		return song, errSongNotFound
+	}
+
+	return song, nil
+}
+
+// canSeeSong は viewerID のユーザーが song の投稿者とブロック関係になく、非公開アカウントでも見られるかを返す。
+// 非表示かどうかは見ない。
+func canSeeSong(db *gorm.DB, viewerID uint, song model.Song) (bool, error) {
+	blocked, err := isBlocked(db, viewerID, song.UserID)
+	if err != nil || blocked {
+		return false, err
+	}
+
+	var owner model.User
+	if err := db.Where("id = ?", song.UserID).Find(&owner).Error; err != nil {
+		return false, err
+	}
+
+	return canSeeProfileContent(db, viewerID, owner)
+}
+
+// loadSongDetails は曲一覧にコメント数・リアクション数・タグ・ハッシュタグとつながっている曲を入れる。
+func loadSongDetails(db *gorm.DB, songs []model.Song) error {
+	if len(songs) == 0 {
+		return nil
+	}
+
+	ids := []uint{}
+	for _, song := range songs {
+		ids = append(ids, song.ID)
+	}
+
+	var counts []struct {
+		SongID uint
+		Count  int
+	}
+	err := db.Model(&model.SongComment{}).Select("song_id, count(*) AS count").
+		Where("song_id IN (?) AND hidden_at IS NULL", ids).Group("song_id").Scan(&counts).Error
+	if err != nil {
+		return err
+	}
+
+	bySong := map[uint]int{}
+	for _, c := range counts {
+		bySong[c.SongID] = c.Count
+	}
+	for i := range songs {
+		songs[i].CommentCount = bySong[songs[i].ID]
+	}
+
+	if err := loadReactionCounts(db, songs, ids); err != nil {
+		return err
+	}
+
+	loadSongHashtags(songs)
+
+	if err := loadSongTracks(db, songs); err != nil {
+		return err
+	}
+
+	return loadSongTags(db, songs, ids)
+}
+
+// resolveMentions は本文の @ユーザー名 をユーザーに解決する。
+// 同名のユーザーが複数いる場合は投稿者がフォローしている1人に絞れたときだけ解決する。
+// 投稿者とブロック関係にあるユーザーは含めない。
+func resolveMentions(db *gorm.DB, author model.User, body string) ([]model.SongCommentMention, error) {
+	names := []string{}
+	for _, m := range mentionPattern.FindAllStringSubmatch(body, -1) {
+		if !hasScope(names, m[1]) {
+			names = append(names, m[1])
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	var users []model.User
+	if err := db.Where("name IN (?)", names).Find(&users).Error; err != nil {
+		return nil, err
+	}
+
+	blockedIDs, err := blockedUserIDs(db, author.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := map[string][]model.User{}
+	for _, user := range users {
+		byName[user.Name] = append(byName[user.Name], user)
+	}
+
+	mentions := []model.SongCommentMention{}
+	for _, name := range names {
+		candidates := byName[name]
+		if len(candidates) > 1 {
+			followed := []model.User{}
+			for _, candidate := range candidates {
+				following, err := isFollowing(db, author.ID, candidate.ID)
+				if err != nil {
+					return nil, err
+				}
+				if following {
+					followed = append(followed, candidate)
+				}
+			}
+			candidates = followed
+		}
+		if len(candidates) != 1 {
+			continue
+		}
+
+		if hasUserID(blockedIDs, candidates[0].ID) {
+			continue
+		}
+
+		mentions = append(mentions, model.SongCommentMention{UserID: candidates[0].ID, Name: name})
+	}
+
+	return mentions, nil
+}
+
+// saveMentions はコメントのメンションを置き換える。
+func saveMentions(tx *gorm.DB, comment *model.SongComment, mentions []model.SongCommentMention) error {
+	// (comment_id, user_id) に一意制約があるため物理削除する
+	if err := tx.Unscoped().Where("comment_id = ?", comment.ID).Delete(&model.SongCommentMention{}).Error; err != nil {
+		return err
+	}
+
+	comment.Mentions = []model.SongCommentMention{}
+	for _, mention := range mentions {
+		mention.CommentID = comment.ID
+		if err := tx.Create(&mention).Error; err != nil {
+			return err
+		}
+		comment.Mentions = append(comment.Mentions, mention)
+	}
+
+	return nil
+}
+
+// decodeCommentBody は本文を読み、空や長すぎる場合はエラーを返す。
+func decodeCommentBody(w http.ResponseWriter, r *http.Request) (model.SongCommentForm, bool) {
+	dec := json.NewDecoder(r.Body)
+	var d model.SongCommentForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return d, false
+	}
+
+	d.Body = strings.TrimSpace(d.Body)
+	if d.Body == "" {
+		var error model.Error
+		error.Message = "コメントは必須です。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return d, false
+	}
+	if utf8.RuneCountInString(d.Body) > songCommentMaxLength {
+		var error model.Error
+		error.Message = "コメントは" + strconv.Itoa(songCommentMaxLength) + "文字以内で入力してください。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return d, false
+	}
+
+	return d, true
+}
+
+// attachCommentAuthors はコメントと返信に投稿者のプロフィールを入れる。
+func attachCommentAuthors(db *gorm.DB, viewerID uint, comments []model.SongComment) error {
+	ids := []uint{}
+	for _, comment := range comments {
+		ids = append(ids, comment.UserID)
+		for _, reply := range comment.Replies {
+			ids = append(ids, reply.UserID)
+		}
+	}
+
+	var users []model.User
+	if err := db.Where("id IN (?)", ids).Find(&users).Error; err != nil {
+		return err
+	}
+
+	profiles, err := profilesFor(db, viewerID, users)
+	if err != nil {
+		return err
+	}
+
+	byID := map[uint]model.Profile{}
+	for _, profile := range profiles {
+		byID[profile.ID] = profile
+	}
+
+	attach := func(comment *model.SongComment) {
+		if comment.DeletedAt != nil {
+			return
+		}
+		if profile, ok := byID[comment.UserID]; ok {
+			comment.User = &profile
+		}
+	}
+	for i := range comments {
+		attach(&comments[i])
+		for j := range comments[i].Replies {
+			attach(&comments[i].Replies[j])
+		}
+	}
+
+	return nil
+}
+
+type SongCommentsHandler struct {
+	DB *gorm.DB
+}
+
+// 曲のコメントを新しいスレッド順に返す。返信は古い順にスレッドの中に入れる
+// 削除されたコメントは返信が残っている場合だけ本文を空にして返す
+func (f *SongCommentsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	song, err := visibleSong(f.DB, r, user, mux.Vars(r)["id"])
+	if err != nil {
+		var error model.Error
+		error.Message = "該当する曲が見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	// ブロック・ミュートしたユーザーのコメントは出さない
+	hiddenIDs, err := hiddenUserIDs(f.DB, user.ID)
+	if err != nil {
+		var error model.Error
+		error.Message = "コメントの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	// 確認待ちのコメントは本人にだけ見せる
+	comments := []model.SongComment{}
+	err = excludeUsers(f.DB.Unscoped(), "user_id", hiddenIDs).Preload("Mentions").
+		Where("song_id = ? AND parent_id IS NULL", song.ID).
+		Where("hidden_at IS NULL OR user_id = ?", user.ID).
+		Where("deleted_at IS NULL OR EXISTS (SELECT 1 FROM song_comments replies WHERE replies.parent_id = song_comments.id AND replies.deleted_at IS NULL AND replies.hidden_at IS NULL)").
+		Order("created_at desc").Limit(songCommentsPerPage).Offset((page - 1) * songCommentsPerPage).
+		Find(&comments).Error
+	if err != nil {
+		var error model.Error
+		error.Message = "コメントの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if len(comments) > 0 {
+		ids := []uint{}
+		for _, comment := range comments {
+			ids = append(ids, comment.ID)
+		}
+
+		var replies []model.SongComment
+		err := excludeUsers(f.DB, "user_id", hiddenIDs).Preload("Mentions").
+			Where("parent_id IN (?)", ids).Where("hidden_at IS NULL OR user_id = ?", user.ID).
+			Order("created_at asc").Find(&replies).Error
+		if err != nil {
+			var error model.Error
+			error.Message = "コメントの取得に失敗しました。"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+
+		byParent := map[uint][]model.SongComment{}
+		for _, reply := range replies {
+			byParent[*reply.ParentID] = append(byParent[*reply.ParentID], reply)
+		}
+		for i := range comments {
+			comments[i].Replies = byParent[comments[i].ID]
+			if comments[i].DeletedAt != nil {
+				comments[i].Body = ""
+				comments[i].Mentions = []model.SongCommentMention{}
+			}
+		}
+	}
+
+	if err := attachCommentAuthors(f.DB, user.ID, comments); err != nil {
+		var error model.Error
+		error.Message = "コメントの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, comments)
+}
+
+type CreateSongCommentHandler struct {
+	DB     *gorm.DB
+	Filter *service.TextFilter
+	Hub    *service.Hub
+}
+
+// 曲にコメントする。parentId を指定すると返信になり、返信への返信は元のスレッドにつなぐ
+// 自動フィルタで保留になったコメントは非表示で保存し、誰にも知らせない
+func (f *CreateSongCommentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	d, ok := decodeCommentBody(w, r)
+	if !ok {
+		return
+	}
+
+	heldRule, ok := filterText(w, f.Filter, d.Body)
+	if !ok {
+		return
+	}
+
+	song, err := visibleSong(f.DB, r, user, mux.Vars(r)["id"])
+	if err != nil {
+		var error model.Error
+		error.Message = "該当する曲が見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	comment := model.SongComment{SongID: song.ID, UserID: user.ID, Body: d.Body}
+
+	var parent model.SongComment
+	if d.ParentID != nil {
+		if err := f.DB.Where("id = ? AND song_id = ?", *d.ParentID, song.ID).Find(&parent).Error; err != nil {
+			var error model.Error
+			error.Message = "返信先のコメントが見つかりません。"
+			errorInResponse(w, http.StatusNotFound, error)
+			return
+		}
+
+		if blocked, err := isBlocked(f.DB, user.ID, parent.UserID); err != nil || blocked {
+			var error model.Error
+			error.Message = "このコメントには返信できません。"
+			errorInResponse(w, http.StatusForbidden, error)
+			return
+		}
+
+		comment.ParentID = &parent.ID
+		if parent.ParentID != nil {
+			comment.ParentID = parent.ParentID
+		}
+	}
+
+	mentions, err := resolveMentions(f.DB, user, d.Body)
+	if err != nil {
+		var error model.Error
+		error.Message = "コメントの投稿に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	err = f.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&comment).Error; err != nil {
+			return err
+		}
+
+		return saveMentions(tx, &comment, mentions)
+	})
+	if err != nil {
+		var error model.Error
+		error.Message = "コメントの投稿に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if heldRule != "" {
+		if err := holdForReview(f.DB, reportTargetComment, comment.ID, heldRule); err != nil {
+			var error model.Error
+			error.Message = "コメントの投稿に失敗しました。"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, comment)
+		return
+	}
+
+	// 同じ人に複数の理由で届く場合は、メンション、返信、コメントの順に1件だけ知らせる
+	// 曲を見られない人へのメンションは知らせない
+	notified := map[uint]bool{}
+	for _, mention := range comment.Mentions {
+		visible, err := canSeeSong(f.DB, mention.UserID, song)
+		if err != nil || !visible {
+			continue
+		}
+		notifyOrLog(f.DB, f.Hub, mention.UserID, user, notificationMention, &song.ID, &comment.ID)
+		notified[mention.UserID] = true
+	}
+	if comment.ParentID != nil && !notified[parent.UserID] {
+		notifyOrLog(f.DB, f.Hub, parent.UserID, user, notificationReply, &song.ID, &comment.ID)
+		notified[parent.UserID] = true
+	}
+	if !notified[song.UserID] {
+		notifyOrLog(f.DB, f.Hub, song.UserID, user, notificationComment, &song.ID, &comment.ID)
+	}
+
+	writeJSON(w, comment)
+}
+
+type UpdateSongCommentHandler struct {
+	DB     *gorm.DB
+	Filter *service.TextFilter
+}
+
+// 自分のコメントを編集する。投稿から songCommentEditWindow を過ぎると編集できない
+// 自動フィルタで保留になった場合はコメントを非表示にして確認待ちに入れる
+func (f *UpdateSongCommentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	d, ok := decodeCommentBody(w, r)
+	if !ok {
+		return
+	}
+
+	heldRule, ok := filterText(w, f.Filter, d.Body)
+	if !ok {
+		return
+	}
+
+	var comment model.SongComment
+	if err := f.DB.Where("id = ? AND user_id = ?", mux.Vars(r)["id"], user.ID).Find(&comment).Error; err != nil {
+		var error model.Error
+		error.Message = "該当するコメントが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	if time.Since(comment.CreatedAt) > songCommentEditWindow {
+		var error model.Error
+		error.Message = "編集できる期間を過ぎています。"
+		errorInResponse(w, http.StatusForbidden, error)
+		return
+	}
+
+	mentions, err := resolveMentions(f.DB, user, d.Body)
+	if err != nil {
+		var error model.Error
+		error.Message = "コメントの編集に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	err = f.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		comment.Body = d.Body
+		comment.EditedAt = &now
+
+		err := tx.Model(&comment).Updates(map[string]interface{}{
+			"body":      comment.Body,
+			"edited_at": now,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		return saveMentions(tx, &comment, mentions)
+	})
+	if err != nil {
+		var error model.Error
+		error.Message = "コメントの編集に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if heldRule != "" {
+		if err := holdForReview(f.DB, reportTargetComment, comment.ID, heldRule); err != nil {
+			var error model.Error
+			error.Message = "コメントの編集に失敗しました。"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+
+	writeJSON(w, comment)
+}
+
+type DeleteSongCommentHandler struct {
+	DB *gorm.DB
+}
+
+// コメントを論理削除する。本人のほか、曲の投稿者とモデレーターも削除できる
+func (f *DeleteSongCommentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	var comment model.SongComment
+	if err := f.DB.Where("id = ?", mux.Vars(r)["id"]).Find(&comment).Error; err != nil {
+		var error model.Error
+		error.Message = "該当するコメントが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	var song model.Song
+	if err := f.DB.Unscoped().Where("id = ?", comment.SongID).Find(&song).Error; err != nil {
+		var error model.Error
+		error.Message = "該当する曲が見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	if comment.UserID != user.ID && !canSeeHidden(r, song.UserID) {
+		var error model.Error
+		error.Message = "このコメントを削除する権限がありません。"
+		errorInResponse(w, http.StatusForbidden, error)
+		return
+	}
+
+	if err := f.DB.Delete(&comment).Error; err != nil {
+		var error model.Error
+		error.Message = "コメントの削除に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
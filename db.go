@@ -0,0 +1,32 @@
+package main
+
+import (
+	"github.com/go-sql-driver/mysql"
+	"github.com/pkg/errors"
+)
+
+// mysqlDuplicateEntry は一意キーに反したときの MySQL のエラー番号
+const mysqlDuplicateEntry = 1062
+
+// duplicateRetries は一意キーに当たったときにやり直す回数
+const duplicateRetries = 3
+
+// isDuplicateKeyError は err が一意キーへの違反かを返す。
+func isDuplicateKeyError(err error) bool {
+	e, ok := errors.Cause(err).(*mysql.MySQLError)
+
+	return ok && e.Number == mysqlDuplicateEntry
+}
+
+// retryOnDuplicate は fn を実行し、同時に同じ行を作ろうとして一意キーに当たった場合はやり直す。
+// トランザクションごとやり直すので、先に作られた行は次の回で見える。
+func retryOnDuplicate(fn func() error) error {
+	var err error
+	for i := 0; i < duplicateRetries; i++ {
+		if err = fn(); !isDuplicateKeyError(err) {
+			return err
+		}
+	}
+
+	return err
+}
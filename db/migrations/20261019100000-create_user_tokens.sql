@@ -0,0 +1,16 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS user_tokens (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    user_id BIGINT NOT NULL,
+    purpose varchar(255) NOT NULL,
+    jti varchar(255) NOT NULL unique,
+    expires_at timestamp NOT NULL,
+    used_at timestamp NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS user_tokens;
@@ -0,0 +1,4 @@
+-- +migrate Up
+ALTER TABLE users ADD COLUMN email_verified_at timestamp NULL AFTER password;
+-- +migrate Down
+ALTER TABLE users DROP COLUMN email_verified_at;
@@ -0,0 +1,8 @@
+-- +migrate Up
+ALTER TABLE users
+    ADD COLUMN pending_email varchar(255) NOT NULL DEFAULT '' AFTER email_verified_at,
+    ADD COLUMN token_version int NOT NULL DEFAULT 0 AFTER pending_email;
+-- +migrate Down
+ALTER TABLE users
+    DROP COLUMN pending_email,
+    DROP COLUMN token_version;
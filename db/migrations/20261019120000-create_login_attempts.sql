@@ -0,0 +1,15 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS login_attempts (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    email varchar(255) NOT NULL,
+    ip varchar(255) NOT NULL,
+    succeeded boolean NOT NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    INDEX (email, created_at),
+    INDEX (ip, created_at)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS login_attempts;
@@ -0,0 +1,10 @@
+-- +migrate Up
+ALTER TABLE users
+    ADD COLUMN totp_secret varchar(255) NOT NULL DEFAULT '' AFTER token_version,
+    ADD COLUMN totp_enabled boolean NOT NULL DEFAULT false AFTER totp_secret,
+    ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0 AFTER totp_enabled;
+-- +migrate Down
+ALTER TABLE users
+    DROP COLUMN totp_secret,
+    DROP COLUMN totp_enabled,
+    DROP COLUMN totp_last_step;
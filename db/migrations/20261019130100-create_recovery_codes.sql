@@ -0,0 +1,14 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    user_id BIGINT NOT NULL,
+    code_hash varchar(255) NOT NULL,
+    used_at timestamp NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS recovery_codes;
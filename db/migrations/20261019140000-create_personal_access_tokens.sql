@@ -0,0 +1,17 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    user_id BIGINT NOT NULL,
+    name varchar(255) NOT NULL,
+    token_hash varchar(255) NOT NULL unique,
+    token_prefix varchar(255) NOT NULL,
+    scopes varchar(255) NOT NULL,
+    last_used_at timestamp NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS personal_access_tokens;
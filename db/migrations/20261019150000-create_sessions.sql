@@ -0,0 +1,16 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS sessions (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    user_id BIGINT NOT NULL,
+    jti varchar(255) NOT NULL unique,
+    user_agent varchar(255) NOT NULL,
+    ip varchar(255) NOT NULL,
+    last_seen_at timestamp NOT NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS sessions;
@@ -0,0 +1,4 @@
+-- +migrate Up
+ALTER TABLE users ADD COLUMN spotify_id varchar(255) NULL unique AFTER totp_last_step;
+-- +migrate Down
+ALTER TABLE users DROP COLUMN spotify_id;
@@ -0,0 +1,4 @@
+-- +migrate Up
+ALTER TABLE users ADD COLUMN suspended_at timestamp NULL;
+-- +migrate Down
+ALTER TABLE users DROP COLUMN suspended_at;
@@ -0,0 +1,15 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS user_blocks (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    user_id BIGINT NOT NULL,
+    blocked_id BIGINT NOT NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    UNIQUE (user_id, blocked_id),
+    FOREIGN KEY(user_id) REFERENCES users(id),
+    FOREIGN KEY(blocked_id) REFERENCES users(id)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS user_blocks;
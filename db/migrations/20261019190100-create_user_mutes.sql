@@ -0,0 +1,15 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS user_mutes (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    user_id BIGINT NOT NULL,
+    muted_id BIGINT NOT NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    UNIQUE (user_id, muted_id),
+    FOREIGN KEY(user_id) REFERENCES users(id),
+    FOREIGN KEY(muted_id) REFERENCES users(id)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS user_mutes;
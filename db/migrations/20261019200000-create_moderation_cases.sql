@@ -0,0 +1,17 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS moderation_cases (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    target_type varchar(255) NOT NULL,
+    target_id BIGINT NOT NULL,
+    status varchar(255) NOT NULL,
+    report_count int NOT NULL DEFAULT 0,
+    resolved_at timestamp NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    INDEX (target_type, target_id, status),
+    INDEX (status, report_count)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS moderation_cases;
@@ -0,0 +1,19 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS reports (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    reporter_id BIGINT NOT NULL,
+    target_type varchar(255) NOT NULL,
+    target_id BIGINT NOT NULL,
+    reason varchar(255) NOT NULL,
+    detail text NOT NULL,
+    moderation_case_id BIGINT NOT NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    UNIQUE (reporter_id, moderation_case_id),
+    FOREIGN KEY(reporter_id) REFERENCES users(id),
+    FOREIGN KEY(moderation_case_id) REFERENCES moderation_cases(id)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS reports;
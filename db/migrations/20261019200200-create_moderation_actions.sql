@@ -0,0 +1,16 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS moderation_actions (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    moderation_case_id BIGINT NOT NULL,
+    moderator_id BIGINT NOT NULL,
+    action varchar(255) NOT NULL,
+    note text NOT NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    FOREIGN KEY(moderation_case_id) REFERENCES moderation_cases(id),
+    FOREIGN KEY(moderator_id) REFERENCES users(id)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS moderation_actions;
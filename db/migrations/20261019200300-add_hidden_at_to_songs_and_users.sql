@@ -0,0 +1,6 @@
+-- +migrate Up
+ALTER TABLE songs ADD COLUMN hidden_at timestamp NULL;
+ALTER TABLE users ADD COLUMN hidden_at timestamp NULL;
+-- +migrate Down
+ALTER TABLE songs DROP COLUMN hidden_at;
+ALTER TABLE users DROP COLUMN hidden_at;
@@ -0,0 +1,4 @@
+-- +migrate Up
+ALTER TABLE moderation_cases ADD COLUMN flagged_rule varchar(255) NOT NULL DEFAULT '' AFTER report_count;
+-- +migrate Down
+ALTER TABLE moderation_cases DROP COLUMN flagged_rule;
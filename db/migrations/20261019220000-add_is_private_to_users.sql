@@ -0,0 +1,4 @@
+-- +migrate Up
+ALTER TABLE users ADD COLUMN is_private tinyint(1) NOT NULL DEFAULT 0;
+-- +migrate Down
+ALTER TABLE users DROP COLUMN is_private;
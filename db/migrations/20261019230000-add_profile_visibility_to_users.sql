@@ -0,0 +1,10 @@
+-- +migrate Up
+ALTER TABLE users ADD COLUMN age_visibility varchar(16) NOT NULL DEFAULT 'public';
+ALTER TABLE users ADD COLUMN gender_visibility varchar(16) NOT NULL DEFAULT 'public';
+ALTER TABLE users ADD COLUMN favorite_music_age_visibility varchar(16) NOT NULL DEFAULT 'public';
+ALTER TABLE users ADD COLUMN favorite_artist_visibility varchar(16) NOT NULL DEFAULT 'public';
+-- +migrate Down
+ALTER TABLE users DROP COLUMN age_visibility;
+ALTER TABLE users DROP COLUMN gender_visibility;
+ALTER TABLE users DROP COLUMN favorite_music_age_visibility;
+ALTER TABLE users DROP COLUMN favorite_artist_visibility;
@@ -0,0 +1,6 @@
+-- +migrate Up
+ALTER TABLE users ADD COLUMN birth_year smallint NULL AFTER email, ADD COLUMN birth_month tinyint NULL AFTER birth_year;
+-- 登録時点の年齢から生まれ年を推定する。age は戻せるよう残し、以降は書き込まない
+UPDATE users SET birth_year = YEAR(created_at) - age WHERE age IS NOT NULL AND age > 0;
+-- +migrate Down
+ALTER TABLE users DROP COLUMN birth_year, DROP COLUMN birth_month;
@@ -0,0 +1,17 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS playlist_items (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    playlist_id BIGINT NOT NULL,
+    song_id BIGINT NOT NULL,
+    position int NOT NULL,
+    note varchar(255) NOT NULL DEFAULT '',
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    INDEX (playlist_id, position),
+    FOREIGN KEY(playlist_id) REFERENCES playlists(id),
+    FOREIGN KEY(song_id) REFERENCES songs(id)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS playlist_items;
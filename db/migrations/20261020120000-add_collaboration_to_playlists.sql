@@ -0,0 +1,9 @@
+-- +migrate Up
+ALTER TABLE playlists ADD COLUMN version int unsigned NOT NULL DEFAULT 0 AFTER cover_image;
+ALTER TABLE playlist_items ADD COLUMN added_by_id BIGINT NULL AFTER note;
+UPDATE playlist_items INNER JOIN playlists ON playlists.id = playlist_items.playlist_id SET playlist_items.added_by_id = playlists.user_id;
+ALTER TABLE playlist_items MODIFY added_by_id BIGINT NOT NULL, ADD CONSTRAINT fk_playlist_items_added_by_id FOREIGN KEY(added_by_id) REFERENCES users(id);
+-- +migrate Down
+ALTER TABLE playlist_items DROP FOREIGN KEY fk_playlist_items_added_by_id;
+ALTER TABLE playlist_items DROP COLUMN added_by_id;
+ALTER TABLE playlists DROP COLUMN version;
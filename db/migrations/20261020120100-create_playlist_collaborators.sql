@@ -0,0 +1,17 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS playlist_collaborators (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    playlist_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    role varchar(16) NOT NULL,
+    accepted_at timestamp NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    UNIQUE (playlist_id, user_id),
+    FOREIGN KEY(playlist_id) REFERENCES playlists(id),
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS playlist_collaborators;
@@ -0,0 +1,18 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS playlist_activities (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    playlist_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    action varchar(16) NOT NULL,
+    song_id BIGINT NULL,
+    version int unsigned NOT NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    INDEX (playlist_id, created_at),
+    FOREIGN KEY(playlist_id) REFERENCES playlists(id),
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS playlist_activities;
@@ -0,0 +1,19 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS song_comments (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    song_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    parent_id BIGINT NULL,
+    body text NOT NULL,
+    edited_at timestamp NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    INDEX (song_id, parent_id, created_at),
+    FOREIGN KEY(song_id) REFERENCES songs(id),
+    FOREIGN KEY(user_id) REFERENCES users(id),
+    FOREIGN KEY(parent_id) REFERENCES song_comments(id)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS song_comments;
@@ -0,0 +1,17 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS song_comment_mentions (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    comment_id BIGINT NOT NULL,
+    user_id BIGINT NOT NULL,
+    name varchar(255) NOT NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    UNIQUE (comment_id, user_id),
+    INDEX (user_id),
+    FOREIGN KEY(comment_id) REFERENCES song_comments(id),
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS song_comment_mentions;
@@ -0,0 +1,17 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS song_reactions (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    user_id BIGINT NOT NULL,
+    song_id BIGINT NOT NULL,
+    type varchar(32) NOT NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    UNIQUE (user_id, song_id),
+    INDEX (song_id, type),
+    FOREIGN KEY(user_id) REFERENCES users(id),
+    FOREIGN KEY(song_id) REFERENCES songs(id)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS song_reactions;
@@ -0,0 +1,20 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS notifications (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    user_id BIGINT NOT NULL,
+    type varchar(32) NOT NULL,
+    group_key varchar(255) NOT NULL,
+    song_id BIGINT NULL,
+    comment_id BIGINT NULL,
+    actor_count int NOT NULL DEFAULT 0,
+    read_at timestamp NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    INDEX (user_id, updated_at),
+    INDEX (user_id, group_key, read_at),
+    FOREIGN KEY(user_id) REFERENCES users(id)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS notifications;
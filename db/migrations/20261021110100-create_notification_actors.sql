@@ -0,0 +1,15 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS notification_actors (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    notification_id BIGINT NOT NULL,
+    actor_id BIGINT NOT NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    UNIQUE (notification_id, actor_id),
+    FOREIGN KEY(notification_id) REFERENCES notifications(id),
+    FOREIGN KEY(actor_id) REFERENCES users(id)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS notification_actors;
@@ -0,0 +1,13 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS tags (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    name varchar(64) NOT NULL,
+    normalized_name varchar(64) NOT NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    UNIQUE (normalized_name)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS tags;
@@ -0,0 +1,16 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS song_tags (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    song_id BIGINT NOT NULL,
+    tag_id BIGINT NOT NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    UNIQUE (song_id, tag_id),
+    INDEX (tag_id, created_at),
+    FOREIGN KEY(song_id) REFERENCES songs(id),
+    FOREIGN KEY(tag_id) REFERENCES tags(id)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS song_tags;
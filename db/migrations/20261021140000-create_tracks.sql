@@ -0,0 +1,20 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS tracks (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    spotify_track_id varchar(255),
+    isrc varchar(12),
+    title varchar(255) NOT NULL,
+    artist varchar(255) NOT NULL,
+    album varchar(255),
+    image varchar(255),
+    music_age int NOT NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    UNIQUE (spotify_track_id),
+    UNIQUE (isrc),
+    INDEX (title, artist)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS tracks;
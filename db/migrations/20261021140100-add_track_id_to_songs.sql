@@ -0,0 +1,21 @@
+-- +migrate Up
+ALTER TABLE songs ADD COLUMN track_id BIGINT NULL AFTER spotify_track_id, ADD CONSTRAINT fk_songs_track_id FOREIGN KEY(track_id) REFERENCES tracks(id);
+-- 同じ Spotify の曲の投稿を、最初の投稿の内容で1つの曲にまとめる。曲 ID の前後の空白はアプリと同じく無視する
+INSERT INTO tracks (spotify_track_id, title, artist, album, image, music_age, created_at, updated_at)
+SELECT TRIM(songs.spotify_track_id), songs.title, songs.artist, songs.album, songs.image, songs.music_age, songs.created_at, songs.created_at
+FROM songs INNER JOIN (
+    SELECT MIN(id) AS id FROM songs WHERE spotify_track_id IS NOT NULL AND TRIM(spotify_track_id) <> '' AND deleted_at IS NULL GROUP BY TRIM(spotify_track_id)
+) firsts ON firsts.id = songs.id;
+UPDATE songs INNER JOIN tracks ON tracks.spotify_track_id = TRIM(songs.spotify_track_id) SET songs.track_id = tracks.id;
+-- Spotify の曲でない投稿は曲名とアーティストが同じものをまとめる
+INSERT INTO tracks (title, artist, album, image, music_age, created_at, updated_at)
+SELECT songs.title, songs.artist, songs.album, songs.image, songs.music_age, songs.created_at, songs.created_at
+FROM songs INNER JOIN (
+    SELECT MIN(id) AS id FROM songs WHERE (spotify_track_id IS NULL OR TRIM(spotify_track_id) = '') AND deleted_at IS NULL GROUP BY title, artist
+) firsts ON firsts.id = songs.id;
+UPDATE songs INNER JOIN tracks ON tracks.spotify_track_id IS NULL AND tracks.isrc IS NULL AND tracks.title = songs.title AND tracks.artist = songs.artist
+SET songs.track_id = tracks.id
+WHERE songs.track_id IS NULL AND (songs.spotify_track_id IS NULL OR TRIM(songs.spotify_track_id) = '');
+-- +migrate Down
+ALTER TABLE songs DROP FOREIGN KEY fk_songs_track_id;
+ALTER TABLE songs DROP COLUMN track_id;
@@ -0,0 +1,17 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS artists (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    name varchar(255) NOT NULL,
+    normalized_name varchar(255) NOT NULL,
+    spotify_artist_id varchar(255),
+    music_brainz_id varchar(36),
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    UNIQUE (normalized_name),
+    UNIQUE (spotify_artist_id),
+    UNIQUE (music_brainz_id)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS artists;
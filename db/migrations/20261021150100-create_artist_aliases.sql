@@ -0,0 +1,15 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS artist_aliases (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    artist_id BIGINT NOT NULL,
+    name varchar(255) NOT NULL,
+    normalized_name varchar(255) NOT NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    UNIQUE (normalized_name),
+    FOREIGN KEY(artist_id) REFERENCES artists(id)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS artist_aliases;
@@ -0,0 +1,9 @@
+-- +migrate Up
+-- 既存の行は表記を揃える必要があるため、管理APIの照合(POST /api/admin/artists/match)で結び付ける
+ALTER TABLE songs ADD COLUMN artist_id BIGINT NULL AFTER artist, ADD CONSTRAINT fk_songs_artist_id FOREIGN KEY(artist_id) REFERENCES artists(id);
+ALTER TABLE users ADD COLUMN favorite_artist_id BIGINT NULL AFTER favorite_artist, ADD CONSTRAINT fk_users_favorite_artist_id FOREIGN KEY(favorite_artist_id) REFERENCES artists(id);
+-- +migrate Down
+ALTER TABLE songs DROP FOREIGN KEY fk_songs_artist_id;
+ALTER TABLE songs DROP COLUMN artist_id;
+ALTER TABLE users DROP FOREIGN KEY fk_users_favorite_artist_id;
+ALTER TABLE users DROP COLUMN favorite_artist_id;
@@ -0,0 +1,18 @@
+-- +migrate Up
+CREATE TABLE IF NOT EXISTS oidc_login_states (
+    id BIGINT AUTO_INCREMENT NOT NULL,
+    jti varchar(255) NOT NULL,
+    provider varchar(255) NOT NULL,
+    code_verifier varchar(255) NOT NULL,
+    nonce varchar(255) NOT NULL,
+    binding_hash varchar(64) NOT NULL,
+    expires_at timestamp NOT NULL,
+    used_at timestamp NULL,
+    created_at timestamp NOT NULL,
+    updated_at timestamp NOT NULL,
+    deleted_at timestamp,
+    PRIMARY KEY (id),
+    UNIQUE (jti)
+);
+-- +migrate Down
+DROP TABLE IF EXISTS oidc_login_states;
@@ -0,0 +1,4 @@
+-- +migrate Up
+ALTER TABLE users ADD COLUMN pending_comment varchar(255) NULL AFTER comment;
+-- +migrate Down
+ALTER TABLE users DROP COLUMN pending_comment;
@@ -0,0 +1,4 @@
+-- +migrate Up
+ALTER TABLE song_comments ADD COLUMN hidden_at timestamp NULL AFTER edited_at;
+-- +migrate Down
+ALTER TABLE song_comments DROP COLUMN hidden_at;
@@ -0,0 +1,5 @@
+-- +migrate Up
+-- Spotify のログインでも使うため、OIDC に限らない名前にする
+RENAME TABLE oidc_login_states TO oauth_login_states;
+-- +migrate Down
+RENAME TABLE oauth_login_states TO oidc_login_states;
@@ -0,0 +1,12 @@
+-- +migrate Up
+ALTER TABLE moderation_cases ADD COLUMN open_key tinyint(1) NULL AFTER status;
+ALTER TABLE moderation_cases ADD COLUMN hold_applied tinyint(1) NOT NULL DEFAULT 0 AFTER flagged_rule;
+UPDATE moderation_cases c
+    JOIN (SELECT MIN(id) AS id FROM moderation_cases WHERE status = 'open' GROUP BY target_type, target_id) o ON o.id = c.id
+    SET c.open_key = 1;
+UPDATE moderation_cases SET hold_applied = 1 WHERE status = 'open' AND flagged_rule <> '';
+ALTER TABLE moderation_cases ADD CONSTRAINT uq_moderation_cases_open UNIQUE (target_type, target_id, open_key);
+-- +migrate Down
+ALTER TABLE moderation_cases DROP INDEX uq_moderation_cases_open;
+ALTER TABLE moderation_cases DROP COLUMN hold_applied;
+ALTER TABLE moderation_cases DROP COLUMN open_key;
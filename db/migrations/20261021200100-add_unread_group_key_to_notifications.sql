@@ -0,0 +1,9 @@
+-- +migrate Up
+ALTER TABLE notifications ADD COLUMN unread_group_key varchar(255) NULL AFTER group_key;
+UPDATE notifications n
+    JOIN (SELECT MAX(id) AS id FROM notifications WHERE read_at IS NULL GROUP BY user_id, group_key) u ON u.id = n.id
+    SET n.unread_group_key = n.group_key;
+ALTER TABLE notifications ADD CONSTRAINT uq_notifications_unread_group UNIQUE (user_id, unread_group_key);
+-- +migrate Down
+ALTER TABLE notifications DROP INDEX uq_notifications_unread_group;
+ALTER TABLE notifications DROP COLUMN unread_group_key;
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"golang-songs/model"
+	"golang-songs/service"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/jinzhu/gorm"
+)
+
+// hashtagReindexBatch は説明文からハッシュタグを作り直すときに1回で読む曲の数
+const hashtagReindexBatch = 500
+
+// syncHashtags は曲の説明文のハッシュタグをタグとして保存し、消えたハッシュタグのつながりを外す。
+// 長すぎるハッシュタグはタグにしない。
+func syncHashtags(db *gorm.DB, song model.Song) error {
+	texts := []string{}
+	for _, hashtag := range service.ExtractHashtags(song.Description) {
+		texts = append(texts, hashtag.Text)
+	}
+
+	names := []string{}
+	for _, name := range cleanTags(texts) {
+		if utf8.RuneCountInString(name) <= tagMaxLength {
+			names = append(names, name)
+		}
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		tags, err := findOrCreateTags(tx, names)
+		if err != nil {
+			return err
+		}
+
+		ids := []uint{}
+		for _, tag := range tags {
+			ids = append(ids, tag.ID)
+		}
+
+		// (song_id, tag_id) に一意制約があるため物理削除する
+		query := tx.Unscoped().Where("song_id = ?", song.ID)
+		if len(ids) > 0 {
+			query = query.Where("tag_id NOT IN (?)", ids)
+		}
+		if err := query.Delete(&model.SongHashtag{}).Error; err != nil {
+			return err
+		}
+
+		for _, id := range ids {
+			var songHashtag model.SongHashtag
+			if err := tx.Where(model.SongHashtag{SongID: song.ID, TagID: id}).FirstOrCreate(&songHashtag).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// loadSongHashtags は曲一覧に説明文のハッシュタグの位置を入れる。
+func loadSongHashtags(songs []model.Song) {
+	for i := range songs {
+		songs[i].Hashtags = service.ExtractHashtags(songs[i].Description)
+	}
+}
+
+type ReindexHashtagsHandler struct {
+	DB *gorm.DB
+}
+
+// すべての曲の説明文からハッシュタグのつながりを作り直す。ハッシュタグの保存を始める前の曲にも使う
+func (f *ReindexHashtagsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	count := 0
+	var lastID uint
+
+	for {
+		var songs []model.Song
+		if err := f.DB.Where("id > ?", lastID).Order("id asc").Limit(hashtagReindexBatch).Find(&songs).Error; err != nil {
+			var error model.Error
+			error.Message = "曲の取得に失敗しました。"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+		if len(songs) == 0 {
+			break
+		}
+
+		for _, song := range songs {
+			if err := syncHashtags(f.DB, song); err != nil {
+				var error model.Error
+				error.Message = "ハッシュタグの保存に失敗しました。"
+				errorInResponse(w, http.StatusInternalServerError, error)
+				return
+			}
+			lastID = song.ID
+			count++
+		}
+	}
+
+	writeJSON(w, map[string]int{"songs": count})
+}
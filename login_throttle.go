@@ -0,0 +1,127 @@
+package main
+
+import (
+	"golang-songs/model"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ログイン失敗の数え方
+// アカウント単位はログイン成功でリセットし、IP単位は他人のアカウントで総当たりされないようリセットしない
+const (
+	loginFailureWindow   = 15 * time.Minute
+	loginLockoutDuration = 15 * time.Minute
+
+	accountBackoffAfter = 3
+	accountLockoutAfter = 10
+	ipBackoffAfter      = 10
+	ipLockoutAfter      = 50
+)
+
+// clientIP はリクエスト元のIPを返す。
+// TRUST_PROXY が true の場合は ELB が末尾に追加した X-Forwarded-For を使う。
+func clientIP(r *http.Request) string {
+	if os.Getenv("TRUST_PROXY") == "true" {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			ips := strings.Split(forwarded, ",")
+			return strings.TrimSpace(ips[len(ips)-1])
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// loginRetryAfter は email と IP の直近の失敗回数から、次にログインを試せるまでの待ち時間を返す。
+func loginRetryAfter(db *gorm.DB, email string, ip string) (time.Duration, error) {
+	since := time.Now().Add(-loginFailureWindow)
+
+	var lastSuccess model.LoginAttempt
+	err := db.Where("email = ? AND succeeded = ? AND created_at > ?", email, true, since).Order("created_at desc").Limit(1).Find(&lastSuccess).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		return 0, err
+	}
+
+	accountSince := since
+	if err == nil {
+		accountSince = lastSuccess.CreatedAt
+	}
+
+	accountWait, err := failureBackoff(db, "email", email, accountSince, accountBackoffAfter, accountLockoutAfter)
+	if err != nil {
+		return 0, err
+	}
+
+	ipWait, err := failureBackoff(db, "ip", ip, since, ipBackoffAfter, ipLockoutAfter)
+	if err != nil {
+		return 0, err
+	}
+
+	if ipWait > accountWait {
+		return ipWait, nil
+	}
+
+	return accountWait, nil
+}
+
+// 失敗が backoffAfter 回を超えると1秒から倍々に待たせ、lockoutAfter 回で一定時間ロックする
+func failureBackoff(db *gorm.DB, column string, value string, since time.Time, backoffAfter int, lockoutAfter int) (time.Duration, error) {
+	var failures int
+	var lastFailure *time.Time
+
+	row := db.Model(&model.LoginAttempt{}).
+		Where(column+" = ? AND succeeded = ? AND created_at > ?", value, false, since).
+		Select("COUNT(*), MAX(created_at)").Row()
+	if err := row.Scan(&failures, &lastFailure); err != nil {
+		return 0, err
+	}
+
+	wait := backoffWait(failures, backoffAfter, lockoutAfter)
+	if wait == 0 {
+		return 0, nil
+	}
+
+	remaining := time.Until(lastFailure.Add(wait))
+	if remaining < 0 {
+		return 0, nil
+	}
+
+	return remaining, nil
+}
+
+// backoffWait は failures 回失敗した後の待ち時間を返す。
+// 倍々に増やすのは loginLockoutDuration までにし、失敗が多いほど待ち時間が短くなることはない
+func backoffWait(failures int, backoffAfter int, lockoutAfter int) time.Duration {
+	if failures >= lockoutAfter {
+		return loginLockoutDuration
+	}
+	if failures < backoffAfter {
+		return 0
+	}
+
+	wait := time.Second
+	for i := backoffAfter; i < failures && wait < loginLockoutDuration; i++ {
+		wait *= 2
+	}
+	if wait > loginLockoutDuration {
+		wait = loginLockoutDuration
+	}
+
+	return wait
+}
+
+func recordLoginAttempt(db *gorm.DB, email string, ip string, succeeded bool) error {
+	return db.Create(&model.LoginAttempt{
+		Email:     email,
+		IP:        ip,
+		Succeeded: succeeded}).Error
+}
@@ -5,11 +5,13 @@ import (
 	"fmt"
 	"golang-songs/controller"
 	"golang-songs/model"
+	"golang-songs/service"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"strings"
+	"strconv"
+	"time"
 
 	"github.com/pkg/errors"
 
@@ -18,7 +20,6 @@ import (
 	"github.com/joho/godotenv"
 
 	jwtmiddleware "github.com/auth0/go-jwt-middleware"
-	"github.com/davecgh/go-spew/spew"
 	jwt "github.com/dgrijalva/jwt-go"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
 	"golang.org/x/crypto/bcrypt"
@@ -37,7 +38,8 @@ func errorInResponse(w http.ResponseWriter, status int, error model.Error) {
 }
 
 type SignUpHandler struct {
-	DB *gorm.DB
+	DB     *gorm.DB
+	Mailer service.Mailer
 }
 
 func (f *SignUpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -69,10 +71,6 @@ func (f *SignUpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// dump も出せる
-	fmt.Println("---------------------")
-	spew.Dump(user)
-
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), 10)
 	if err != nil {
 		var error model.Error
@@ -83,15 +81,19 @@ func (f *SignUpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	user.Email = email
 	user.Password = string(hash)
-	password = string(hash)
 
-	if err := f.DB.Create(&model.User{Email: email, Password: password}).Error; err != nil {
+	if err := f.DB.Create(&user).Error; err != nil {
 		var error model.Error
 		error.Message = "アカウントの作成に失敗しました"
 		errorInResponse(w, http.StatusUnauthorized, error)
 		return
 	}
 
+	//確認メールが送れなくてもアカウント作成は成功とし、再送してもらう
+	if err := sendVerificationMail(f.DB, f.Mailer, user); err != nil {
+		log.Println(err)
+	}
+
 	user.Password = ""
 	w.Header().Set("Content-Type", "application/json")
 
@@ -111,6 +113,9 @@ func (f *SignUpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// 存在しないアカウントのログイン時に比較するハッシュ
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), 10)
+
 type LoginHandler struct {
 	DB *gorm.DB
 }
@@ -118,8 +123,6 @@ type LoginHandler struct {
 func (f *LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	var user model.User
 
-	var jwt model.JWT
-
 	dec := json.NewDecoder(r.Body)
 	var d model.Form
 	if err := dec.Decode(&d); err != nil {
@@ -143,63 +146,54 @@ func (f *LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		var error model.Error
 		error.Message = "パスワードは必須です。"
 		errorInResponse(w, http.StatusBadRequest, error)
-	}
-
-	user.Email = email
-	user.Password = password
-
-	var userData model.User
-	row := f.DB.Where("email = ?", user.Email).Find(&userData)
-	if err := f.DB.Where("email = ?", user.Email).Find(&user).Error; gorm.IsRecordNotFoundError(err) {
-		var error model.Error
-		error.Message = "該当するアカウントが見つかりません。"
-		errorInResponse(w, http.StatusUnauthorized, error)
-		return
-	}
-
-	if _, err := json.Marshal(row); err != nil {
-		var error model.Error
-		error.Message = "該当するアカウントが見つかりません。"
-		errorInResponse(w, http.StatusUnauthorized, error)
 		return
 	}
 
-	passwordData := userData.Password
+	ip := clientIP(r)
 
-	err := bcrypt.CompareHashAndPassword([]byte(passwordData), []byte(password))
+	wait, err := loginRetryAfter(f.DB, email, ip)
 	if err != nil {
 		var error model.Error
-		error.Message = "無効なパスワードです。"
-		errorInResponse(w, http.StatusUnauthorized, error)
+		error.Message = "ログインに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
 		return
 	}
 
-	//トークン作成
-	token, err := createToken(user)
-	if err != nil {
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
 		var error model.Error
-		error.Message = "トークンの作成に失敗しました"
-		errorInResponse(w, http.StatusUnauthorized, error)
+		error.Message = "ログインの試行回数が多すぎます。しばらくしてから再度お試しください。"
+		errorInResponse(w, http.StatusTooManyRequests, error)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	jwt.Token = token
+	// アカウントが無い場合もダミーのハッシュと比較し、応答時間で登録の有無が分からないようにする
+	passwordData := dummyPasswordHash
+	found := true
+	if err := f.DB.Where("email = ?", email).Find(&user).Error; err != nil {
+		found = false
+	} else {
+		passwordData = []byte(user.Password)
+	}
 
-	v2, err := json.Marshal(jwt)
-	if err != nil {
-		var error model.Error
-		error.Message = "JSONへの変換に失敗しました"
-		errorInResponse(w, http.StatusInternalServerError, error)
-		return
+	err = bcrypt.CompareHashAndPassword(passwordData, []byte(password))
+	succeeded := found && err == nil
+
+	// 二段階認証が残っている場合は、コードを確認するまで成功として記録しない
+	if !succeeded || !user.TOTPEnabled {
+		if err := recordLoginAttempt(f.DB, email, ip, succeeded); err != nil {
+			log.Println(err)
+		}
 	}
 
-	if _, err := w.Write(v2); err != nil {
+	if !succeeded {
 		var error model.Error
-		error.Message = "JWTトークンの取得に失敗しました。"
-		errorInResponse(w, http.StatusInternalServerError, error)
+		error.Message = "メールアドレスまたはパスワードが正しくありません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
 		return
 	}
+
+	writeLoginResponse(w, r, f.DB, user)
 }
 
 type UserHandler struct {
@@ -208,38 +202,9 @@ type UserHandler struct {
 
 //リクエストユーザーの情報を返す
 func (f *UserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	headerAuthorization := r.Header.Get("Authorization")
-	if len(headerAuthorization) == 0 {
-		var error model.Error
-		error.Message = "認証トークンの取得に失敗しました。"
-		errorInResponse(w, http.StatusInternalServerError, error)
-		return
-	}
-
-	bearerToken := strings.Split(headerAuthorization, " ")
-	if len(bearerToken) < 2 {
-		var error model.Error
-		error.Message = "bearerトークンの取得に失敗しました。"
-		errorInResponse(w, http.StatusUnauthorized, error)
-		return
-	}
-
-	authToken := bearerToken[1]
-
-	parsedToken, err := Parse(authToken)
-	if err != nil {
+	user, ok := authUser(r)
+	if !ok {
 		var error model.Error
-		error.Message = "認証コードのパースに失敗しました。"
-		errorInResponse(w, http.StatusInternalServerError, error)
-		return
-	}
-
-	userEmail := parsedToken.Email
-
-	var user model.User
-
-	if err := f.DB.Where("email = ?", userEmail).Find(&user).Error; gorm.IsRecordNotFoundError(err) {
-		error := model.Error{}
 		error.Message = "該当するアカウントが見つかりません。"
 		errorInResponse(w, http.StatusUnauthorized, error)
 		return
@@ -275,7 +240,15 @@ func (f *UserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	v, err := json.Marshal(user)
+	body, err := newOwnProfile(f.DB, user)
+	if err != nil {
+		var error model.Error
+		error.Message = "ユーザー情報の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	v, err := json.Marshal(body)
 	if err != nil {
 		var error model.Error
 		error.Message = "JSONへの変換に失敗しました"
@@ -315,9 +288,55 @@ func (f *GetUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	requestUser, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	// ブロックした・された相手のプロフィールは存在しないものとして扱う
+	if blocked, err := isBlocked(f.DB, requestUser.ID, user.ID); err != nil || blocked {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	// モデレーターが非表示にしたプロフィールは本人とモデレーターにだけ見せる
+	if user.HiddenAt != nil && !canSeeHidden(r, user.ID) {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	visible, err := canSeeProfileContent(f.DB, requestUser.ID, user)
+	if err != nil {
+		var error model.Error
+		error.Message = "ユーザー情報の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	blockedIDs, err := blockedUserIDs(f.DB, requestUser.ID)
+	if err != nil {
+		var error model.Error
+		error.Message = "ユーザー情報の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
 	var bookmarkings []model.Song
 
-	if err := f.DB.Preload("Bookmarkings").Find(&user).Error; err != nil {
+	// お気に入りの曲も、リクエストユーザーが見られるものだけにする
+	visibleBookmarkings := func(db *gorm.DB) *gorm.DB {
+		return excludePrivateUsers(excludeUsers(db, "songs.user_id", blockedIDs), "songs.user_id", requestUser.ID).
+			Where("songs.hidden_at IS NULL")
+	}
+
+	if err := f.DB.Preload("Bookmarkings", visibleBookmarkings).Find(&user).Error; err != nil {
 		var error model.Error
 		error.Message = "該当する参照が見つかりません。"
 		errorInResponse(w, http.StatusInternalServerError, error)
@@ -345,7 +364,44 @@ func (f *GetUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	v, err := json.Marshal(user)
+	// 非公開アカウントのお気に入りとフォローは承認済みのフォロワーにだけ見せる
+	if !visible {
+		user.Bookmarkings = nil
+		user.Followings = nil
+	}
+
+	var body interface{}
+
+	// 他のユーザーには公開範囲内の項目だけを返し、メールアドレスは含めない
+	if requestUser.ID == user.ID {
+		body, err = newOwnProfile(f.DB, user)
+		if err != nil {
+			var error model.Error
+			error.Message = "ユーザー情報の取得に失敗しました。"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+	} else {
+		followings := []model.User{}
+		for _, following := range user.Followings {
+			followings = append(followings, *following)
+		}
+
+		profiles, err := profilesFor(f.DB, requestUser.ID, append([]model.User{user}, followings...))
+		if err != nil {
+			var error model.Error
+			error.Message = "ユーザー情報の取得に失敗しました。"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+
+		profile := profiles[0]
+		profile.Bookmarkings = user.Bookmarkings
+		profile.Followings = profiles[1:]
+		body = profile
+	}
+
+	v, err := json.Marshal(body)
 	if err != nil {
 		var error model.Error
 		error.Message = "JSONへの変換に失敗しました"
@@ -368,16 +424,40 @@ type AllUsersHandler struct {
 //全てのユーザーを返す
 func (f *AllUsersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
+	requestUser, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	blockedIDs, err := blockedUserIDs(f.DB, requestUser.ID)
+	if err != nil {
+		var error model.Error
+		error.Message = "ユーザー一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
 	allUsers := []model.User{}
 
-	if err := f.DB.Find(&allUsers).Error; gorm.IsRecordNotFoundError(err) {
+	if err := excludeUsers(f.DB, "id", blockedIDs).Where("hidden_at IS NULL").Find(&allUsers).Error; gorm.IsRecordNotFoundError(err) {
 		var error model.Error
 		error.Message = "該当するアカウントが見つかりません。"
 		errorInResponse(w, http.StatusInternalServerError, error)
 		return
 	}
 
-	v, err := json.Marshal(allUsers)
+	profiles, err := profilesFor(f.DB, requestUser.ID, allUsers)
+	if err != nil {
+		var error model.Error
+		error.Message = "ユーザー一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	v, err := json.Marshal(profiles)
 	if err != nil {
 		var error model.Error
 		error.Message = "ユーザー一覧の取得に失敗しました"
@@ -393,7 +473,8 @@ func (f *AllUsersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 type UpdateUserHandler struct {
-	DB *gorm.DB
+	DB     *gorm.DB
+	Filter *service.TextFilter
 }
 
 func (f *UpdateUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -415,18 +496,78 @@ func (f *UpdateUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// 以前のクライアントは age を送ってくるので、生まれ年に直して保存する
+	if d.BirthYear == nil && d.Age > 0 {
+		birthYear := time.Now().Year() - d.Age
+		d.BirthYear = &birthYear
+	}
+
+	if !validBirthDate(d.BirthYear, d.BirthMonth) {
+		var error model.Error
+		error.Message = "生年月が正しくありません。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	heldRule, ok := filterText(w, f.Filter, d.Comment)
+	if !ok {
+		return
+	}
+
+	// 保留にした自己紹介は確認が済むまで反映せず、それまでの自己紹介のままにする
+	comment := d.Comment
+	if heldRule != "" {
+		comment = ""
+	}
+
 	var user model.User
 
-	if err := f.DB.Model(&user).Where("id = ?", id).Update(model.User{Email: d.Email, Name: d.Name, Age: d.Age, Gender: d.Gender, FavoriteMusicAge: d.FavoriteMusicAge, FavoriteArtist: d.FavoriteArtist, Comment: d.Comment}).Error; err != nil {
+	if err := f.DB.Model(&user).Where("id = ?", id).Update(model.User{Name: d.Name, BirthYear: d.BirthYear, BirthMonth: d.BirthMonth, Gender: d.Gender, FavoriteMusicAge: d.FavoriteMusicAge, FavoriteArtist: d.FavoriteArtist, Comment: comment}).Error; err != nil {
 		var error model.Error
 		error.Message = "ユーザー情報の更新に失敗しました。"
 		errorInResponse(w, http.StatusInternalServerError, error)
 		return
 	}
+
+	if err := f.DB.Where("id = ?", id).Find(&user).Error; err != nil {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err := linkFavoriteArtist(f.DB, &user); err != nil {
+		var error model.Error
+		error.Message = "ユーザー情報の更新に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if heldRule != "" {
+		if err := holdCommentForReview(f.DB, user.ID, d.Comment, heldRule); err != nil {
+			var error model.Error
+			error.Message = "ユーザー情報の更新に失敗しました。"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	// 保留中の自己紹介があっても、新しく保存した自己紹介で置き換わらないよう捨てる
+	if user.PendingComment != nil && d.Comment != "" {
+		if err := f.DB.Model(&user).UpdateColumn("pending_comment", nil).Error; err != nil {
+			var error model.Error
+			error.Message = "ユーザー情報の更新に失敗しました。"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+	}
 }
 
 //JWT
-func createToken(user model.User) (string, error) {
+func createToken(user model.User, jti string) (string, error) {
 	var err error
 
 	secret := os.Getenv("SIGNINGKEY")
@@ -435,14 +576,15 @@ func createToken(user model.User) (string, error) {
 	// jwt -> JSON Web Token - JSON をセキュアにやり取りするための仕様
 	// jwtの構造 -> {Base64 encoded Header}.{Base64 encoded Payload}.{Signature}
 	// HS254 -> 証明生成用(https://ja.wikipedia.org/wiki/JSON_Web_Token)
+	// ver -> パスワード等の変更で増やし、それ以前に発行したトークンを失効させる
+	// jti -> sessions のレコードと紐づけ、端末ごとにログアウトできるようにする
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"email": user.Email,
+		"ver":   user.TokenVersion,
+		"jti":   jti,
 		"iss":   "__init__", // JWT の発行者が入る(文字列(__init__)は任意)
 	})
 
-	//Dumpを吐く
-	spew.Dump(token)
-
 	tokenString, err := token.SignedString([]byte(secret))
 	if err != nil {
 		return tokenString, err
@@ -452,7 +594,9 @@ func createToken(user model.User) (string, error) {
 }
 
 type CreateSongHandler struct {
-	DB *gorm.DB
+	DB     *gorm.DB
+	Filter *service.TextFilter
+	Hub    *service.Hub
 }
 
 func (f *CreateSongHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -466,30 +610,27 @@ func (f *CreateSongHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	header_hoge := r.Header.Get("Authorization")
-	bearerToken := strings.Split(header_hoge, " ")
-	authToken := bearerToken[1]
-
-	parsedToken, err := Parse(authToken)
-	if err != nil {
+	user, ok := authUser(r)
+	if !ok {
 		var error model.Error
-		error.Message = "認証コードのパースに失敗しました。"
-		errorInResponse(w, http.StatusInternalServerError, error)
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
 		return
 	}
 
-	userEmail := parsedToken.Email
-
-	var user model.User
+	if emailVerificationRequired() && user.EmailVerifiedAt == nil {
+		var error model.Error
+		error.Message = "メールアドレスの確認が完了していません。"
+		errorInResponse(w, http.StatusForbidden, error)
+		return
+	}
 
-	if err := f.DB.Where("email = ?", userEmail).Find(&user).Error; gorm.IsRecordNotFoundError(err) {
-		error := model.Error{}
-		error.Message = "該当するアカウントが見つかりません。"
-		errorInResponse(w, http.StatusUnauthorized, error)
+	heldRule, ok := filterText(w, f.Filter, d.Description)
+	if !ok {
 		return
 	}
 
-	if err := f.DB.Create(&model.Song{
+	song := model.Song{
 		Title:          d.Title,
 		Artist:         d.Artist,
 		MusicAge:       d.MusicAge,
@@ -498,12 +639,52 @@ func (f *CreateSongHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Album:          d.Album,
 		Description:    d.Description,
 		SpotifyTrackId: d.SpotifyTrackId,
-		UserID:         user.ID}).Error; err != nil {
+		UserID:         user.ID}
+
+	track, err := findOrCreateTrack(f.DB, song, trackISRC(d))
+	if err != nil {
+		var error model.Error
+		error.Message = "曲の追加に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+	song.TrackID = &track.ID
+
+	if song.ArtistID, err = findOrCreateArtist(f.DB, song.Artist); err != nil {
+		var error model.Error
+		error.Message = "曲の追加に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err := f.DB.Create(&song).Error; err != nil {
 		var error model.Error
 		error.Message = "曲の追加に失敗しました"
 		errorInResponse(w, http.StatusInternalServerError, error)
 		return
 	}
+
+	// ハッシュタグが保存できなくても曲の追加は成功とし、再インデックスで作り直せるようにする
+	if err := syncHashtags(f.DB, song); err != nil {
+		log.Println(err)
+	}
+
+	// 確認待ちの曲は投稿者とモデレーターにだけ見える
+	if heldRule != "" {
+		if err := holdForReview(f.DB, reportTargetSong, song.ID, heldRule); err != nil {
+			var error model.Error
+			error.Message = "曲の追加に失敗しました"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if err := publishSongToFollowers(f.DB, f.Hub, song); err != nil {
+		log.Println(err)
+	}
 }
 
 type GetSongHandler struct {
@@ -529,6 +710,48 @@ func (f *GetSongHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	if blocked, err := isBlocked(f.DB, user.ID, song.UserID); err != nil || blocked {
+		error := model.Error{}
+		error.Message = "該当する曲が見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	// モデレーターが非表示にした曲は投稿者とモデレーターにだけ見せる
+	if song.HiddenAt != nil && !canSeeHidden(r, song.UserID) {
+		error := model.Error{}
+		error.Message = "該当する曲が見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	var owner model.User
+	if err := f.DB.Where("id = ?", song.UserID).Find(&owner).Error; err == nil {
+		if visible, err := canSeeProfileContent(f.DB, user.ID, owner); err != nil || !visible {
+			error := model.Error{}
+			error.Message = "該当する曲が見つかりません。"
+			errorInResponse(w, http.StatusNotFound, error)
+			return
+		}
+	}
+
+	songs := []model.Song{song}
+	if err := loadSongDetails(f.DB, songs); err != nil {
+		var error model.Error
+		error.Message = "曲の取得に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+	song = songs[0]
+
 	v, err := json.Marshal(song)
 	if err != nil {
 		var error model.Error
@@ -550,15 +773,39 @@ type AllSongsHandler struct {
 }
 
 func (f *AllSongsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	// ブロック・ミュートしたユーザーの曲は一覧に出さない
+	hiddenIDs, err := hiddenUserIDs(f.DB, user.ID)
+	if err != nil {
+		var error model.Error
+		error.Message = "曲一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
 	allSongs := []model.Song{}
 
-	if err := f.DB.Find(&allSongs).Error; gorm.IsRecordNotFoundError(err) {
+	if err := excludePrivateUsers(excludeUsers(f.DB, "user_id", hiddenIDs), "user_id", user.ID).Where("hidden_at IS NULL").Find(&allSongs).Error; gorm.IsRecordNotFoundError(err) {
 		var error model.Error
 		error.Message = "曲が見つかりません。"
 		errorInResponse(w, http.StatusInternalServerError, error)
 		return
 	}
 
+	if err := loadSongDetails(f.DB, allSongs); err != nil {
+		var error model.Error
+		error.Message = "曲一覧の取得に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
 	v, err := json.Marshal(allSongs)
 	if err != nil {
 		var error model.Error
@@ -576,7 +823,8 @@ func (f *AllSongsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 type UpdateSongHandler struct {
-	DB *gorm.DB
+	DB     *gorm.DB
+	Filter *service.TextFilter
 }
 
 func (f *UpdateSongHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -600,6 +848,27 @@ func (f *UpdateSongHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	var song model.Song
 
+	if err := f.DB.Where("id = ?", id).Find(&song).Error; err != nil {
+		var error model.Error
+		error.Message = "該当する曲が見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	// 編集できるのは投稿者とモデレーターだけ
+	ac, ok := r.Context().Value(authKey).(*authContext)
+	if !ok || (song.UserID != ac.User.ID && !ac.hasPermission(permissionModerate)) {
+		var error model.Error
+		error.Message = "この曲を編集する権限がありません。"
+		errorInResponse(w, http.StatusForbidden, error)
+		return
+	}
+
+	heldRule, ok := filterText(w, f.Filter, d.Description)
+	if !ok {
+		return
+	}
+
 	if err := f.DB.Model(&song).Where("id = ?", id).Update(model.Song{
 		Title:          d.Title,
 		Artist:         d.Artist,
@@ -614,6 +883,44 @@ func (f *UpdateSongHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		errorInResponse(w, http.StatusInternalServerError, error)
 		return
 	}
+
+	if err := f.DB.Where("id = ?", id).Find(&song).Error; err != nil {
+		var error model.Error
+		error.Message = "該当する曲が見つかりません。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	// Spotify の曲 ID や曲名が変わった場合は別の曲につなぎ直す
+	if err := linkTrack(f.DB, &song, trackISRC(d)); err != nil {
+		var error model.Error
+		error.Message = "曲の更新に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err := linkSongArtist(f.DB, &song); err != nil {
+		var error model.Error
+		error.Message = "曲の更新に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	// 説明文が変わっていなければ同じつながりになるので、毎回保存し直す
+	if err := syncHashtags(f.DB, song); err != nil {
+		log.Println(err)
+	}
+
+	if heldRule != "" {
+		if err := holdForReview(f.DB, reportTargetSong, song.ID, heldRule); err != nil {
+			var error model.Error
+			error.Message = "曲の更新に失敗しました"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
 }
 
 type DeleteSongHandler struct {
@@ -641,7 +948,8 @@ func (f *DeleteSongHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 type FollowUserHandler struct {
-	DB *gorm.DB
+	DB  *gorm.DB
+	Hub *service.Hub
 }
 
 func (f *FollowUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -663,40 +971,45 @@ func (f *FollowUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	headerAuthorization := r.Header.Get("Authorization")
-	if len(headerAuthorization) == 0 {
-		var error model.Error
-		error.Message = "認証トークンの取得に失敗しました。"
-		errorInResponse(w, http.StatusInternalServerError, error)
-		return
-	}
-
-	bearerToken := strings.Split(headerAuthorization, " ")
-	if len(bearerToken) < 2 {
+	requestUser, ok := authUser(r)
+	if !ok {
 		var error model.Error
-		error.Message = "bearerトークンの取得に失敗しました。"
+		error.Message = "該当するアカウントが見つかりません。"
 		errorInResponse(w, http.StatusUnauthorized, error)
 		return
 	}
 
-	authToken := bearerToken[1]
-
-	parsedToken, err := Parse(authToken)
-	if err != nil {
+	if blocked, err := isBlocked(f.DB, requestUser.ID, targetUser.ID); err != nil || blocked {
 		var error model.Error
-		error.Message = "認証コードのパースに失敗しました。"
-		errorInResponse(w, http.StatusInternalServerError, error)
+		error.Message = "このユーザーはフォローできません。"
+		errorInResponse(w, http.StatusForbidden, error)
 		return
 	}
 
-	userEmail := parsedToken.Email
+	// 非公開アカウントへのフォローは申請にして、相手の承認を待つ
+	if targetUser.IsPrivate {
+		following, err := isFollowing(f.DB, requestUser.ID, targetUser.ID)
+		if err != nil {
+			var error model.Error
+			error.Message = "ユーザーフォローの追加に失敗しました"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+		if following {
+			return
+		}
 
-	var requestUser model.User
+		var request model.FollowRequest
+		if err := f.DB.Where(model.FollowRequest{UserID: requestUser.ID, FollowID: targetUser.ID}).FirstOrCreate(&request).Error; err != nil {
+			var error model.Error
+			error.Message = "フォロー申請に失敗しました。"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
 
-	if err := f.DB.Where("email = ?", userEmail).Find(&requestUser).Error; gorm.IsRecordNotFoundError(err) {
-		var error model.Error
-		error.Message = "該当するアカウントが見つかりません。"
-		errorInResponse(w, http.StatusUnauthorized, error)
+		notifyOrLog(f.DB, f.Hub, targetUser.ID, requestUser, notificationFollowRequest, nil, nil)
+
+		w.WriteHeader(http.StatusAccepted)
 		return
 	}
 
@@ -721,6 +1034,8 @@ func (f *FollowUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		errorInResponse(w, http.StatusInternalServerError, error)
 		return
 	}
+
+	notifyOrLog(f.DB, f.Hub, targetUser.ID, requestUser, notificationFollow, nil, nil)
 }
 
 type UnfollowUserHandler struct {
@@ -746,37 +1061,8 @@ func (f *UnfollowUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	headerAuthorization := r.Header.Get("Authorization")
-	if len(headerAuthorization) == 0 {
-		var error model.Error
-		error.Message = "認証トークンの取得に失敗しました。"
-		errorInResponse(w, http.StatusInternalServerError, error)
-		return
-	}
-
-	bearerToken := strings.Split(headerAuthorization, " ")
-	if len(bearerToken) < 2 {
-		var error model.Error
-		error.Message = "bearerトークンの取得に失敗しました。"
-		errorInResponse(w, http.StatusUnauthorized, error)
-		return
-	}
-
-	authToken := bearerToken[1]
-
-	parsedToken, err := Parse(authToken)
-	if err != nil {
-		var error model.Error
-		error.Message = "認証コードのパースに失敗しました。"
-		errorInResponse(w, http.StatusInternalServerError, error)
-		return
-	}
-
-	userEmail := parsedToken.Email
-
-	var requestUser model.User
-
-	if err := f.DB.Where("email = ?", userEmail).Find(&requestUser).Error; gorm.IsRecordNotFoundError(err) {
+	requestUser, ok := authUser(r)
+	if !ok {
 		var error model.Error
 		error.Message = "該当するアカウントが見つかりません。"
 		errorInResponse(w, http.StatusUnauthorized, error)
@@ -795,10 +1081,19 @@ func (f *UnfollowUserHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		errorInResponse(w, http.StatusInternalServerError, error)
 		return
 	}
+
+	// 保留中のフォロー申請も取り消す
+	if err := f.DB.Unscoped().Where("user_id = ? AND follow_id = ?", requestUser.ID, targetUser.ID).Delete(&model.FollowRequest{}).Error; err != nil {
+		var error model.Error
+		error.Message = "フォロー申請の取り消しに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
 }
 
 type BookmarkHandler struct {
-	DB *gorm.DB
+	DB  *gorm.DB
+	Hub *service.Hub
 }
 
 func (f *BookmarkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -811,47 +1106,33 @@ func (f *BookmarkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var song model.Song
-	if err := f.DB.Where("id = ?", id).Find(&song).Error; gorm.IsRecordNotFoundError(err) {
-		error := model.Error{}
-		error.Message = "該当する曲が見つかりません。"
-		errorInResponse(w, http.StatusInternalServerError, error)
-		return
-	}
-
-	headerAuthorization := r.Header.Get("Authorization")
-	if len(headerAuthorization) == 0 {
+	user, ok := authUser(r)
+	if !ok {
 		var error model.Error
-		error.Message = "認証トークンの取得に失敗しました。"
-		errorInResponse(w, http.StatusInternalServerError, error)
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
 		return
 	}
 
-	bearerToken := strings.Split(headerAuthorization, " ")
-	if len(bearerToken) < 2 {
+	// 見られない曲(ブロック関係・フォローしていない非公開アカウント)はお気に入り登録させない
+	song, err := visibleSong(f.DB, r, user, id)
+	if err == errSongNotFound {
 		var error model.Error
-		error.Message = "bearerトークンの取得に失敗しました。"
-		errorInResponse(w, http.StatusUnauthorized, error)
+		error.Message = "該当する曲が見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
 		return
 	}
-
-	authToken := bearerToken[1]
-
-	parsedToken, err := Parse(authToken)
 	if err != nil {
 		var error model.Error
-		error.Message = "認証コードのパースに失敗しました。"
+		error.Message = "曲のお気に入り登録に失敗しました"
 		errorInResponse(w, http.StatusInternalServerError, error)
 		return
 	}
 
-	userEmail := parsedToken.Email
-
-	var user model.User
-	if err := f.DB.Where("email = ?", userEmail).Find(&user).Error; gorm.IsRecordNotFoundError(err) {
+	if song.HiddenAt != nil {
 		var error model.Error
-		error.Message = "該当するアカウントが見つかりません。"
-		errorInResponse(w, http.StatusUnauthorized, error)
+		error.Message = "この曲はお気に入り登録できません。"
+		errorInResponse(w, http.StatusForbidden, error)
 		return
 	}
 
@@ -877,6 +1158,8 @@ func (f *BookmarkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		errorInResponse(w, http.StatusInternalServerError, error)
 		return
 	}
+
+	notifyOrLog(f.DB, f.Hub, song.UserID, user, notificationBookmark, &song.ID, nil)
 }
 
 type RemoveBookmarkHandler struct {
@@ -902,37 +1185,9 @@ func (f *RemoveBookmarkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	headerAuthorization := r.Header.Get("Authorization")
-	if len(headerAuthorization) == 0 {
-		var error model.Error
-		error.Message = "認証トークンの取得に失敗しました。"
-		errorInResponse(w, http.StatusInternalServerError, error)
-		return
-	}
-
-	bearerToken := strings.Split(headerAuthorization, " ")
-	if len(bearerToken) < 2 {
-		var error model.Error
-		error.Message = "bearerトークンの取得に失敗しました。"
-		errorInResponse(w, http.StatusUnauthorized, error)
-		return
-	}
-
-	authToken := bearerToken[1]
-
-	parsedToken, err := Parse(authToken)
-	if err != nil {
+	user, ok := authUser(r)
+	if !ok {
 		var error model.Error
-		error.Message = "認証コードのパースに失敗しました。"
-		errorInResponse(w, http.StatusInternalServerError, error)
-		return
-	}
-
-	userEmail := parsedToken.Email
-
-	var user model.User
-	if err := f.DB.Where("email = ?", userEmail).Find(&user).Error; gorm.IsRecordNotFoundError(err) {
-		error := model.Error{}
 		error.Message = "該当するアカウントが見つかりません。"
 		errorInResponse(w, http.StatusUnauthorized, error)
 		return
@@ -985,30 +1240,145 @@ func main() {
 	db.DB().SetMaxIdleConns(10)
 	defer db.Close()
 
+	mailer := service.NewMailer()
+	oidcProviders := loadOIDCProviders("conf/oidc.yml")
+	textFilter := loadTextFilter("conf/moderation.yml")
+	hub, err := service.NewHub(service.NewBroker())
+	if err != nil {
+		log.Fatal(err)
+	}
+	auth := &AuthMiddleware{DB: db}
+
 	r := mux.NewRouter()
 
-	r.Handle("/api/signup", &SignUpHandler{DB: db}).Methods("POST")
+	r.Handle("/api/signup", &SignUpHandler{DB: db, Mailer: mailer}).Methods("POST")
 	r.Handle("/api/login", &LoginHandler{DB: db}).Methods("POST")
-	r.Handle("/api/user", JwtMiddleware.Handler(&UserHandler{DB: db})).Methods("GET")
-	r.Handle("/api/user/{id}", JwtMiddleware.Handler(&GetUserHandler{DB: db})).Methods("GET")
-	r.Handle("/api/users", JwtMiddleware.Handler(&AllUsersHandler{DB: db})).Methods("GET")
-	r.Handle("/api/user/{id}/update", JwtMiddleware.Handler(&UpdateUserHandler{DB: db})).Methods("PUT")
-
-	r.Handle("/api/song", JwtMiddleware.Handler(&CreateSongHandler{DB: db})).Methods("POST")
-	r.Handle("/api/song/{id}", JwtMiddleware.Handler(&GetSongHandler{DB: db})).Methods("GET")
-	r.Handle("/api/songs", JwtMiddleware.Handler(&AllSongsHandler{DB: db})).Methods("GET")
-	r.Handle("/api/song/{id}", JwtMiddleware.Handler(&UpdateSongHandler{DB: db})).Methods("PUT")
-	r.Handle("/api/song/{id}", JwtMiddleware.Handler(&DeleteSongHandler{DB: db})).Methods("DELETE")
+	r.Handle("/api/login/2fa", &LoginTwoFactorHandler{DB: db}).Methods("POST")
+
+	r.Handle("/api/2fa/setup", auth.Handler(scopeAccount, &SetupTwoFactorHandler{DB: db})).Methods("POST")
+	r.Handle("/api/2fa/enable", auth.Handler(scopeAccount, &EnableTwoFactorHandler{DB: db})).Methods("POST")
+	r.Handle("/api/2fa/disable", auth.Handler(scopeAccount, &DisableTwoFactorHandler{DB: db})).Methods("POST")
+
+	r.Handle("/api/password/forgot", &ForgotPasswordHandler{DB: db, Mailer: mailer}).Methods("POST")
+	r.Handle("/api/password/reset", &ResetPasswordHandler{DB: db}).Methods("POST")
+	r.Handle("/api/email/verify", &VerifyEmailHandler{DB: db}).Methods("POST")
+	r.Handle("/api/email/verify/resend", auth.Handler(scopeAccount, &ResendVerificationHandler{DB: db, Mailer: mailer})).Methods("POST")
+	r.Handle("/api/user", auth.Handler(scopeRead, &UserHandler{DB: db})).Methods("GET")
+	r.Handle("/api/user/{id}", auth.Handler(scopeRead, &GetUserHandler{DB: db})).Methods("GET")
+	r.Handle("/api/users", auth.Handler(scopeRead, &AllUsersHandler{DB: db})).Methods("GET")
+	r.Handle("/api/user/{id}/update", auth.Handler(scopeAccount, &UpdateUserHandler{DB: db, Filter: textFilter})).Methods("PUT")
+	r.Handle("/api/user/password", auth.Handler(scopeAccount, &ChangePasswordHandler{DB: db})).Methods("POST")
+	r.Handle("/api/user/email", auth.Handler(scopeAccount, &ChangeEmailHandler{DB: db, Mailer: mailer})).Methods("POST")
+	r.Handle("/api/user/email/confirm", &ConfirmEmailChangeHandler{DB: db}).Methods("POST")
+
+	r.Handle("/api/logout", auth.Handler(scopeAccount, &LogoutHandler{DB: db})).Methods("POST")
+	r.Handle("/api/sessions", auth.Handler(scopeAccount, &SessionsHandler{DB: db})).Methods("GET")
+	r.Handle("/api/sessions/{id}", auth.Handler(scopeAccount, &RevokeSessionHandler{DB: db})).Methods("DELETE")
+
+	r.Handle("/api/tokens", auth.Handler(scopeAccount, &CreatePersonalAccessTokenHandler{DB: db})).Methods("POST")
+	r.Handle("/api/tokens", auth.Handler(scopeAccount, &PersonalAccessTokensHandler{DB: db})).Methods("GET")
+	r.Handle("/api/tokens/{id}", auth.Handler(scopeAccount, &RevokePersonalAccessTokenHandler{DB: db})).Methods("DELETE")
+
+	r.Handle("/api/song", auth.Handler(scopeWriteSongs, &CreateSongHandler{DB: db, Filter: textFilter, Hub: hub})).Methods("POST")
+	r.Handle("/api/song/{id}", auth.Handler(scopeRead, &GetSongHandler{DB: db})).Methods("GET")
+	r.Handle("/api/songs", auth.Handler(scopeRead, &AllSongsHandler{DB: db})).Methods("GET")
+	r.Handle("/api/song/{id}", auth.Handler(scopeWriteSongs, &UpdateSongHandler{DB: db, Filter: textFilter})).Methods("PUT")
+	r.Handle("/api/song/{id}", auth.Handler(scopeWriteSongs, &DeleteSongHandler{DB: db})).Methods("DELETE")
 
 	r.HandleFunc("/api/get-redirect-url", controller.GetRedirectURL).Methods("GET")
 	r.HandleFunc("/api/get-token", controller.GetToken).Methods("POST")
 	r.HandleFunc("/api/tracks", controller.GetTracks).Methods("POST")
 
-	r.Handle("/api/song/{id}/bookmark", JwtMiddleware.Handler(&BookmarkHandler{DB: db})).Methods("POST")
-	r.Handle("/api/song/{id}/remove-bookmark", JwtMiddleware.Handler(&RemoveBookmarkHandler{DB: db})).Methods("POST")
-
-	r.Handle("/api/user/{id}/follow", JwtMiddleware.Handler(&FollowUserHandler{DB: db})).Methods("POST")
-	r.Handle("/api/user/{id}/unfollow", JwtMiddleware.Handler(&UnfollowUserHandler{DB: db})).Methods("POST")
+	r.Handle("/api/oidc/providers", &OIDCProvidersHandler{Providers: oidcProviders}).Methods("GET")
+	r.Handle("/api/oidc/{provider}/login-url", &OIDCLoginURLHandler{DB: db, Providers: oidcProviders}).Methods("GET")
+	r.Handle("/api/oidc/{provider}/login", &OIDCLoginHandler{DB: db, Providers: oidcProviders}).Methods("POST")
+
+	r.Handle("/api/spotify/login-url", &SpotifyLoginURLHandler{DB: db}).Methods("GET")
+	r.Handle("/api/spotify/login", &SpotifyLoginHandler{DB: db}).Methods("POST")
+	r.Handle("/api/spotify/link-url", auth.Handler(scopeAccount, &SpotifyLoginURLHandler{DB: db, Link: true})).Methods("GET")
+	r.Handle("/api/spotify/link", auth.Handler(scopeAccount, &LinkSpotifyHandler{DB: db})).Methods("POST")
+	r.Handle("/api/spotify/unlink", auth.Handler(scopeAccount, &UnlinkSpotifyHandler{DB: db})).Methods("POST")
+
+	r.Handle("/api/song/{id}/bookmark", auth.Handler(scopeWriteSocial, &BookmarkHandler{DB: db, Hub: hub})).Methods("POST")
+	r.Handle("/api/song/{id}/remove-bookmark", auth.Handler(scopeWriteSocial, &RemoveBookmarkHandler{DB: db})).Methods("POST")
+	r.Handle("/api/stream/ticket", auth.Handler(scopeRead, &StreamTicketHandler{DB: db})).Methods("POST")
+	r.Handle("/api/stream", auth.StreamTicket(&StreamHandler{DB: db, Hub: hub})).Methods("GET")
+	r.Handle("/api/notifications", auth.Handler(scopeRead, &NotificationsHandler{DB: db})).Methods("GET")
+	r.Handle("/api/notifications/read-all", auth.Handler(scopeWriteSocial, &ReadAllNotificationsHandler{DB: db})).Methods("POST")
+	r.Handle("/api/notifications/preferences", auth.Handler(scopeRead, &NotificationPreferencesHandler{DB: db})).Methods("GET")
+	r.Handle("/api/notifications/preferences", auth.Handler(scopeAccount, &UpdateNotificationPreferencesHandler{DB: db})).Methods("PUT")
+	r.Handle("/api/notifications/{id}/read", auth.Handler(scopeWriteSocial, &ReadNotificationHandler{DB: db})).Methods("POST")
+	r.Handle("/api/tracks/{id}", auth.Handler(scopeRead, &TrackHandler{DB: db})).Methods("GET")
+	r.Handle("/api/artists/{id}", auth.Handler(scopeRead, &ArtistHandler{DB: db})).Methods("GET")
+	r.Handle("/api/song/{id}/tags", auth.Handler(scopeWriteSongs, &UpdateSongTagsHandler{DB: db})).Methods("PUT")
+	r.Handle("/api/song/{id}/tags/suggestions", auth.Handler(scopeWriteSongs, &SongTagSuggestionsHandler{DB: db})).Methods("POST")
+	r.Handle("/api/tags", auth.Handler(scopeRead, &TagAutocompleteHandler{DB: db})).Methods("GET")
+	r.Handle("/api/tags/trending", auth.Handler(scopeRead, &TrendingTagsHandler{DB: db})).Methods("GET")
+	r.Handle("/api/tags/{tag}/songs", auth.Handler(scopeRead, &TagSongsHandler{DB: db})).Methods("GET")
+	r.Handle("/api/song/{id}/reaction", auth.Handler(scopeWriteSocial, &ReactHandler{DB: db})).Methods("PUT")
+	r.Handle("/api/song/{id}/reaction", auth.Handler(scopeWriteSocial, &RemoveReactionHandler{DB: db})).Methods("DELETE")
+	r.Handle("/api/song/{id}/reactions", auth.Handler(scopeRead, &SongReactionsHandler{DB: db})).Methods("GET")
+	r.Handle("/api/song/{id}/comments", auth.Handler(scopeRead, &SongCommentsHandler{DB: db})).Methods("GET")
+	r.Handle("/api/song/{id}/comments", auth.Handler(scopeWriteSocial, &CreateSongCommentHandler{DB: db, Filter: textFilter, Hub: hub})).Methods("POST")
+	r.Handle("/api/comments/{id}", auth.Handler(scopeWriteSocial, &UpdateSongCommentHandler{DB: db, Filter: textFilter})).Methods("PUT")
+	r.Handle("/api/comments/{id}", auth.Handler(scopeWriteSocial, &DeleteSongCommentHandler{DB: db})).Methods("DELETE")
+
+	r.Handle("/api/user/{id}/follow", auth.Handler(scopeWriteSocial, &FollowUserHandler{DB: db, Hub: hub})).Methods("POST")
+	r.Handle("/api/user/{id}/unfollow", auth.Handler(scopeWriteSocial, &UnfollowUserHandler{DB: db})).Methods("POST")
+
+	admin := r.PathPrefix("/api/admin").Subrouter()
+	admin.Handle("/users", auth.RequirePermission(permissionViewUsers, &AdminUsersHandler{DB: db})).Methods("GET")
+	admin.Handle("/users/{id}/suspend", auth.RequirePermission(permissionSuspendUsers, &SuspendUserHandler{DB: db, Suspend: true})).Methods("POST")
+	admin.Handle("/users/{id}/unsuspend", auth.RequirePermission(permissionSuspendUsers, &SuspendUserHandler{DB: db})).Methods("POST")
+	admin.Handle("/users/{id}/roles", auth.RequirePermission(permissionManageRoles, &UpdateUserRolesHandler{DB: db})).Methods("PUT")
+	admin.Handle("/songs/{id}", auth.RequirePermission(permissionDeleteSongs, &AdminDeleteSongHandler{DB: db})).Methods("DELETE")
+	admin.Handle("/artists/match", auth.RequirePermission(permissionManageArtists, &MatchArtistsHandler{DB: db})).Methods("POST")
+	admin.Handle("/artists/{id}", auth.RequirePermission(permissionManageArtists, &UpdateArtistHandler{DB: db})).Methods("PUT")
+	admin.Handle("/artists/{id}/merge", auth.RequirePermission(permissionManageArtists, &MergeArtistHandler{DB: db})).Methods("POST")
+	admin.Handle("/hashtags/reindex", auth.RequirePermission(permissionReindexHashtags, &ReindexHashtagsHandler{DB: db})).Methods("POST")
+	admin.Handle("/stats", auth.RequirePermission(permissionViewStats, &AdminStatsHandler{DB: db})).Methods("GET")
+
+	r.Handle("/api/user/{id}/block", auth.Handler(scopeWriteSocial, &BlockUserHandler{DB: db})).Methods("POST")
+	r.Handle("/api/user/{id}/unblock", auth.Handler(scopeWriteSocial, &UnblockUserHandler{DB: db})).Methods("POST")
+	r.Handle("/api/user/{id}/mute", auth.Handler(scopeWriteSocial, &MuteUserHandler{DB: db})).Methods("POST")
+	r.Handle("/api/user/{id}/unmute", auth.Handler(scopeWriteSocial, &UnmuteUserHandler{DB: db})).Methods("POST")
+	r.Handle("/api/blocks", auth.Handler(scopeRead, &BlockedUsersHandler{DB: db})).Methods("GET")
+	r.Handle("/api/mutes", auth.Handler(scopeRead, &MutedUsersHandler{DB: db})).Methods("GET")
+
+	r.Handle("/api/report", auth.Handler(scopeWriteSocial, &ReportHandler{DB: db})).Methods("POST")
+
+	admin.Handle("/moderation", auth.RequirePermission(permissionModerate, &ModerationCasesHandler{DB: db})).Methods("GET")
+	admin.Handle("/moderation/filter", auth.RequirePermission(permissionModerate, &TextFilterStatsHandler{Filter: textFilter})).Methods("GET")
+	admin.Handle("/moderation/filter/reload", auth.RequirePermission(permissionConfigureModeration, &ReloadTextFilterHandler{Filter: textFilter})).Methods("POST")
+	admin.Handle("/moderation/{id}", auth.RequirePermission(permissionModerate, &ModerationCaseHandler{DB: db})).Methods("GET")
+	admin.Handle("/moderation/{id}/resolve", auth.RequirePermission(permissionModerate, &ResolveModerationCaseHandler{DB: db})).Methods("POST")
+
+	r.Handle("/api/user/privacy", auth.Handler(scopeAccount, &UpdatePrivacyHandler{DB: db})).Methods("PUT")
+	r.Handle("/api/follow-requests", auth.Handler(scopeRead, &FollowRequestsHandler{DB: db})).Methods("GET")
+	r.Handle("/api/follow-requests/{id}/approve", auth.Handler(scopeWriteSocial, &RespondFollowRequestHandler{DB: db, Approve: true})).Methods("POST")
+	r.Handle("/api/follow-requests/{id}/reject", auth.Handler(scopeWriteSocial, &RespondFollowRequestHandler{DB: db})).Methods("POST")
+
+	r.Handle("/api/user/visibility", auth.Handler(scopeAccount, &UpdateProfileVisibilityHandler{DB: db})).Methods("PUT")
+
+	r.Handle("/api/user/{id}/teen-songs", auth.Handler(scopeRead, &TeenSongsHandler{DB: db})).Methods("GET")
+
+	r.Handle("/api/playlists", auth.Handler(scopeWriteSongs, &CreatePlaylistHandler{DB: db})).Methods("POST")
+	r.Handle("/api/playlists/{id}", auth.Handler(scopeRead, &GetPlaylistHandler{DB: db})).Methods("GET")
+	r.Handle("/api/playlists/{id}", auth.Handler(scopeWriteSongs, &UpdatePlaylistHandler{DB: db})).Methods("PUT")
+	r.Handle("/api/playlists/{id}", auth.Handler(scopeWriteSongs, &DeletePlaylistHandler{DB: db})).Methods("DELETE")
+	r.Handle("/api/playlists/{id}/items", auth.Handler(scopeWriteSongs, &AddPlaylistItemHandler{DB: db})).Methods("POST")
+	r.Handle("/api/playlists/{id}/items/order", auth.Handler(scopeWriteSongs, &ReorderPlaylistHandler{DB: db})).Methods("PUT")
+	r.Handle("/api/playlists/{id}/items/{itemId}", auth.Handler(scopeWriteSongs, &RemovePlaylistItemHandler{DB: db})).Methods("DELETE")
+	r.Handle("/api/playlists/{id}/items/{itemId}/move", auth.Handler(scopeWriteSongs, &MovePlaylistItemHandler{DB: db})).Methods("POST")
+	r.Handle("/api/user/{id}/playlists", auth.Handler(scopeRead, &UserPlaylistsHandler{DB: db})).Methods("GET")
+	r.Handle("/api/playlists/{id}/collaborators", auth.Handler(scopeRead, &PlaylistCollaboratorsHandler{DB: db})).Methods("GET")
+	r.Handle("/api/playlists/{id}/collaborators", auth.Handler(scopeWriteSongs, &InvitePlaylistCollaboratorHandler{DB: db})).Methods("POST")
+	r.Handle("/api/playlists/{id}/collaborators/{userId}", auth.Handler(scopeWriteSongs, &UpdatePlaylistCollaboratorHandler{DB: db})).Methods("PUT")
+	r.Handle("/api/playlists/{id}/collaborators/{userId}", auth.Handler(scopeWriteSongs, &RemovePlaylistCollaboratorHandler{DB: db})).Methods("DELETE")
+	r.Handle("/api/playlists/{id}/invitation/accept", auth.Handler(scopeWriteSongs, &RespondPlaylistInvitationHandler{DB: db, Accept: true})).Methods("POST")
+	r.Handle("/api/playlists/{id}/invitation/decline", auth.Handler(scopeWriteSongs, &RespondPlaylistInvitationHandler{DB: db, Accept: false})).Methods("POST")
+	r.Handle("/api/playlists/{id}/activities", auth.Handler(scopeRead, &PlaylistActivitiesHandler{DB: db})).Methods("GET")
+	r.Handle("/api/playlist-invitations", auth.Handler(scopeRead, &PlaylistInvitationsHandler{DB: db})).Methods("GET")
 
 	r.HandleFunc("/", healthzHandler).Methods("GET")
 
@@ -1052,5 +1422,10 @@ func Parse(signedString string) (*model.Auth, error) {
 		return nil, errors.Errorf("not found %s in %s", email, signedString)
 	}
 
-	return &model.Auth{Email: email}, nil
+	// ver を持たないトークンは変更前に発行されたものとして扱う
+	version, _ := claims["ver"].(float64)
+
+	jti, _ := claims["jti"].(string)
+
+	return &model.Auth{Email: email, TokenVersion: uint(version), Jti: jti}, nil
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"golang-songs/model"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+// newTestDB は models のテーブルだけを持つメモリ上の SQLite を返す。
+// 本番の MySQL のマイグレーションは使わないので、テストが頼る一意制約は呼び出し側で足す。
+func newTestDB(t *testing.T, models ...interface{}) *gorm.DB {
+	db, err := gorm.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// :memory: は接続ごとに別のデータベースになるので、1本だけ使う
+	db.DB().SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	if err := db.AutoMigrate(models...).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+// withAuthUser は AuthMiddleware を通ったときと同じく、user をリクエストユーザーにする。
+func withAuthUser(r *http.Request, user model.User) *http.Request {
+	return withAuthContext(r, &authContext{User: user, Scopes: loginScopes})
+}
+
+// withAuthContext は ac のセッションやトークンで認証されたリクエストにする。
+func withAuthContext(r *http.Request, ac *authContext) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), authKey, ac))
+}
+
+func TestUpdateSongRequiresOwner(t *testing.T) {
+	db := newTestDB(t, &model.UserFollow{}, &model.User{}, &model.Song{}, &model.Track{}, &model.Artist{}, &model.ArtistAlias{}, &model.Hashtag{}, &model.SongHashtag{})
+	filter := loadTextFilter("testdata/missing.yml")
+
+	users := []model.User{{Email: "owner@example.com"}, {Email: "other@example.com"}, {Email: "moderator@example.com"}}
+	for i := range users {
+		if err := db.Create(&users[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	owner, other, moderator := users[0], users[1], users[2]
+
+	song := model.Song{Title: "title", Artist: "artist", UserID: owner.ID}
+	if err := db.Create(&song).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		ac    *authContext
+		title string
+		want  int
+	}{
+		{"another user", &authContext{User: other, Scopes: loginScopes}, "by other", http.StatusForbidden},
+		{"owner", &authContext{User: owner, Scopes: loginScopes}, "by owner", http.StatusOK},
+		{"moderator", &authContext{User: moderator, Scopes: loginScopes, Roles: []string{roleModerator}}, "by moderator", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("PUT", "/api/song/1", strings.NewReader(`{"title":"`+tt.title+`","artist":"artist"}`))
+		r = mux.SetURLVars(withAuthContext(r, tt.ac), map[string]string{"id": fmt.Sprint(song.ID)})
+		w := httptest.NewRecorder()
+		(&UpdateSongHandler{DB: db, Filter: filter}).ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d: %s", tt.name, w.Code, tt.want, w.Body)
+		}
+
+		var saved model.Song
+		if err := db.Where("id = ?", song.ID).Find(&saved).Error; err != nil {
+			t.Fatal(err)
+		}
+		if (saved.Title == tt.title) != (tt.want == http.StatusOK) {
+			t.Errorf("%s: title = %q", tt.name, saved.Title)
+		}
+	}
+
+	r := httptest.NewRequest("PUT", "/api/song/404", strings.NewReader(`{"title":"title"}`))
+	r = mux.SetURLVars(withAuthUser(r, owner), map[string]string{"id": "404"})
+	w := httptest.NewRecorder()
+	(&UpdateSongHandler{DB: db, Filter: filter}).ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("missing song: status = %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"golang-songs/model"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jinzhu/gorm"
+)
+
+// パーソナルアクセストークンに付けられる権限
+const (
+	scopeRead        = "read"
+	scopeWriteSongs  = "write:songs"
+	scopeWriteSocial = "write:social"
+)
+
+// scopeAccount はパスワード変更やトークン発行などのアカウント操作の権限。
+// ログインで発行した JWT だけが持ち、パーソナルアクセストークンには付けられない。
+const scopeAccount = "account"
+
+var tokenScopes = []string{scopeRead, scopeWriteSongs, scopeWriteSocial}
+
+var loginScopes = []string{scopeRead, scopeWriteSongs, scopeWriteSocial, scopeAccount}
+
+type contextKey string
+
+const authKey contextKey = "auth"
+
+// authContext はリクエストユーザーと、そのリクエストに許可された権限を表す。
+// SessionID と AccessTokenID はそのリクエストを通したログインのセッションかパーソナルアクセストークン。
+type authContext struct {
+	User          model.User
+	Scopes        []string
+	Roles         []string
+	SessionID     uint
+	AccessTokenID uint
+}
+
+// AuthMiddleware はリクエストの JWT またはパーソナルアクセストークンを検証し、持ち主を読み込む。
+// パスワードやメールアドレスの変更で失効したトークンはここで弾く。
+type AuthMiddleware struct {
+	DB *gorm.DB
+}
+
+// Handler は scope の権限を持つリクエストだけを h に渡す。
+func (m *AuthMiddleware) Handler(scope string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ac *authContext
+		var ok bool
+		if isPersonalAccessToken(r) {
+			ac, ok = m.personalAccessToken(w, r)
+		} else {
+			ac, ok = m.loginToken(w, r)
+		}
+		if !ok {
+			return
+		}
+
+		m.serve(w, r, ac, scope, h)
+	})
+}
+
+// StreamTicket はクエリの ticket に渡されたストリーム用のチケットを検証し、持ち主のリクエストとして h に渡す。
+// チケットは一度しか使えず、読み取りの権限だけを持つ。発行したセッションやトークンが失効していれば通さない。
+func (m *AuthMiddleware) StreamTicket(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userToken, claims, err := useActionToken(m.DB, r.URL.Query().Get("ticket"), tokenPurposeStream)
+		if err != nil {
+			var error model.Error
+			error.Message = "チケットが無効です。"
+			errorInResponse(w, http.StatusUnauthorized, error)
+			return
+		}
+
+		var user model.User
+		if err := m.DB.Where("id = ?", userToken.UserID).Find(&user).Error; err != nil {
+			var error model.Error
+			error.Message = "該当するアカウントが見つかりません。"
+			errorInResponse(w, http.StatusUnauthorized, error)
+			return
+		}
+
+		ac, ok := streamTicketContext(user, actionTokenValues(claims))
+		if ok {
+			ok, err = authStillValid(m.DB, ac)
+		}
+		if err != nil {
+			var error model.Error
+			error.Message = "チケットの検証に失敗しました。"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+		if !ok {
+			var error model.Error
+			error.Message = "チケットが無効です。"
+			errorInResponse(w, http.StatusUnauthorized, error)
+			return
+		}
+
+		m.serve(w, r, ac, scopeRead, h)
+	})
+}
+
+// streamTicketValues はチケットに持たせる、発行したリクエストのセッション・トークンとトークンのバージョン。
+func streamTicketValues(ac *authContext) map[string]string {
+	return map[string]string{
+		"session":       strconv.FormatUint(uint64(ac.SessionID), 10),
+		"access_token":  strconv.FormatUint(uint64(ac.AccessTokenID), 10),
+		"token_version": strconv.FormatUint(uint64(ac.User.TokenVersion), 10),
+	}
+}
+
+// streamTicketContext はチケットの値から、発行したときと同じセッション・トークンの authContext を作る。
+// User.TokenVersion は発行したときのもので、authStillValid で今のアカウントと比べる。
+func streamTicketContext(user model.User, values map[string]string) (*authContext, bool) {
+	ids := map[string]uint{}
+	for _, key := range []string{"session", "access_token", "token_version"} {
+		id, err := strconv.ParseUint(values[key], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		ids[key] = uint(id)
+	}
+
+	user.TokenVersion = ids["token_version"]
+
+	return &authContext{User: user, Scopes: []string{scopeRead}, SessionID: ids["session"], AccessTokenID: ids["access_token"]}, true
+}
+
+// authStillValid は ac のセッションやパーソナルアクセストークンが残っていて、
+// アカウントが利用停止やパスワード変更などで失効していないかを返す。ストリームのように長く続く接続で確かめ直すのに使う。
+func authStillValid(db *gorm.DB, ac *authContext) (bool, error) {
+	var user model.User
+	if err := db.Where("id = ?", ac.User.ID).Find(&user).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if user.SuspendedAt != nil || user.TokenVersion != ac.User.TokenVersion {
+		return false, nil
+	}
+
+	if ac.SessionID == 0 && ac.AccessTokenID == 0 {
+		return false, nil
+	}
+
+	if ac.SessionID != 0 {
+		var count int
+		if err := db.Model(&model.Session{}).Where("id = ? AND user_id = ?", ac.SessionID, user.ID).Count(&count).Error; err != nil || count == 0 {
+			return false, err
+		}
+	}
+
+	if ac.AccessTokenID != 0 {
+		var count int
+		if err := db.Model(&model.PersonalAccessToken{}).Where("id = ? AND user_id = ?", ac.AccessTokenID, user.ID).Count(&count).Error; err != nil || count == 0 {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// serve は利用停止中のアカウントと scope の権限が無いリクエストを弾き、ロールを読み込んで h に渡す。
+func (m *AuthMiddleware) serve(w http.ResponseWriter, r *http.Request, ac *authContext, scope string, h http.Handler) {
+	if ac.User.SuspendedAt != nil {
+		var error model.Error
+		error.Message = "このアカウントは利用停止中です。"
+		errorInResponse(w, http.StatusForbidden, error)
+		return
+	}
+
+	roles, err := userRoles(m.DB, ac.User.ID)
+	if err != nil {
+		var error model.Error
+		error.Message = "ロールの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+	ac.Roles = roles
+	ac.User.Roles = roles
+
+	if !hasScope(ac.Scopes, scope) {
+		var error model.Error
+		error.Message = "この操作を行う権限がありません。"
+		errorInResponse(w, http.StatusForbidden, error)
+		return
+	}
+
+	h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authKey, ac)))
+}
+
+func (m *AuthMiddleware) loginToken(w http.ResponseWriter, r *http.Request) (*authContext, bool) {
+	if err := JwtMiddleware.CheckJWT(w, r); err != nil {
+		return nil, false
+	}
+
+	token, ok := r.Context().Value("user").(*jwt.Token)
+	if !ok {
+		var error model.Error
+		error.Message = "認証トークンの取得に失敗しました。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return nil, false
+	}
+
+	parsedToken, err := Parse(token.Raw)
+	if err != nil {
+		var error model.Error
+		error.Message = "認証コードのパースに失敗しました。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return nil, false
+	}
+
+	var user model.User
+	if err := m.DB.Where("email = ?", parsedToken.Email).Find(&user).Error; err != nil {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return nil, false
+	}
+
+	if user.TokenVersion != parsedToken.TokenVersion {
+		var error model.Error
+		error.Message = "認証トークンが無効です。再度ログインしてください。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return nil, false
+	}
+
+	// jti の無い古いトークンやログアウト済みのセッションは通さない
+	var session model.Session
+	if err := m.DB.Where("jti = ? AND user_id = ?", parsedToken.Jti, user.ID).Find(&session).Error; parsedToken.Jti == "" || err != nil {
+		var error model.Error
+		error.Message = "セッションが無効です。再度ログインしてください。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return nil, false
+	}
+
+	now := time.Now()
+	if now.Sub(session.LastSeenAt) > time.Minute {
+		if err := m.DB.Model(&session).UpdateColumn("last_seen_at", now).Error; err != nil {
+			log.Println(err)
+		}
+	}
+
+	return &authContext{User: user, Scopes: loginScopes, SessionID: session.ID}, true
+}
+
+func (m *AuthMiddleware) personalAccessToken(w http.ResponseWriter, r *http.Request) (*authContext, bool) {
+	bearerToken := strings.Split(r.Header.Get("Authorization"), " ")
+
+	var token model.PersonalAccessToken
+	if err := m.DB.Where("token_hash = ?", hashPersonalAccessToken(bearerToken[1])).Find(&token).Error; err != nil {
+		var error model.Error
+		error.Message = "認証トークンが無効です。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return nil, false
+	}
+
+	var user model.User
+	if err := m.DB.Where("id = ?", token.UserID).Find(&user).Error; err != nil {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return nil, false
+	}
+
+	// 毎リクエスト書き込まないよう、最終使用日時は1分単位で更新する
+	now := time.Now()
+	if token.LastUsedAt == nil || now.Sub(*token.LastUsedAt) > time.Minute {
+		if err := m.DB.Model(&token).UpdateColumn("last_used_at", now).Error; err != nil {
+			log.Println(err)
+		}
+	}
+
+	return &authContext{User: user, Scopes: strings.Fields(token.Scopes), AccessTokenID: token.ID}, true
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authUser は AuthMiddleware が読み込んだリクエストユーザーを返す。
+func authUser(r *http.Request) (model.User, bool) {
+	ac, ok := r.Context().Value(authKey).(*authContext)
+	if !ok {
+		return model.User{}, false
+	}
+
+	return ac.User, true
+}
@@ -9,31 +9,192 @@ type User struct {
 	DeletedAt        *time.Time `json:"deletedAt"`
 	Name             string     `json:"name"`
 	Email            string     `json:"email"`
-	Age              int        `json:"age"`
+	Age              int        `json:"age" gorm:"-"`
+	BirthYear        *int       `json:"birthYear"`
+	BirthMonth       *int       `json:"birthMonth"`
 	Gender           int        `json:"gender"`
 	ImageUrl         string     `json:"imageUrl"`
 	FavoriteMusicAge int        `json:"favoriteMusicAge"`
 	FavoriteArtist   string     `json:"favoriteArtist"`
+	FavoriteArtistID *uint      `json:"favoriteArtistId"`
 	Comment          string     `json:"comment"`
+	PendingComment   *string    `json:"-"`
 	Password         string     `json:"-"`
-	Bookmarkings     []*Song    `json:"bookmarkings" gorm:"many2many:bookmarks;"`
-	Followings       []*User    `json:"followings" gorm:"many2many:user_follows;association_jointable_foreignkey:follow_id"`
+	EmailVerifiedAt  *time.Time `json:"emailVerifiedAt"`
+	PendingEmail     string     `json:"-"`
+	TokenVersion     uint       `json:"-"`
+	TOTPSecret       string     `json:"-"`
+	TOTPEnabled      bool       `json:"totpEnabled"`
+	TOTPLastStep     int64      `json:"-"`
+	SpotifyID        *string    `json:"-"`
+	SuspendedAt      *time.Time `json:"suspendedAt"`
+	HiddenAt         *time.Time `json:"hiddenAt"`
+	IsPrivate        bool       `json:"isPrivate"`
+	ProfileVisibility
+	Roles        []string `json:"roles,omitempty" gorm:"-"`
+	Bookmarkings []*Song  `json:"bookmarkings" gorm:"many2many:bookmarks;"`
+	Followings   []*User  `json:"followings" gorm:"many2many:user_follows;association_jointable_foreignkey:follow_id"`
+}
+
+// AgeAt は生まれ年(と月)から t 時点の年齢を返す。生まれ年が無ければ 0。
+// 月が無い場合は、その年の誕生日を迎えたものとして数える。
+func (u User) AgeAt(t time.Time) int {
+	if u.BirthYear == nil {
+		return 0
+	}
+
+	age := t.Year() - *u.BirthYear
+	if u.BirthMonth != nil && int(t.Month()) < *u.BirthMonth {
+		age--
+	}
+
+	return age
+}
+
+// AfterFind は読み込み時に年齢を計算する。API の age は互換のため残している。
+func (u *User) AfterFind() error {
+	u.Age = u.AgeAt(time.Now())
+	return nil
 }
 
 type Song struct {
+	ID             uint           `json:"id"`
+	CreatedAt      time.Time      `json:"createdAt"`
+	UpdatedAt      time.Time      `json:"updatedAt"`
+	DeletedAt      *time.Time     `json:"deletedAt"`
+	Title          string         `json:"title"`
+	Artist         string         `json:"artist"`
+	ArtistID       *uint          `json:"artistId"`
+	MusicAge       int            `json:"musicAge"`
+	Image          string         `json:"image"`
+	Video          string         `json:"video"`
+	Album          string         `json:"album"`
+	Description    string         `json:"description"`
+	SpotifyTrackId string         `json:"spotifyTrackId"`
+	TrackID        *uint          `json:"trackId"`
+	UserID         uint           `json:"userId"`
+	HiddenAt       *time.Time     `json:"hiddenAt"`
+	Track          *Track         `json:"track,omitempty" gorm:"-"`
+	CommentCount   int            `json:"commentCount" gorm:"-"`
+	Reactions      map[string]int `json:"reactions" gorm:"-"`
+	Tags           []Tag          `json:"tags" gorm:"-"`
+	Hashtags       []Hashtag      `json:"hashtags" gorm:"-"`
+}
+
+// Track は投稿をまとめる曲そのもの。同じ Spotify の曲や同じ ISRC の投稿は1つの Track を指す。
+// どちらも無い投稿は曲名とアーティストが同じものをまとめる。
+type Track struct {
 	ID             uint       `json:"id"`
 	CreatedAt      time.Time  `json:"createdAt"`
 	UpdatedAt      time.Time  `json:"updatedAt"`
 	DeletedAt      *time.Time `json:"deletedAt"`
+	SpotifyTrackId *string    `json:"spotifyTrackId"`
+	ISRC           *string    `json:"isrc" gorm:"column:isrc"`
 	Title          string     `json:"title"`
 	Artist         string     `json:"artist"`
-	MusicAge       int        `json:"musicAge"`
-	Image          string     `json:"image"`
-	Video          string     `json:"video"`
 	Album          string     `json:"album"`
-	Description    string     `json:"description"`
-	SpotifyTrackId string     `json:"spotifyTrackId"`
-	UserID         uint       `json:"userId"`
+	Image          string     `json:"image"`
+	MusicAge       int        `json:"musicAge"`
+	PostCount      int        `json:"postCount" gorm:"-"`
+}
+
+// TrackPage は曲のページ。見られる投稿と、それらへのブックマーク数・最近のコメントをまとめる。
+type TrackPage struct {
+	Track         Track         `json:"track"`
+	Songs         []Song        `json:"songs"`
+	BookmarkCount int           `json:"bookmarkCount"`
+	Comments      []SongComment `json:"comments"`
+}
+
+// Artist はアーティスト。Song.Artist と User.FavoriteArtist の文字列はここに結び付ける。
+// NormalizedName と別名の NormalizedName はどちらもアーティストをまたいで一意になる。
+type Artist struct {
+	ID              uint          `json:"id"`
+	CreatedAt       time.Time     `json:"createdAt"`
+	UpdatedAt       time.Time     `json:"updatedAt"`
+	DeletedAt       *time.Time    `json:"deletedAt"`
+	Name            string        `json:"name"`
+	NormalizedName  string        `json:"-"`
+	SpotifyArtistId *string       `json:"spotifyArtistId"`
+	MusicBrainzId   *string       `json:"musicBrainzId"`
+	Aliases         []ArtistAlias `json:"aliases" gorm:"association_autoupdate:false;association_autocreate:false"`
+}
+
+// ArtistAlias はアーティストの別名。"YMO" と "Yellow Magic Orchestra" のような表記を同じアーティストにする。
+type ArtistAlias struct {
+	ID             uint       `json:"id"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	UpdatedAt      time.Time  `json:"updatedAt"`
+	DeletedAt      *time.Time `json:"deletedAt"`
+	ArtistID       uint       `json:"artistId"`
+	Name           string     `json:"name"`
+	NormalizedName string     `json:"-"`
+}
+
+// ArtistDecade はアーティストの曲が出た年代ごとの投稿数。Decade は 1980 のような年代の始めの年。
+type ArtistDecade struct {
+	Decade int `json:"decade"`
+	Count  int `json:"count"`
+}
+
+// ArtistPage はアーティストのページ。
+type ArtistPage struct {
+	Artist    Artist         `json:"artist"`
+	SongCount int            `json:"songCount"`
+	Songs     []Song         `json:"songs"`
+	Fans      []Profile      `json:"fans"`
+	Decades   []ArtistDecade `json:"decades"`
+}
+
+// ArtistForm は管理画面でアーティストを編集するときのリクエスト。Aliases は別名をすべて置き換える。
+type ArtistForm struct {
+	Name            string   `json:"name"`
+	SpotifyArtistId *string  `json:"spotifyArtistId"`
+	MusicBrainzId   *string  `json:"musicBrainzId"`
+	Aliases         []string `json:"aliases"`
+}
+
+// ArtistMergeForm はアーティストを TargetID のアーティストにまとめるときのリクエスト。
+type ArtistMergeForm struct {
+	TargetID uint `json:"targetId"`
+}
+
+// Hashtag は説明文中のハッシュタグ。Start と End は # を含む範囲の位置で、
+// JavaScript の String と同じ UTF-16 のコード単位で数える(絵文字などは2つと数える)。
+type Hashtag struct {
+	Text  string `json:"text"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// SongHashtag は説明文のハッシュタグから作った曲とタグのつながり。手で付けた SongTag とは別に持つ。
+type SongHashtag struct {
+	ID        uint       `json:"id"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	DeletedAt *time.Time `json:"deletedAt"`
+	SongID    uint       `json:"songId"`
+	TagID     uint       `json:"tagId"`
+}
+
+// Tag は曲の分類。NormalizedName は大文字小文字・全角半角・カタカナひらがなの違いを揃えたもので、一意になる。
+type Tag struct {
+	ID             uint       `json:"id"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	UpdatedAt      time.Time  `json:"updatedAt"`
+	DeletedAt      *time.Time `json:"deletedAt"`
+	Name           string     `json:"name"`
+	NormalizedName string     `json:"-"`
+	SongCount      int        `json:"songCount,omitempty" gorm:"-"`
+}
+
+type SongTag struct {
+	ID        uint       `json:"id"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	DeletedAt *time.Time `json:"deletedAt"`
+	SongID    uint       `json:"songId"`
+	TagID     uint       `json:"tagId"`
 }
 
 type Bookmark struct {
@@ -54,17 +215,388 @@ type UserFollow struct {
 	FollowID  uint       `json:"followId"`
 }
 
+// UserToken はメール確認・パスワード再設定用トークンの使用状況を表す。
+type UserToken struct {
+	ID        uint       `json:"id"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	DeletedAt *time.Time `json:"deletedAt"`
+	UserID    uint       `json:"userId"`
+	Purpose   string     `json:"purpose"`
+	Jti       string     `json:"-"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	UsedAt    *time.Time `json:"usedAt"`
+}
+
+// LoginAttempt はログインの試行履歴を表す。
+type LoginAttempt struct {
+	ID        uint       `json:"id"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	DeletedAt *time.Time `json:"deletedAt"`
+	Email     string     `json:"email"`
+	IP        string     `json:"ip"`
+	Succeeded bool       `json:"succeeded"`
+}
+
+// RecoveryCode は二段階認証の端末を失くした場合に使う使い捨てコードを表す。
+type RecoveryCode struct {
+	ID        uint       `json:"id"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	DeletedAt *time.Time `json:"deletedAt"`
+	UserID    uint       `json:"userId"`
+	CodeHash  string     `json:"-"`
+	UsedAt    *time.Time `json:"usedAt"`
+}
+
+// PersonalAccessToken はスクリプトや外部連携用に発行したトークンを表す。
+// Token は発行時のレスポンスにだけ含める。
+type PersonalAccessToken struct {
+	ID          uint       `json:"id"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+	DeletedAt   *time.Time `json:"deletedAt"`
+	UserID      uint       `json:"userId"`
+	Name        string     `json:"name"`
+	TokenHash   string     `json:"-"`
+	TokenPrefix string     `json:"tokenPrefix"`
+	Scopes      string     `json:"scopes"`
+	LastUsedAt  *time.Time `json:"lastUsedAt"`
+	Token       string     `json:"token,omitempty" gorm:"-"`
+}
+
+// Session はログイン中の端末を表す。Current はリクエストに使われたセッションかどうか。
+type Session struct {
+	ID         uint       `json:"id"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	DeletedAt  *time.Time `json:"deletedAt"`
+	UserID     uint       `json:"userId"`
+	Jti        string     `json:"-"`
+	UserAgent  string     `json:"userAgent"`
+	IP         string     `json:"ip"`
+	LastSeenAt time.Time  `json:"lastSeenAt"`
+	Current    bool       `json:"current" gorm:"-"`
+}
+
+// UserIdentity は OIDC の IdP のアカウント(iss ごとの sub)とユーザーの連携を表す。
+type UserIdentity struct {
+	ID        uint       `json:"id"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	DeletedAt *time.Time `json:"deletedAt"`
+	UserID    uint       `json:"userId"`
+	Provider  string     `json:"provider"`
+	Subject   string     `json:"-"`
+	Email     string     `json:"email"`
+}
+
+// OAuthLoginState は外部の認可画面でのログインを始めたときの code_verifier と nonce。
+// state の jti で引き、ログインを始めたブラウザの Cookie と合うときに一度だけ使える。
+type OAuthLoginState struct {
+	ID           uint       `json:"id"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	UpdatedAt    time.Time  `json:"updatedAt"`
+	DeletedAt    *time.Time `json:"deletedAt"`
+	Jti          string     `json:"-"`
+	Provider     string     `json:"provider"`
+	CodeVerifier string     `json:"-"`
+	Nonce        string     `json:"-"`
+	BindingHash  string     `json:"-"`
+	ExpiresAt    time.Time  `json:"expiresAt"`
+	UsedAt       *time.Time `json:"usedAt"`
+}
+
+// ProfileVisibility はプロフィールの項目ごとの公開範囲(public / followers / private)。
+type ProfileVisibility struct {
+	AgeVisibility              string `json:"ageVisibility"`
+	GenderVisibility           string `json:"genderVisibility"`
+	FavoriteMusicAgeVisibility string `json:"favoriteMusicAgeVisibility"`
+	FavoriteArtistVisibility   string `json:"favoriteArtistVisibility"`
+}
+
+// Profile は他のユーザーに返すプロフィール。公開範囲外の項目とメールアドレスは含めない。
+type Profile struct {
+	ID               uint      `json:"id"`
+	CreatedAt        time.Time `json:"createdAt"`
+	Name             string    `json:"name"`
+	ImageUrl         string    `json:"imageUrl"`
+	Comment          string    `json:"comment"`
+	Age              *int      `json:"age,omitempty"`
+	Gender           *int      `json:"gender,omitempty"`
+	FavoriteMusicAge *int      `json:"favoriteMusicAge,omitempty"`
+	FavoriteArtist   *string   `json:"favoriteArtist,omitempty"`
+	FavoriteArtistID *uint     `json:"favoriteArtistId,omitempty"`
+	IsPrivate        bool      `json:"isPrivate"`
+	Bookmarkings     []*Song   `json:"bookmarkings,omitempty"`
+	Followings       []Profile `json:"followings,omitempty"`
+}
+
+// FollowRequest は非公開アカウントへのフォロー申請を表す。承認されると UserFollow になる。
+type FollowRequest struct {
+	ID        uint       `json:"id"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	DeletedAt *time.Time `json:"deletedAt"`
+	UserID    uint       `json:"userId"`
+	FollowID  uint       `json:"followId"`
+	User      *User      `json:"-" gorm:"association_autoupdate:false;association_autocreate:false"`
+	Requester *Profile   `json:"user,omitempty" gorm:"-"`
+}
+
+// UserBlock は UserID のユーザーが BlockedID のユーザーをブロックしていることを表す。
+type UserBlock struct {
+	ID        uint       `json:"id"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	DeletedAt *time.Time `json:"deletedAt"`
+	UserID    uint       `json:"userId"`
+	BlockedID uint       `json:"blockedId"`
+}
+
+// UserMute は UserID のユーザーが MutedID のユーザーをミュートしていることを表す。
+type UserMute struct {
+	ID        uint       `json:"id"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	DeletedAt *time.Time `json:"deletedAt"`
+	UserID    uint       `json:"userId"`
+	MutedID   uint       `json:"mutedId"`
+}
+
+// Playlist はユーザーが曲を並べたプレイリスト。Visibility は public / followers / private。
+type Playlist struct {
+	ID          uint           `json:"id"`
+	CreatedAt   time.Time      `json:"createdAt"`
+	UpdatedAt   time.Time      `json:"updatedAt"`
+	DeletedAt   *time.Time     `json:"deletedAt"`
+	UserID      uint           `json:"userId"`
+	Title       string         `json:"title"`
+	Description string         `json:"description"`
+	Visibility  string         `json:"visibility"`
+	CoverImage  string         `json:"coverImage"`
+	Version     uint           `json:"version"`
+	Items       []PlaylistItem `json:"items,omitempty"`
+}
+
+// PlaylistItem はプレイリストの1曲。Position は1から始まる連番。
+type PlaylistItem struct {
+	ID         uint       `json:"id"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	DeletedAt  *time.Time `json:"deletedAt"`
+	PlaylistID uint       `json:"playlistId"`
+	SongID     uint       `json:"songId"`
+	Position   int        `json:"position"`
+	Note       string     `json:"note"`
+	AddedByID  uint       `json:"addedById"`
+	Song       *Song      `json:"song,omitempty" gorm:"association_autoupdate:false;association_autocreate:false"`
+}
+
+// PlaylistCollaborator はプレイリストに招待されたユーザー。Role は add(追加のみ)か edit(削除・並び替えも可)。
+type PlaylistCollaborator struct {
+	ID         uint       `json:"id"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	DeletedAt  *time.Time `json:"deletedAt"`
+	PlaylistID uint       `json:"playlistId"`
+	UserID     uint       `json:"userId"`
+	Role       string     `json:"role"`
+	AcceptedAt *time.Time `json:"acceptedAt"`
+	User       *Profile   `json:"user,omitempty" gorm:"-"`
+}
+
+// PlaylistActivity はプレイリストの曲の追加・削除・並び替えの記録。
+type PlaylistActivity struct {
+	ID         uint       `json:"id"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	DeletedAt  *time.Time `json:"deletedAt"`
+	PlaylistID uint       `json:"playlistId"`
+	UserID     uint       `json:"userId"`
+	Action     string     `json:"action"`
+	SongID     *uint      `json:"songId"`
+	Version    uint       `json:"version"`
+}
+
+// SongComment は曲へのコメント。返信は ParentID に最上位のコメントを持ち、スレッドは1段だけにする。
+type SongComment struct {
+	ID        uint                 `json:"id"`
+	CreatedAt time.Time            `json:"createdAt"`
+	UpdatedAt time.Time            `json:"updatedAt"`
+	DeletedAt *time.Time           `json:"deletedAt"`
+	SongID    uint                 `json:"songId"`
+	UserID    uint                 `json:"userId"`
+	ParentID  *uint                `json:"parentId"`
+	Body      string               `json:"body"`
+	EditedAt  *time.Time           `json:"editedAt"`
+	HiddenAt  *time.Time           `json:"hiddenAt"`
+	Mentions  []SongCommentMention `json:"mentions" gorm:"foreignkey:CommentID;association_autoupdate:false;association_autocreate:false"`
+	User      *Profile             `json:"user,omitempty" gorm:"-"`
+	Replies   []SongComment        `json:"replies,omitempty" gorm:"-"`
+}
+
+// SongCommentMention はコメント中の @ユーザー名 を解決したユーザー。
+type SongCommentMention struct {
+	ID        uint       `json:"id"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	DeletedAt *time.Time `json:"deletedAt"`
+	CommentID uint       `json:"commentId"`
+	UserID    uint       `json:"userId"`
+	Name      string     `json:"name"`
+}
+
+// SongReaction は曲へのリアクション。1人が1曲につけられるのは1種類だけ。
+type SongReaction struct {
+	ID        uint       `json:"id"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	DeletedAt *time.Time `json:"deletedAt"`
+	UserID    uint       `json:"userId"`
+	SongID    uint       `json:"songId"`
+	Type      string     `json:"type"`
+	User      *Profile   `json:"user,omitempty" gorm:"-"`
+}
+
+// Notification はユーザーへのお知らせ。未読の間は同じ GroupKey の出来事を1件にまとめ、
+// Actors に最近の数人、ActorCount に人数を入れる(「Aさんと他3人が…」)。
+// UnreadGroupKey は未読の間だけ GroupKey と同じ値を持ち、一意キーで同じまとまりの未読を1件に限る。
+type Notification struct {
+	ID             uint       `json:"id"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	UpdatedAt      time.Time  `json:"updatedAt"`
+	DeletedAt      *time.Time `json:"deletedAt"`
+	UserID         uint       `json:"userId"`
+	Type           string     `json:"type"`
+	GroupKey       string     `json:"-"`
+	UnreadGroupKey *string    `json:"-"`
+	SongID         *uint      `json:"songId"`
+	CommentID      *uint      `json:"commentId"`
+	ActorCount     int        `json:"actorCount"`
+	ReadAt         *time.Time `json:"readAt"`
+	Actors         []Profile  `json:"actors" gorm:"-"`
+}
+
+// NotificationActor はまとめたお知らせの出来事を起こしたユーザー。
+type NotificationActor struct {
+	ID             uint       `json:"id"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	UpdatedAt      time.Time  `json:"updatedAt"`
+	DeletedAt      *time.Time `json:"deletedAt"`
+	NotificationID uint       `json:"notificationId"`
+	ActorID        uint       `json:"actorId"`
+}
+
+// NotificationPreference はお知らせの種類ごとの受け取り設定。行が無い種類は受け取る。
+type NotificationPreference struct {
+	ID        uint       `json:"id"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	DeletedAt *time.Time `json:"deletedAt"`
+	UserID    uint       `json:"userId"`
+	Type      string     `json:"type"`
+	Enabled   bool       `json:"enabled"`
+}
+
+// Notifications はお知らせ一覧のレスポンス。
+type Notifications struct {
+	Notifications []Notification `json:"notifications"`
+	UnreadCount   int            `json:"unreadCount"`
+}
+
+// Report はユーザーからの通報を表す。同じ対象への通報は ModerationCase にまとめる。
+type Report struct {
+	ID               uint       `json:"id"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	UpdatedAt        time.Time  `json:"updatedAt"`
+	DeletedAt        *time.Time `json:"deletedAt"`
+	ReporterID       uint       `json:"reporterId"`
+	TargetType       string     `json:"targetType"`
+	TargetID         uint       `json:"targetId"`
+	Reason           string     `json:"reason"`
+	Detail           string     `json:"detail"`
+	ModerationCaseID uint       `json:"moderationCaseId"`
+}
+
+// ModerationCase はモデレーターが対応する通報対象1件を表す。
+type ModerationCase struct {
+	ID          uint               `json:"id"`
+	CreatedAt   time.Time          `json:"createdAt"`
+	UpdatedAt   time.Time          `json:"updatedAt"`
+	DeletedAt   *time.Time         `json:"deletedAt"`
+	TargetType  string             `json:"targetType"`
+	TargetID    uint               `json:"targetId"`
+	Status      string             `json:"status"`
+	OpenKey     *bool              `json:"-"`
+	ReportCount int                `json:"reportCount"`
+	FlaggedRule string             `json:"flaggedRule"`
+	HoldApplied bool               `json:"holdApplied"`
+	ResolvedAt  *time.Time         `json:"resolvedAt"`
+	Reports     []Report           `json:"reports,omitempty"`
+	Actions     []ModerationAction `json:"actions,omitempty"`
+}
+
+// ModerationAction はモデレーターの判断の記録。
+type ModerationAction struct {
+	ID               uint       `json:"id"`
+	CreatedAt        time.Time  `json:"createdAt"`
+	UpdatedAt        time.Time  `json:"updatedAt"`
+	DeletedAt        *time.Time `json:"deletedAt"`
+	ModerationCaseID uint       `json:"moderationCaseId"`
+	ModeratorID      uint       `json:"moderatorId"`
+	Action           string     `json:"action"`
+	Note             string     `json:"note"`
+}
+
+// UserRole はユーザーに付与されたロールを表す。
+type UserRole struct {
+	ID        uint       `json:"id"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt time.Time  `json:"updatedAt"`
+	DeletedAt *time.Time `json:"deletedAt"`
+	UserID    uint       `json:"userId"`
+	Role      string     `json:"role"`
+}
+
+// AdminStats は管理画面に表示する件数をまとめたもの。
+type AdminStats struct {
+	Users          int `json:"users"`
+	SuspendedUsers int `json:"suspendedUsers"`
+	Songs          int `json:"songs"`
+	Bookmarks      int `json:"bookmarks"`
+	Follows        int `json:"follows"`
+}
+
 type JWT struct {
 	Token string `json:"token"`
 }
 
+// TwoFactorChallenge はパスワード確認後、二段階認証のコードを求めるレスポンスを表す。
+type TwoFactorChallenge struct {
+	TwoFactorRequired bool   `json:"twoFactorRequired"`
+	ChallengeToken    string `json:"challengeToken"`
+}
+
+type TwoFactorSetup struct {
+	Secret     string `json:"secret"`
+	OtpauthURL string `json:"otpauthUrl"`
+}
+
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
 type Error struct {
 	Message string `json:"message"`
 }
 
 // Auth は署名前の認証トークン情報を表す。
 type Auth struct {
-	Email string
+	Email        string
+	TokenVersion uint
+	Jti          string
 }
 
 type Form struct {
@@ -72,6 +604,107 @@ type Form struct {
 	Password string `json:"password"`
 }
 
+type TwoFactorCodeForm struct {
+	Code string `json:"code"`
+}
+
+type TwoFactorLoginForm struct {
+	ChallengeToken string `json:"challengeToken"`
+	Code           string `json:"code"`
+}
+
+type PersonalAccessTokenForm struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type ReportForm struct {
+	TargetType string `json:"targetType"`
+	TargetID   uint   `json:"targetId"`
+	Reason     string `json:"reason"`
+	Detail     string `json:"detail"`
+}
+
+type ModerationForm struct {
+	Action string `json:"action"`
+	Note   string `json:"note"`
+}
+
+type PrivacyForm struct {
+	IsPrivate bool `json:"isPrivate"`
+}
+
+type PlaylistForm struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Visibility  string `json:"visibility"`
+	CoverImage  string `json:"coverImage"`
+	Version     *uint  `json:"version"`
+}
+
+type PlaylistItemForm struct {
+	SongID   uint   `json:"songId"`
+	Note     string `json:"note"`
+	Position int    `json:"position"`
+	Version  *uint  `json:"version"`
+}
+
+type MovePlaylistItemForm struct {
+	Position int   `json:"position"`
+	Version  *uint `json:"version"`
+}
+
+type ReorderPlaylistForm struct {
+	ItemIDs []uint `json:"itemIds"`
+	Version *uint  `json:"version"`
+}
+
+type PlaylistCollaboratorForm struct {
+	UserID uint   `json:"userId"`
+	Role   string `json:"role"`
+}
+
+type SongCommentForm struct {
+	Body     string `json:"body"`
+	ParentID *uint  `json:"parentId"`
+}
+
+type SongReactionForm struct {
+	Type string `json:"type"`
+}
+
+type SongTagsForm struct {
+	Tags []string `json:"tags"`
+}
+
+type SpotifyTokenForm struct {
+	Token string `json:"token"`
+}
+
+type RolesForm struct {
+	Roles []string `json:"roles"`
+}
+
+type TokenForm struct {
+	Token string `json:"token"`
+}
+
+type ChangePasswordForm struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
+}
+
+type ResetPasswordForm struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// OAuthCallbackForm は Spotify や OIDC の認可後に受け取った code と、発行時に渡した state を表す。
+type OAuthCallbackForm struct {
+	Code  string `json:"code"`
+	State string `json:"state"`
+}
+
 type Code struct {
 	Code string
 }
@@ -152,6 +785,34 @@ type Tracks struct {
 	} `json:"tracks"`
 }
 
+// SpotifyTrack は Spotify の /v1/tracks/{id} のレスポンスのうち使う項目。
+type SpotifyTrack struct {
+	ID      string `json:"id"`
+	Artists []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"artists"`
+}
+
+// SpotifyArtists は Spotify の /v1/artists のレスポンスのうち使う項目。
+type SpotifyArtists struct {
+	Artists []struct {
+		ID     string   `json:"id"`
+		Name   string   `json:"name"`
+		Genres []string `json:"genres"`
+	} `json:"artists"`
+}
+
+// SpotifyUser は Spotify の /v1/me のレスポンスを表す。
+type SpotifyUser struct {
+	ID          string `json:"id"`
+	DisplayName string `json:"display_name"`
+	Email       string `json:"email"`
+	Images      []struct {
+		URL string `json:"url"`
+	} `json:"images"`
+}
+
 type Response struct {
 	Tracks Tracks `json:"tracks"`
 }
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"golang-songs/model"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// 通報の対象
+const (
+	reportTargetSong = "song"
+	reportTargetUser = "user"
+	// reportTargetUserComment は自動フィルタで保留にしたプロフィールの自己紹介。通報の対象にはならない
+	reportTargetUserComment = "user_comment"
+	// reportTargetComment は自動フィルタで保留にした曲のコメント。通報の対象にはならない
+	reportTargetComment = "comment"
+)
+
+// 通報の理由
+var reportReasons = []string{
+	"spam",
+	"harassment",
+	"hate",
+	"sexual",
+	"violence",
+	"copyright",
+	"personal_info",
+	"other",
+}
+
+// 対応状況
+const (
+	moderationOpen      = "open"
+	moderationDismissed = "dismissed"
+	moderationHidden    = "hidden"
+	moderationSuspended = "suspended"
+)
+
+// モデレーターの操作
+const (
+	moderationActionDismiss = "dismiss"
+	moderationActionHide    = "hide"
+	moderationActionSuspend = "suspend"
+)
+
+var errModerationCaseResolved = errors.New("moderation case already resolved")
+var errSuspendForbidden = errors.New("cannot suspend a moderator or admin")
+
+var moderationActionStatus = map[string]string{
+	moderationActionDismiss: moderationDismissed,
+	moderationActionHide:    moderationHidden,
+	moderationActionSuspend: moderationSuspended,
+}
+
+// canSeeHidden は非表示にされたコンテンツを見られるか(投稿者本人かモデレーター)を返す。
+func canSeeHidden(r *http.Request, ownerID uint) bool {
+	ac, ok := r.Context().Value(authKey).(*authContext)
+	if !ok {
+		return false
+	}
+
+	return ac.User.ID == ownerID || ac.hasPermission(permissionModerate)
+}
+
+type ReportHandler struct {
+	DB *gorm.DB
+}
+
+// 曲またはユーザーを通報する
+// 対応待ちの同じ対象への通報は1件のケースにまとめ、同じユーザーからの重複は受け付けない
+func (f *ReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.ReportForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if !hasScope(reportReasons, d.Reason) {
+		var error model.Error
+		error.Message = "通報の理由が正しくありません。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	var err error
+	switch d.TargetType {
+	case reportTargetSong:
+		err = f.DB.Where("id = ?", d.TargetID).Find(&model.Song{}).Error
+	case reportTargetUser:
+		err = f.DB.Where("id = ?", d.TargetID).Find(&model.User{}).Error
+	default:
+		var error model.Error
+		error.Message = "通報の対象が正しくありません。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+	if err != nil {
+		var error model.Error
+		error.Message = "通報の対象が見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	var duplicated bool
+
+	err = retryOnDuplicate(func() error {
+		return f.DB.Transaction(func(tx *gorm.DB) error {
+			duplicated = false
+
+			c, err := openModerationCase(tx, d.TargetType, d.TargetID)
+			if err != nil {
+				return err
+			}
+
+			var count int
+			if err := tx.Model(&model.Report{}).Where("reporter_id = ? AND moderation_case_id = ?", user.ID, c.ID).Count(&count).Error; err != nil {
+				return err
+			}
+			if count > 0 {
+				duplicated = true
+				return nil
+			}
+
+			if err := tx.Create(&model.Report{
+				ReporterID:       user.ID,
+				TargetType:       d.TargetType,
+				TargetID:         d.TargetID,
+				Reason:           d.Reason,
+				Detail:           d.Detail,
+				ModerationCaseID: c.ID}).Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&c).UpdateColumn("report_count", gorm.Expr("report_count + 1")).Error
+		})
+	})
+	if err != nil {
+		var error model.Error
+		error.Message = "通報に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if duplicated {
+		var error model.Error
+		error.Message = "この対象は既に通報済みです。"
+		errorInResponse(w, http.StatusConflict, error)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+type ModerationCasesHandler struct {
+	DB *gorm.DB
+}
+
+// 対応状況ごとのケース一覧を返す。通報の多い順に並べる
+func (f *ModerationCasesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = moderationOpen
+	}
+
+	cases := []model.ModerationCase{}
+
+	if err := f.DB.Where("status = ?", status).Order("report_count desc, created_at asc").Limit(100).Find(&cases).Error; err != nil {
+		var error model.Error
+		error.Message = "通報一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, cases)
+}
+
+type ModerationCaseHandler struct {
+	DB *gorm.DB
+}
+
+// ケースの通報内容と対応履歴を返す
+func (f *ModerationCaseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var c model.ModerationCase
+
+	if err := f.DB.Preload("Reports").Preload("Actions").Where("id = ?", mux.Vars(r)["id"]).Find(&c).Error; err != nil {
+		var error model.Error
+		error.Message = "該当する通報が見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	writeJSON(w, c)
+}
+
+type ResolveModerationCaseHandler struct {
+	DB *gorm.DB
+}
+
+// ケースに対応する。非表示・利用停止の場合は対象に反映し、判断はすべて記録する
+func (f *ResolveModerationCaseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	moderator, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.ModerationForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	status, ok := moderationActionStatus[d.Action]
+	if !ok {
+		var error model.Error
+		error.Message = "対応の種類が正しくありません。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	var c model.ModerationCase
+	if err := f.DB.Where("id = ?", mux.Vars(r)["id"]).Find(&c).Error; err != nil {
+		var error model.Error
+		error.Message = "該当する通報が見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	if c.Status != moderationOpen {
+		var error model.Error
+		error.Message = "この通報は対応済みです。"
+		errorInResponse(w, http.StatusConflict, error)
+		return
+	}
+
+	err := f.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		switch d.Action {
+		case moderationActionDismiss:
+			// 自動フィルタの保留で隠したものだけ公開する。ほかの理由で隠れていたものはそのまま
+			if c.HoldApplied {
+				if err := setTargetHidden(tx, c.TargetType, c.TargetID, nil); err != nil {
+					return err
+				}
+			}
+		case moderationActionHide:
+			if err := setTargetHidden(tx, c.TargetType, c.TargetID, &now); err != nil {
+				return err
+			}
+		case moderationActionSuspend:
+			author, err := targetAuthor(tx, c.TargetType, c.TargetID)
+			if err != nil {
+				return err
+			}
+			allowed, err := canSuspend(tx, r, author)
+			if err != nil {
+				return err
+			}
+			if !allowed {
+				return errSuspendForbidden
+			}
+			if err := setSuspended(tx, &author, true); err != nil {
+				return err
+			}
+		}
+
+		result := tx.Model(&c).Where("status = ?", moderationOpen).
+			UpdateColumns(map[string]interface{}{"status": status, "open_key": nil, "resolved_at": now})
+		if result.Error != nil {
+			return result.Error
+		}
+		// 他のモデレーターが先に対応した
+		if result.RowsAffected == 0 {
+			return errModerationCaseResolved
+		}
+
+		return tx.Create(&model.ModerationAction{
+			ModerationCaseID: c.ID,
+			ModeratorID:      moderator.ID,
+			Action:           d.Action,
+			Note:             d.Note}).Error
+	})
+	if err == errModerationCaseResolved {
+		var error model.Error
+		error.Message = "この通報は対応済みです。"
+		errorInResponse(w, http.StatusConflict, error)
+		return
+	}
+	if err == errSuspendForbidden {
+		var error model.Error
+		error.Message = "モデレーター・管理者のアカウントを利用停止する権限がありません。"
+		errorInResponse(w, http.StatusForbidden, error)
+		return
+	}
+	if err != nil {
+		var error model.Error
+		error.Message = "通報の対応に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+// openModerationCase は対象の対応待ちのケースを返す。無ければ作る。
+// 対応待ちのケースは open_key の一意キーで対象ごとに1件に限り、同時に作ると片方は一意キーに当たるので retryOnDuplicate でやり直す。
+func openModerationCase(tx *gorm.DB, targetType string, targetID uint) (model.ModerationCase, error) {
+	var c model.ModerationCase
+
+	err := tx.Where("target_type = ? AND target_id = ? AND open_key = ?", targetType, targetID, true).First(&c).Error
+	if gorm.IsRecordNotFoundError(err) {
+		open := true
+		c = model.ModerationCase{TargetType: targetType, TargetID: targetID, Status: moderationOpen, OpenKey: &open}
+		err = tx.Create(&c).Error
+	}
+
+	return c, err
+}
+
+// hideTarget は対象が表示中なら非表示にし、このとき隠したかを返す。
+func hideTarget(db *gorm.DB, targetType string, targetID uint, hiddenAt time.Time) (bool, error) {
+	var target interface{}
+	switch targetType {
+	case reportTargetSong:
+		target = &model.Song{}
+	case reportTargetUser:
+		target = &model.User{}
+	case reportTargetComment:
+		target = &model.SongComment{}
+	default:
+		return false, nil
+	}
+
+	result := db.Model(target).Where("id = ? AND hidden_at IS NULL", targetID).UpdateColumn("hidden_at", hiddenAt)
+
+	return result.RowsAffected > 0, result.Error
+}
+
+func setTargetHidden(db *gorm.DB, targetType string, targetID uint, hiddenAt *time.Time) error {
+	switch targetType {
+	case reportTargetSong:
+		return db.Model(&model.Song{}).Where("id = ?", targetID).UpdateColumn("hidden_at", hiddenAt).Error
+	case reportTargetUser:
+		return db.Model(&model.User{}).Where("id = ?", targetID).UpdateColumn("hidden_at", hiddenAt).Error
+	case reportTargetComment:
+		return db.Model(&model.SongComment{}).Where("id = ?", targetID).UpdateColumn("hidden_at", hiddenAt).Error
+	case reportTargetUserComment:
+		// 保留中の自己紹介は、公開するなら反映し、非表示にするなら捨てる。アカウントは隠さない
+		if hiddenAt == nil {
+			return db.Model(&model.User{}).Where("id = ? AND pending_comment IS NOT NULL", targetID).
+				UpdateColumns(map[string]interface{}{"comment": gorm.Expr("pending_comment"), "pending_comment": nil}).Error
+		}
+		return db.Model(&model.User{}).Where("id = ?", targetID).UpdateColumn("pending_comment", nil).Error
+	}
+
+	return nil
+}
+
+// targetAuthor は通報対象の投稿者(ユーザーの場合は本人)を返す。
+func targetAuthor(db *gorm.DB, targetType string, targetID uint) (model.User, error) {
+	var user model.User
+
+	userID := targetID
+	if targetType == reportTargetSong {
+		var song model.Song
+		if err := db.Unscoped().Where("id = ?", targetID).Find(&song).Error; err != nil {
+			return user, err
+		}
+		userID = song.UserID
+	}
+	if targetType == reportTargetComment {
+		var comment model.SongComment
+		if err := db.Unscoped().Where("id = ?", targetID).Find(&comment).Error; err != nil {
+			return user, err
+		}
+		userID = comment.UserID
+	}
+
+	err := db.Where("id = ?", userID).Find(&user).Error
+
+	return user, err
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"golang-songs/model"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+func newModerationTestDB(t *testing.T) *gorm.DB {
+	db := newTestDB(t, &model.User{}, &model.Song{}, &model.Report{}, &model.ModerationCase{}, &model.ModerationAction{})
+	if err := db.Model(&model.ModerationCase{}).AddUniqueIndex("uq_moderation_cases_open", "target_type", "target_id", "open_key").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func reportTarget(db *gorm.DB, reporter model.User, targetType string, targetID uint) int {
+	r := httptest.NewRequest("POST", "/api/reports", strings.NewReader(
+		fmt.Sprintf(`{"targetType":%q,"targetId":%d,"reason":"spam"}`, targetType, targetID)))
+	w := httptest.NewRecorder()
+	(&ReportHandler{DB: db}).ServeHTTP(w, withAuthUser(r, reporter))
+
+	return w.Code
+}
+
+func resolveCase(db *gorm.DB, moderator model.User, caseID uint, action string) int {
+	r := httptest.NewRequest("POST", "/api/admin/moderation/resolve", strings.NewReader(fmt.Sprintf(`{"action":%q}`, action)))
+	r = mux.SetURLVars(withAuthUser(r, moderator), map[string]string{"id": fmt.Sprint(caseID)})
+	w := httptest.NewRecorder()
+	(&ResolveModerationCaseHandler{DB: db}).ServeHTTP(w, r)
+
+	return w.Code
+}
+
+func TestRetryOnDuplicate(t *testing.T) {
+	var calls int
+	err := retryOnDuplicate(func() error {
+		calls++
+		if calls == 1 {
+			return &mysql.MySQLError{Number: mysqlDuplicateEntry, Message: "Duplicate entry"}
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("err = %v, calls = %d, want nil after 2 calls", err, calls)
+	}
+
+	calls = 0
+	err = retryOnDuplicate(func() error {
+		calls++
+		return &mysql.MySQLError{Number: mysqlDuplicateEntry, Message: "Duplicate entry"}
+	})
+	if !isDuplicateKeyError(err) || calls != duplicateRetries {
+		t.Errorf("err = %v, calls = %d, want the duplicate error after %d calls", err, calls, duplicateRetries)
+	}
+
+	// 一意キー以外のエラーはやり直さない
+	calls = 0
+	err = retryOnDuplicate(func() error {
+		calls++
+		return &mysql.MySQLError{Number: 1213, Message: "Deadlock found"}
+	})
+	if isDuplicateKeyError(err) || calls != 1 {
+		t.Errorf("err = %v, calls = %d, want the error after 1 call", err, calls)
+	}
+}
+
+func TestReportOpensOneCase(t *testing.T) {
+	db := newModerationTestDB(t)
+
+	users := []model.User{{Email: "a@example.com"}, {Email: "b@example.com"}, {Email: "c@example.com"}}
+	for i := range users {
+		if err := db.Create(&users[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	song := model.Song{Title: "title", UserID: users[0].ID}
+	if err := db.Create(&song).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, reporter := range users[1:] {
+		if code := reportTarget(db, reporter, reportTargetSong, song.ID); code != http.StatusCreated {
+			t.Fatalf("report status = %d, want 201", code)
+		}
+	}
+	if code := reportTarget(db, users[1], reportTargetSong, song.ID); code != http.StatusConflict {
+		t.Errorf("duplicated report status = %d, want 409", code)
+	}
+
+	var cases []model.ModerationCase
+	if err := db.Find(&cases).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(cases) != 1 || cases[0].ReportCount != 2 {
+		t.Fatalf("cases = %+v, want 1 case with 2 reports", cases)
+	}
+
+	// 2件目の対応待ちケースは一意キーで作れない
+	open := true
+	if err := db.Create(&model.ModerationCase{TargetType: reportTargetSong, TargetID: song.ID, Status: moderationOpen, OpenKey: &open}).Error; err == nil {
+		t.Error("a second open case was created")
+	}
+
+	// 対応済みになれば同じ対象に新しいケースを作れる
+	if code := resolveCase(db, users[0], cases[0].ID, moderationActionDismiss); code != http.StatusOK {
+		t.Fatalf("resolve status = %d, want 200", code)
+	}
+	if code := reportTarget(db, users[1], reportTargetSong, song.ID); code != http.StatusCreated {
+		t.Fatalf("report after resolve status = %d, want 201", code)
+	}
+	var count int
+	if err := db.Model(&model.ModerationCase{}).Where("status = ?", moderationOpen).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("open cases = %d, want 1", count)
+	}
+}
+
+func TestDismissHeldCase(t *testing.T) {
+	db := newModerationTestDB(t)
+
+	user := model.User{Email: "a@example.com"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	hiddenAt := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name       string
+		hiddenAt   *time.Time
+		wantHidden bool
+	}{
+		// 保留で隠したものは問題なしなら公開する
+		{"held by the filter", nil, false},
+		// モデレーターが先に隠していたものは、保留のケースを問題なしにしても隠したまま
+		{"hidden before the hold", &hiddenAt, true},
+	}
+
+	for _, tt := range tests {
+		song := model.Song{Title: tt.name, UserID: user.ID, HiddenAt: tt.hiddenAt}
+		if err := db.Create(&song).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		if err := holdForReview(db, reportTargetSong, song.ID, "rule"); err != nil {
+			t.Fatal(err)
+		}
+		// 同じ投稿が続けて保留になっても記録は変わらない
+		if err := holdForReview(db, reportTargetSong, song.ID, "rule"); err != nil {
+			t.Fatal(err)
+		}
+
+		var c model.ModerationCase
+		if err := db.Where("target_type = ? AND target_id = ?", reportTargetSong, song.ID).Find(&c).Error; err != nil {
+			t.Fatal(err)
+		}
+		if c.HoldApplied != (tt.hiddenAt == nil) {
+			t.Errorf("%s: HoldApplied = %v", tt.name, c.HoldApplied)
+		}
+
+		if code := resolveCase(db, user, c.ID, moderationActionDismiss); code != http.StatusOK {
+			t.Fatalf("%s: resolve status = %d, want 200", tt.name, code)
+		}
+
+		if err := db.Where("id = ?", song.ID).Find(&song).Error; err != nil {
+			t.Fatal(err)
+		}
+		if (song.HiddenAt != nil) != tt.wantHidden {
+			t.Errorf("%s: HiddenAt = %v, want hidden %v", tt.name, song.HiddenAt, tt.wantHidden)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang-songs/model"
+	"golang-songs/service"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// お知らせの種類
+const (
+	notificationFollow        = "follow"
+	notificationFollowRequest = "follow_request"
+	notificationBookmark      = "bookmark"
+	notificationComment       = "comment"
+	notificationReply         = "reply"
+	notificationMention       = "mention"
+)
+
+var notificationTypes = []string{
+	notificationFollow,
+	notificationFollowRequest,
+	notificationBookmark,
+	notificationComment,
+	notificationReply,
+	notificationMention,
+}
+
+const (
+	notificationsPerPage = 30
+	// notificationActorsShown はまとめたお知らせに載せる最近のユーザーの人数
+	notificationActorsShown = 3
+)
+
+// notificationEnabled は userID のユーザーが typ のお知らせを受け取るかを返す。
+func notificationEnabled(db *gorm.DB, userID uint, typ string) (bool, error) {
+	var preference model.NotificationPreference
+	err := db.Where("user_id = ? AND type = ?", userID, typ).Find(&preference).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return true, nil
+	}
+
+	return preference.Enabled, err
+}
+
+// notify は recipientID のユーザーにお知らせを作り、接続中のストリームにも流す。
+// 未読の同じ種類・同じ曲のお知らせがあればそこに actor を加えてまとめる。
+// 自分自身の操作、受け取らない設定の種類、ブロック・ミュートした相手の操作は知らせない。
+func notify(db *gorm.DB, hub *service.Hub, recipientID uint, actor model.User, typ string, songID *uint, commentID *uint) error {
+	if recipientID == actor.ID {
+		return nil
+	}
+
+	enabled, err := notificationEnabled(db, recipientID, typ)
+	if err != nil || !enabled {
+		return err
+	}
+
+	hiddenIDs, err := hiddenUserIDs(db, recipientID)
+	if err != nil {
+		return err
+	}
+	if hasUserID(hiddenIDs, actor.ID) {
+		return nil
+	}
+
+	groupKey := typ
+	if songID != nil {
+		groupKey = fmt.Sprintf("%s:song:%d", typ, *songID)
+	}
+
+	// 未読のまとまりは unread_group_key の一意キーで1件に限る。同時に作ろうとして当たった場合はやり直す
+	var notification model.Notification
+	err = retryOnDuplicate(func() error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			notification = model.Notification{}
+			err := tx.Where("user_id = ? AND unread_group_key = ?", recipientID, groupKey).First(&notification).Error
+			if err != nil && !gorm.IsRecordNotFoundError(err) {
+				return err
+			}
+
+			if gorm.IsRecordNotFoundError(err) {
+				notification = model.Notification{
+					UserID:         recipientID,
+					Type:           typ,
+					GroupKey:       groupKey,
+					UnreadGroupKey: &groupKey,
+					SongID:         songID}
+				if err := tx.Create(&notification).Error; err != nil {
+					return err
+				}
+			}
+
+			var notificationActor model.NotificationActor
+			if err := tx.Where(model.NotificationActor{NotificationID: notification.ID, ActorID: actor.ID}).FirstOrCreate(&notificationActor).Error; err != nil {
+				return err
+			}
+			// 同じユーザーの出来事でも新しい順に並ぶよう更新日時を進める
+			if err := tx.Model(&notificationActor).Update("updated_at", time.Now()).Error; err != nil {
+				return err
+			}
+
+			var count int
+			if err := tx.Model(&model.NotificationActor{}).Where("notification_id = ?", notification.ID).Count(&count).Error; err != nil {
+				return err
+			}
+
+			return tx.Model(&notification).Updates(map[string]interface{}{
+				"actor_count": count,
+				"comment_id":  commentID,
+			}).Error
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	notifications := []model.Notification{notification}
+	if err := attachNotificationActors(db, recipientID, notifications); err != nil {
+		return err
+	}
+
+	return hub.Publish(recipientID, streamNotification, notifications[0])
+}
+
+// notifyOrLog はお知らせを作る。失敗しても元の操作は成功とし、ログに残すだけにする。
+func notifyOrLog(db *gorm.DB, hub *service.Hub, recipientID uint, actor model.User, typ string, songID *uint, commentID *uint) {
+	if err := notify(db, hub, recipientID, actor, typ, songID, commentID); err != nil {
+		log.Println(err)
+	}
+}
+
+// attachNotificationActors はお知らせに最近のユーザーのプロフィールを入れる。
+func attachNotificationActors(db *gorm.DB, viewerID uint, notifications []model.Notification) error {
+	for i := range notifications {
+		var actors []model.NotificationActor
+		err := db.Where("notification_id = ?", notifications[i].ID).
+			Order("updated_at desc").Limit(notificationActorsShown).Find(&actors).Error
+		if err != nil {
+			return err
+		}
+
+		ids := []uint{}
+		for _, actor := range actors {
+			ids = append(ids, actor.ActorID)
+		}
+
+		var users []model.User
+		if err := db.Where("id IN (?)", ids).Find(&users).Error; err != nil {
+			return err
+		}
+
+		profiles, err := profilesFor(db, viewerID, users)
+		if err != nil {
+			return err
+		}
+
+		byID := map[uint]model.Profile{}
+		for _, profile := range profiles {
+			byID[profile.ID] = profile
+		}
+
+		notifications[i].Actors = []model.Profile{}
+		for _, id := range ids {
+			if profile, ok := byID[id]; ok {
+				notifications[i].Actors = append(notifications[i].Actors, profile)
+			}
+		}
+	}
+
+	return nil
+}
+
+type NotificationsHandler struct {
+	DB *gorm.DB
+}
+
+// お知らせを新しい順に返す。未読の件数も合わせて返す
+func (f *NotificationsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	body := model.Notifications{Notifications: []model.Notification{}}
+
+	err = f.DB.Where("user_id = ?", user.ID).Order("updated_at desc").
+		Limit(notificationsPerPage).Offset((page - 1) * notificationsPerPage).
+		Find(&body.Notifications).Error
+	if err != nil {
+		var error model.Error
+		error.Message = "お知らせの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err := f.DB.Model(&model.Notification{}).Where("user_id = ? AND read_at IS NULL", user.ID).Count(&body.UnreadCount).Error; err != nil {
+		var error model.Error
+		error.Message = "お知らせの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err := attachNotificationActors(f.DB, user.ID, body.Notifications); err != nil {
+		var error model.Error
+		error.Message = "お知らせの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, body)
+}
+
+type ReadNotificationHandler struct {
+	DB *gorm.DB
+}
+
+// お知らせを既読にする。以降の同じ出来事は新しいお知らせになる
+func (f *ReadNotificationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	var notification model.Notification
+	if err := f.DB.Where("id = ? AND user_id = ?", mux.Vars(r)["id"], user.ID).Find(&notification).Error; err != nil {
+		var error model.Error
+		error.Message = "該当するお知らせが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	if notification.ReadAt != nil {
+		return
+	}
+
+	// 既読にしたものにはもうまとめない
+	if err := f.DB.Model(&notification).UpdateColumns(map[string]interface{}{"read_at": time.Now(), "unread_group_key": nil}).Error; err != nil {
+		var error model.Error
+		error.Message = "お知らせの更新に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type ReadAllNotificationsHandler struct {
+	DB *gorm.DB
+}
+
+func (f *ReadAllNotificationsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	err := f.DB.Model(&model.Notification{}).Where("user_id = ? AND read_at IS NULL", user.ID).
+		UpdateColumns(map[string]interface{}{"read_at": time.Now(), "unread_group_key": nil}).Error
+	if err != nil {
+		var error model.Error
+		error.Message = "お知らせの更新に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+// notificationPreferences は種類ごとの受け取り設定を返す。設定していない種類は true。
+func notificationPreferences(db *gorm.DB, userID uint) (map[string]bool, error) {
+	var rows []model.NotificationPreference
+	if err := db.Where("user_id = ?", userID).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	preferences := map[string]bool{}
+	for _, typ := range notificationTypes {
+		preferences[typ] = true
+	}
+	for _, row := range rows {
+		preferences[row.Type] = row.Enabled
+	}
+
+	return preferences, nil
+}
+
+type NotificationPreferencesHandler struct {
+	DB *gorm.DB
+}
+
+func (f *NotificationPreferencesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	preferences, err := notificationPreferences(f.DB, user.ID)
+	if err != nil {
+		var error model.Error
+		error.Message = "お知らせの設定の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, preferences)
+}
+
+type UpdateNotificationPreferencesHandler struct {
+	DB *gorm.DB
+}
+
+// 種類ごとの受け取り設定を変更する。指定しなかった種類は変更しない
+func (f *UpdateNotificationPreferencesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d map[string]bool
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	for typ := range d {
+		if !hasScope(notificationTypes, typ) {
+			var error model.Error
+			error.Message = "お知らせの種類が正しくありません: " + typ
+			errorInResponse(w, http.StatusBadRequest, error)
+			return
+		}
+	}
+
+	err := f.DB.Transaction(func(tx *gorm.DB) error {
+		for typ, enabled := range d {
+			var preference model.NotificationPreference
+			err := tx.Where(model.NotificationPreference{UserID: user.ID, Type: typ}).
+				Assign(map[string]interface{}{"enabled": enabled}).FirstOrCreate(&preference).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		var error model.Error
+		error.Message = "お知らせの設定の更新に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	preferences, err := notificationPreferences(f.DB, user.ID)
+	if err != nil {
+		var error model.Error
+		error.Message = "お知らせの設定の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, preferences)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"golang-songs/model"
+	"golang-songs/service"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestNotifyGroupsUnread(t *testing.T) {
+	// User の many2many が user_follows を id 無しで作らないよう、UserFollow を先に作る
+	db := newTestDB(t, &model.UserFollow{}, &model.User{}, &model.UserBlock{}, &model.UserMute{},
+		&model.NotificationPreference{}, &model.Notification{}, &model.NotificationActor{})
+	if err := db.Model(&model.Notification{}).AddUniqueIndex("uq_notifications_unread_group", "user_id", "unread_group_key").Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&model.NotificationActor{}).AddUniqueIndex("uq_notification_actors", "notification_id", "actor_id").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	hub, err := service.NewHub(service.NewBroker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users := []model.User{{Email: "a@example.com"}, {Email: "b@example.com"}, {Email: "c@example.com"}}
+	for i := range users {
+		if err := db.Create(&users[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	recipient := users[0]
+	songID := uint(1)
+
+	unread := func() []model.Notification {
+		var notifications []model.Notification
+		if err := db.Where("user_id = ? AND read_at IS NULL", recipient.ID).Find(&notifications).Error; err != nil {
+			t.Fatal(err)
+		}
+		return notifications
+	}
+
+	for _, actor := range []model.User{users[1], users[2], users[1]} {
+		if err := notify(db, hub, recipient.ID, actor, notificationBookmark, &songID, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	notifications := unread()
+	if len(notifications) != 1 || notifications[0].ActorCount != 2 {
+		t.Fatalf("unread = %+v, want 1 notification from 2 users", notifications)
+	}
+
+	// 同じまとまりの未読は一意キーで2件目を作れない
+	groupKey := notifications[0].GroupKey
+	if err := db.Create(&model.Notification{UserID: recipient.ID, Type: notificationBookmark, GroupKey: groupKey, UnreadGroupKey: &groupKey}).Error; err == nil {
+		t.Error("a second unread notification was created for the same group")
+	}
+
+	// 既読にしたものにはまとめず、新しいお知らせにする
+	r := httptest.NewRequest("POST", "/api/notifications/read", nil)
+	r = mux.SetURLVars(withAuthUser(r, recipient), map[string]string{"id": "1"})
+	(&ReadNotificationHandler{DB: db}).ServeHTTP(httptest.NewRecorder(), r)
+
+	if err := notify(db, hub, recipient.ID, users[2], notificationBookmark, &songID, nil); err != nil {
+		t.Fatal(err)
+	}
+	notifications = unread()
+	if len(notifications) != 1 || notifications[0].ID == 1 || notifications[0].ActorCount != 1 {
+		t.Errorf("unread = %+v, want a new notification from 1 user", notifications)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"golang-songs/model"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// loginBindingCookie は外部の認可画面でのログインを始めたブラウザを示す Cookie。
+// code と state を横取りされても、この Cookie が無ければ保存した state は使えない。
+// 別のブラウザで作った state を使わせてログインさせることもできない。
+const loginBindingCookie = "login_binding"
+
+func hashBinding(binding string) string {
+	sum := sha256.Sum256([]byte(binding))
+	return hex.EncodeToString(sum[:])
+}
+
+// startOAuthLogin は code_verifier・nonce・ブラウザを結び付ける値を作ってサーバーに保存し、
+// state の jti・code_verifier・nonce・ブラウザの Cookie に入れる値を返す。
+func startOAuthLogin(db *gorm.DB, provider string) (jti string, verifier string, nonce string, binding string, err error) {
+	if jti, err = randomHex(16); err != nil {
+		return
+	}
+	if verifier, err = randomHex(32); err != nil {
+		return
+	}
+	if nonce, err = randomHex(16); err != nil {
+		return
+	}
+	if binding, err = randomHex(32); err != nil {
+		return
+	}
+
+	err = db.Create(&model.OAuthLoginState{
+		Jti:          jti,
+		Provider:     provider,
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		BindingHash:  hashBinding(binding),
+		ExpiresAt:    time.Now().Add(oauthStateTTL)}).Error
+
+	return
+}
+
+// consumeOAuthLogin は state の jti で保存した値を引き、使用済みにして返す。
+// 期限切れ・使用済み・リクエストに別のブラウザの Cookie が付いている場合は errInvalidActionToken を返す。
+func consumeOAuthLogin(db *gorm.DB, r *http.Request, jti string, provider string) (model.OAuthLoginState, error) {
+	var loginState model.OAuthLoginState
+
+	binding := ""
+	if cookie, err := r.Cookie(loginBindingCookie); err == nil {
+		binding = cookie.Value
+	}
+	if jti == "" || binding == "" {
+		return loginState, errInvalidActionToken
+	}
+
+	if err := db.Where("jti = ? AND provider = ?", jti, provider).Find(&loginState).Error; err != nil {
+		return loginState, errInvalidActionToken
+	}
+
+	now := time.Now()
+	if loginState.UsedAt != nil || now.After(loginState.ExpiresAt) || loginState.BindingHash != hashBinding(binding) {
+		return loginState, errInvalidActionToken
+	}
+
+	// 同時に使われた場合に片方だけ通るよう、未使用の行だけを更新する
+	result := db.Model(&model.OAuthLoginState{}).Where("id = ? AND used_at IS NULL", loginState.ID).Update("used_at", now)
+	if result.Error != nil {
+		return loginState, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return loginState, errInvalidActionToken
+	}
+
+	return loginState, nil
+}
+
+// setBindingCookie はログインを始めたブラウザに HttpOnly の Cookie を付ける。
+// path はログインの API だけに送られるよう、プロバイダごとの API の範囲にする。
+func setBindingCookie(w http.ResponseWriter, r *http.Request, path string, binding string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginBindingCookie,
+		Value:    binding,
+		Path:     path,
+		MaxAge:   int(oauthStateTTL / time.Second),
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearBindingCookie は使い終わった Cookie を消す。
+func clearBindingCookie(w http.ResponseWriter, r *http.Request, path string) {
+	http.SetCookie(w, &http.Cookie{Name: loginBindingCookie, Path: path, MaxAge: -1, HttpOnly: true, Secure: secureRequest(r)})
+}
+
+// secureRequest は TLS 越しのリクエストかを返す。リバースプロキシの後ろでは X-Forwarded-Proto を見る。
+func secureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"golang-songs/model"
+	"golang-songs/service"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// oidcCookiePath はログインを始めたブラウザを示す Cookie を送る範囲
+const oidcCookiePath = "/api/oidc/"
+
+// loadOIDCProviders は conf/oidc.yml のプロバイダを読み込む。
+// ファイルが無ければ OIDC ログインは無効になる。
+func loadOIDCProviders(path string) map[string]*service.OIDCProvider {
+	providers := map[string]*service.OIDCProvider{}
+
+	config, err := service.LoadOIDCConfig(path)
+	if err != nil {
+		log.Println(path + "の読み込み失敗")
+		return providers
+	}
+
+	for name, c := range config.Providers {
+		providers[name] = service.NewOIDCProvider(name, c)
+	}
+
+	return providers
+}
+
+type OIDCProvidersHandler struct {
+	Providers map[string]*service.OIDCProvider
+}
+
+// 設定されているプロバイダ名の一覧を返す
+func (f *OIDCProvidersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	names := []string{}
+	for name := range f.Providers {
+		names = append(names, name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	v, err := json.Marshal(names)
+	if err != nil {
+		var error model.Error
+		error.Message = "JSONへの変換に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if _, err := w.Write(v); err != nil {
+		var error model.Error
+		error.Message = "プロバイダ一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type OIDCLoginURLHandler struct {
+	DB        *gorm.DB
+	Providers map[string]*service.OIDCProvider
+}
+
+// IdP の認可画面のURLを返す。ログインを始めたブラウザに HttpOnly の Cookie を付けるので、
+// クライアントはこの API とログインの API を Cookie 付き(credentials: include)で呼ぶ
+func (f *OIDCLoginURLHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	provider, ok := f.Providers[mux.Vars(r)["provider"]]
+	if !ok {
+		var error model.Error
+		error.Message = "該当するプロバイダが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	jti, verifier, nonce, binding, err := startOAuthLogin(f.DB, provider.Name)
+	if err != nil {
+		var error model.Error
+		error.Message = "stateの作成に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	// code_verifier と nonce は state に入れない。state は code と一緒に横取りされうる
+	state, err := createStateToken(map[string]string{"provider": provider.Name, "mode": "oidc", "jti": jti})
+	if err != nil {
+		var error model.Error
+		error.Message = "stateの作成に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	url, err := provider.AuthCodeURL(state, nonce, verifier)
+	if err != nil {
+		log.Println(err)
+		var error model.Error
+		error.Message = "認可URLの取得に失敗しました。"
+		errorInResponse(w, http.StatusBadGateway, error)
+		return
+	}
+
+	setBindingCookie(w, r, oidcCookiePath, binding)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(url); err != nil {
+		var error model.Error
+		error.Message = "JSONへの変換に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type OIDCLoginHandler struct {
+	DB        *gorm.DB
+	Providers map[string]*service.OIDCProvider
+}
+
+// IdP から戻ってきた code で ログインする
+// 連携済みでなければ、IdP が確認済みとしたメールアドレスで既存のアカウントに連携するか新しく作る
+// 既存のアカウントに連携するのは、こちらでもメールアドレスが確認済みの場合だけにする。
+// 他人のメールアドレスで先に登録しておき、本人が IdP でログインした後も乗っ取り続けるのを防ぐため
+func (f *OIDCLoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	provider, ok := f.Providers[mux.Vars(r)["provider"]]
+	if !ok {
+		var error model.Error
+		error.Message = "該当するプロバイダが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.OAuthCallbackForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	state, err := parseStateToken(d.State)
+	if err != nil || state["provider"] != provider.Name || state["mode"] != "oidc" {
+		var error model.Error
+		error.Message = "stateが無効か、有効期限が切れています。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	loginState, err := consumeOAuthLogin(f.DB, r, state["jti"], provider.Name)
+	if err == errInvalidActionToken {
+		var error model.Error
+		error.Message = "stateが無効か、有効期限が切れています。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+	if err != nil {
+		var error model.Error
+		error.Message = "stateの確認に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	clearBindingCookie(w, r, oidcCookiePath)
+
+	claims, err := provider.Exchange(context.TODO(), d.Code, loginState.CodeVerifier, loginState.Nonce)
+	if err != nil {
+		log.Println(err)
+		var error model.Error
+		error.Message = "IDトークンの検証に失敗しました。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	var user model.User
+
+	var identity model.UserIdentity
+	err = f.DB.Where("provider = ? AND subject = ?", provider.Name, claims.Subject).Find(&identity).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		var error model.Error
+		error.Message = "ユーザー情報の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err == nil {
+		if err := f.DB.Where("id = ?", identity.UserID).Find(&user).Error; err != nil {
+			var error model.Error
+			error.Message = "該当するアカウントが見つかりません。"
+			errorInResponse(w, http.StatusUnauthorized, error)
+			return
+		}
+
+		writeLoginResponse(w, r, f.DB, user)
+		return
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		var error model.Error
+		error.Message = "確認済みのEmailが取得できないため、アカウントを連携できません。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	err = f.DB.Where("email = ?", claims.Email).Find(&user).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		var error model.Error
+		error.Message = "ユーザー情報の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err == nil && user.EmailVerifiedAt == nil {
+		var error model.Error
+		error.Message = "同じEmailのアカウントがありますが、Emailが確認されていないため連携できません。Emailを確認してから再度お試しください。"
+		errorInResponse(w, http.StatusConflict, error)
+		return
+	}
+
+	if gorm.IsRecordNotFoundError(err) {
+		now := time.Now()
+		user = model.User{
+			Email:           claims.Email,
+			Name:            claims.Name,
+			ImageUrl:        claims.Picture,
+			EmailVerifiedAt: &now,
+		}
+
+		// パスワードは空のままにし、パスワードでのログインはできないようにする
+		if err := f.DB.Create(&user).Error; err != nil {
+			var error model.Error
+			error.Message = "アカウントの作成に失敗しました"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+	}
+
+	if err := f.DB.Create(&model.UserIdentity{
+		UserID:   user.ID,
+		Provider: provider.Name,
+		Subject:  claims.Subject,
+		Email:    claims.Email}).Error; err != nil {
+		var error model.Error
+		error.Message = "アカウントの連携に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeLoginResponse(w, r, f.DB, user)
+}
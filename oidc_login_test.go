@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"golang-songs/model"
+	"golang-songs/service"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// testIdP はディスカバリ、JWKS、トークンエンドポイントを持つテスト用の IdP。
+// 認可画面は無いので、authorize で認可URLの code_challenge と nonce に対する code を発行する。
+type testIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	next  int
+	codes map[string][2]string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &testIdP{key: key, codes: map[string][2]string{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": "key-1",
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		idp.mu.Lock()
+		code, ok := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		idp.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !ok || service.PKCEChallenge(r.PostForm.Get("code_verifier")) != code[0] {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+			"iss":            idp.server.URL,
+			"aud":            "songs-client",
+			"sub":            "subject-1",
+			"email":          "user@example.com",
+			"email_verified": true,
+			"name":           "OIDC User",
+			"nonce":          code[1],
+			"iat":            time.Now().Unix(),
+			"exp":            time.Now().Add(time.Hour).Unix(),
+		})
+		token.Header["kid"] = "key-1"
+		idToken, err := token.SignedString(key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access-token",
+			"token_type":   "Bearer",
+			"id_token":     idToken,
+		})
+	})
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+// authorize はユーザーが認可画面で同意したものとして code を発行する。
+func (idp *testIdP) authorize(authCodeURL *url.URL) string {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	idp.next++
+	code := fmt.Sprintf("code-%d", idp.next)
+	idp.codes[code] = [2]string{authCodeURL.Query().Get("code_challenge"), authCodeURL.Query().Get("nonce")}
+
+	return code
+}
+
+func newOIDCTestRouter(db *gorm.DB, idp *testIdP) *mux.Router {
+	providers := map[string]*service.OIDCProvider{
+		"mock": service.NewOIDCProvider("mock", service.OIDCProviderConfig{
+			Issuer:      idp.server.URL,
+			ClientID:    "songs-client",
+			RedirectURL: "https://songs.example.com/oidc/mock/callback",
+		}),
+	}
+
+	router := mux.NewRouter()
+	router.Handle("/api/oidc/{provider}/login-url", &OIDCLoginURLHandler{DB: db, Providers: providers}).Methods("GET")
+	router.Handle("/api/oidc/{provider}/login", &OIDCLoginHandler{DB: db, Providers: providers}).Methods("POST")
+
+	return router
+}
+
+// startOIDCTestLogin は認可URLを取得して同意するところまで進め、コールバックに渡す code と state、ブラウザの Cookie を返す。
+func startOIDCTestLogin(t *testing.T, router *mux.Router, idp *testIdP) (string, string, *http.Cookie) {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/oidc/mock/login-url", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("login-url status = %d, want 200: %s", w.Code, w.Body)
+	}
+
+	var raw string
+	if err := json.NewDecoder(w.Body).Decode(&raw); err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != loginBindingCookie || !cookies[0].HttpOnly || cookies[0].Path != oidcCookiePath {
+		t.Fatalf("cookies = %+v, want an HttpOnly binding cookie for %s", cookies, oidcCookiePath)
+	}
+
+	return idp.authorize(u), u.Query().Get("state"), cookies[0]
+}
+
+func oidcCallback(router *mux.Router, code string, state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/api/oidc/mock/login", strings.NewReader(`{"code":"`+code+`","state":"`+state+`"}`))
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestOIDCLoginRejectsInvalidState(t *testing.T) {
+	providers := map[string]*service.OIDCProvider{
+		"mock": service.NewOIDCProvider("mock", service.OIDCProviderConfig{
+			Issuer:      "https://idp.example.com",
+			ClientID:    "songs-client",
+			RedirectURL: "https://songs.example.com/oidc/mock/callback",
+		}),
+	}
+
+	router := mux.NewRouter()
+	router.Handle("/api/oidc/{provider}/login", &OIDCLoginHandler{Providers: providers}).Methods("POST")
+
+	state := func(values map[string]string) string {
+		s, err := createStateToken(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	tests := []struct {
+		name     string
+		provider string
+		state    string
+		want     int
+	}{
+		{"unknown provider", "other", state(map[string]string{"provider": "other", "mode": "oidc"}), http.StatusNotFound},
+		{"broken state", "mock", "not-a-state", http.StatusUnauthorized},
+		{"state for another provider", "mock", state(map[string]string{"provider": "google", "mode": "oidc"}), http.StatusUnauthorized},
+		{"state for another login mode", "mock", state(map[string]string{"provider": "mock", "mode": "login"}), http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		body := strings.NewReader(`{"code":"code","state":"` + tt.state + `"}`)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("POST", "/api/oidc/"+tt.provider+"/login", body))
+
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestConsumeOAuthLogin(t *testing.T) {
+	db := newTestDB(t, &model.OAuthLoginState{})
+
+	request := func(binding string) *http.Request {
+		r := httptest.NewRequest("POST", "/api/oidc/mock/login", nil)
+		if binding != "" {
+			r.AddCookie(&http.Cookie{Name: loginBindingCookie, Value: binding})
+		}
+		return r
+	}
+
+	tests := []struct {
+		name     string
+		provider string
+		binding  func(binding string) string
+		expire   bool
+		wantErr  bool
+	}{
+		{"valid", "mock", func(b string) string { return b }, false, false},
+		{"without cookie", "mock", func(b string) string { return "" }, false, true},
+		{"cookie of another browser", "mock", func(b string) string { return b + "x" }, false, true},
+		{"another provider", "spotify", func(b string) string { return b }, false, true},
+		{"expired", "mock", func(b string) string { return b }, true, true},
+	}
+
+	for _, tt := range tests {
+		jti, verifier, nonce, binding, err := startOAuthLogin(db, "mock")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.expire {
+			if err := db.Model(&model.OAuthLoginState{}).Where("jti = ?", jti).UpdateColumn("expires_at", time.Now().Add(-time.Minute)).Error; err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		loginState, err := consumeOAuthLogin(db, request(tt.binding(binding)), jti, tt.provider)
+		if tt.wantErr {
+			if err != errInvalidActionToken {
+				t.Errorf("%s: err = %v, want errInvalidActionToken", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if loginState.CodeVerifier != verifier || loginState.Nonce != nonce {
+			t.Errorf("%s: loginState = %+v, want the stored verifier and nonce", tt.name, loginState)
+		}
+
+		// 同じ state は二度使えない
+		if _, err := consumeOAuthLogin(db, request(binding), jti, tt.provider); err != errInvalidActionToken {
+			t.Errorf("%s: second use err = %v, want errInvalidActionToken", tt.name, err)
+		}
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	db := newTestDB(t, &model.User{}, &model.Session{}, &model.OAuthLoginState{}, &model.UserIdentity{})
+	idp := newTestIdP(t)
+	router := newOIDCTestRouter(db, idp)
+
+	code, state, cookie := startOIDCTestLogin(t, router, idp)
+	w := oidcCallback(router, code, state, cookie)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+
+	var identity model.UserIdentity
+	if err := db.Where("provider = ? AND subject = ?", "mock", "subject-1").Find(&identity).Error; err != nil {
+		t.Fatalf("identity was not created: %v", err)
+	}
+	var user model.User
+	if err := db.Where("id = ?", identity.UserID).Find(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "user@example.com" || user.EmailVerifiedAt == nil {
+		t.Errorf("user = %+v, want a verified user@example.com", user)
+	}
+
+	// 同じ state と Cookie をもう一度使っても通らない
+	if w := oidcCallback(router, code, state, cookie); w.Code != http.StatusUnauthorized {
+		t.Errorf("second use: status = %d, want 401", w.Code)
+	}
+}
+
+func TestOIDCLoginRequiresBindingCookie(t *testing.T) {
+	db := newTestDB(t, &model.User{}, &model.Session{}, &model.OAuthLoginState{}, &model.UserIdentity{})
+	idp := newTestIdP(t)
+	router := newOIDCTestRouter(db, idp)
+
+	tests := []struct {
+		name   string
+		cookie func(c *http.Cookie) *http.Cookie
+	}{
+		{"without cookie", func(c *http.Cookie) *http.Cookie { return nil }},
+		{"cookie of another browser", func(c *http.Cookie) *http.Cookie {
+			return &http.Cookie{Name: loginBindingCookie, Value: "another-browser"}
+		}},
+	}
+
+	for _, tt := range tests {
+		code, state, cookie := startOIDCTestLogin(t, router, idp)
+		if w := oidcCallback(router, code, state, tt.cookie(cookie)); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status = %d, want 401", tt.name, w.Code)
+		}
+	}
+
+	// 別のブラウザの Cookie で始めたログインの state と code は、そのブラウザ以外では使えない
+	var count int
+	if err := db.Model(&model.UserIdentity{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("identities = %d, want 0", count)
+	}
+}
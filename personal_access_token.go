@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"golang-songs/model"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// JWT と見分けられるよう、パーソナルアクセストークンには接頭辞を付ける
+const personalAccessTokenPrefix = "gs_pat_"
+
+func isPersonalAccessToken(r *http.Request) bool {
+	bearerToken := strings.Split(r.Header.Get("Authorization"), " ")
+	return len(bearerToken) == 2 && strings.HasPrefix(bearerToken[1], personalAccessTokenPrefix)
+}
+
+// トークンは十分長いランダム値なので、bcrypt ではなく SHA-256 で引けるようにする
+func hashPersonalAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type CreatePersonalAccessTokenHandler struct {
+	DB *gorm.DB
+}
+
+// トークンを発行する。平文を返すのはこの時だけ
+func (f *CreatePersonalAccessTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.PersonalAccessTokenForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if d.Name == "" {
+		var error model.Error
+		error.Message = "トークン名は必須です。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	if len(d.Scopes) == 0 {
+		var error model.Error
+		error.Message = "権限を1つ以上指定してください。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	for _, scope := range d.Scopes {
+		if !hasScope(tokenScopes, scope) {
+			var error model.Error
+			error.Message = "指定できない権限です: " + scope
+			errorInResponse(w, http.StatusBadRequest, error)
+			return
+		}
+	}
+
+	secret, err := randomHex(32)
+	if err != nil {
+		var error model.Error
+		error.Message = "トークンの作成に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	plain := personalAccessTokenPrefix + secret
+
+	token := model.PersonalAccessToken{
+		UserID:      user.ID,
+		Name:        d.Name,
+		TokenHash:   hashPersonalAccessToken(plain),
+		TokenPrefix: plain[:len(personalAccessTokenPrefix)+6],
+		Scopes:      strings.Join(d.Scopes, " ")}
+
+	if err := f.DB.Create(&token).Error; err != nil {
+		var error model.Error
+		error.Message = "トークンの作成に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	token.Token = plain
+
+	w.Header().Set("Content-Type", "application/json")
+
+	v, err := json.Marshal(token)
+	if err != nil {
+		var error model.Error
+		error.Message = "JSONへの変換に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if _, err := w.Write(v); err != nil {
+		var error model.Error
+		error.Message = "トークンの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type PersonalAccessTokensHandler struct {
+	DB *gorm.DB
+}
+
+// リクエストユーザーのトークン一覧を返す
+func (f *PersonalAccessTokensHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	tokens := []model.PersonalAccessToken{}
+
+	if err := f.DB.Where("user_id = ?", user.ID).Order("created_at desc").Find(&tokens).Error; err != nil {
+		var error model.Error
+		error.Message = "トークン一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	v, err := json.Marshal(tokens)
+	if err != nil {
+		var error model.Error
+		error.Message = "JSONへの変換に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if _, err := w.Write(v); err != nil {
+		var error model.Error
+		error.Message = "トークン一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type RevokePersonalAccessTokenHandler struct {
+	DB *gorm.DB
+}
+
+func (f *RevokePersonalAccessTokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		var error model.Error
+		error.Message = "idの取得に失敗しました"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	result := f.DB.Where("id = ? AND user_id = ?", id, user.ID).Delete(&model.PersonalAccessToken{})
+	if result.Error != nil {
+		var error model.Error
+		error.Message = "トークンの削除に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		var error model.Error
+		error.Message = "該当するトークンが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+}
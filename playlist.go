@@ -0,0 +1,731 @@
+package main
+
+import (
+	"encoding/json"
+	"golang-songs/model"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+var (
+	errPlaylistNotFound     = errors.New("playlist not found")
+	errPlaylistForbidden    = errors.New("playlist is not editable")
+	errPlaylistItemNotFound = errors.New("playlist item not found")
+	errInvalidPlaylistOrder = errors.New("invalid playlist order")
+	errPlaylistConflict     = errors.New("playlist version conflict")
+)
+
+// プレイリストの編集権限。共同編集者は招待を承諾するまで権限を持たない
+type playlistAccess int
+
+const (
+	playlistAccessNone playlistAccess = iota
+	playlistAccessAdd
+	playlistAccessEdit
+	playlistAccessOwner
+)
+
+// 共同編集者の役割
+const (
+	playlistRoleAdd  = "add"
+	playlistRoleEdit = "edit"
+)
+
+var playlistRoles = []string{playlistRoleAdd, playlistRoleEdit}
+
+// アクティビティの種類
+const (
+	playlistActivityAdd     = "add"
+	playlistActivityRemove  = "remove"
+	playlistActivityMove    = "move"
+	playlistActivityReorder = "reorder"
+	playlistActivityUpdate  = "update"
+)
+
+// playlistErrorInResponse はプレイリスト操作のエラーをステータスに振り分けて返す。
+func playlistErrorInResponse(w http.ResponseWriter, err error, message string) {
+	var error model.Error
+
+	switch err {
+	case errPlaylistNotFound:
+		error.Message = "該当するプレイリストが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+	case errPlaylistItemNotFound:
+		error.Message = "該当する曲がプレイリストにありません。"
+		errorInResponse(w, http.StatusNotFound, error)
+	case errPlaylistForbidden:
+		error.Message = "このプレイリストを編集する権限がありません。"
+		errorInResponse(w, http.StatusForbidden, error)
+	case errInvalidPlaylistOrder:
+		error.Message = "並び順の指定が正しくありません。"
+		errorInResponse(w, http.StatusBadRequest, error)
+	case errPlaylistConflict:
+		error.Message = "プレイリストが他のユーザーに更新されています。最新の内容を取得してからやり直してください。"
+		errorInResponse(w, http.StatusConflict, error)
+	default:
+		error.Message = message
+		errorInResponse(w, http.StatusInternalServerError, error)
+	}
+}
+
+// playlistAccessOf は userID のユーザーがプレイリストに持つ権限を返す。
+func playlistAccessOf(db *gorm.DB, playlist model.Playlist, userID uint) (playlistAccess, error) {
+	if playlist.UserID == userID {
+		return playlistAccessOwner, nil
+	}
+
+	var collaborator model.PlaylistCollaborator
+	err := db.Where("playlist_id = ? AND user_id = ? AND accepted_at IS NOT NULL", playlist.ID, userID).Find(&collaborator).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return playlistAccessNone, nil
+	}
+	if err != nil {
+		return playlistAccessNone, err
+	}
+
+	if collaborator.Role == playlistRoleEdit {
+		return playlistAccessEdit, nil
+	}
+
+	return playlistAccessAdd, nil
+}
+
+// canSeePlaylist は viewerID のユーザーがプレイリストを見られるかを返す。
+// 共同編集者は公開範囲に関係なく見られる。
+func canSeePlaylist(db *gorm.DB, viewerID uint, playlist model.Playlist) (bool, error) {
+	if access, err := playlistAccessOf(db, playlist, viewerID); err != nil || access != playlistAccessNone {
+		return err == nil, err
+	}
+
+	if playlist.Visibility == visibilityPrivate {
+		return false, nil
+	}
+
+	if blocked, err := isBlocked(db, viewerID, playlist.UserID); err != nil || blocked {
+		return false, err
+	}
+
+	var owner model.User
+	if err := db.Where("id = ?", playlist.UserID).Find(&owner).Error; err != nil {
+		return false, err
+	}
+
+	if playlist.Visibility == visibilityFollowers || owner.IsPrivate {
+		return isFollowing(db, viewerID, owner.ID)
+	}
+
+	return true, nil
+}
+
+// lockPlaylist はトランザクション内でプレイリストの行をロックし、同時に並び替えられないようにする。
+func lockPlaylist(tx *gorm.DB, id interface{}) (model.Playlist, error) {
+	var playlist model.Playlist
+
+	err := tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ?", id).Find(&playlist).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return playlist, errPlaylistNotFound
+	}
+
+	return playlist, err
+}
+
+// lockEditablePlaylist はリクエストユーザーが need 以上の権限を持つプレイリストをロックして返す。
+func lockEditablePlaylist(tx *gorm.DB, id interface{}, user model.User, need playlistAccess) (model.Playlist, error) {
+	playlist, err := lockPlaylist(tx, id)
+	if err != nil {
+		return playlist, err
+	}
+
+	access, err := playlistAccessOf(tx, playlist, user.ID)
+	if err != nil {
+		return playlist, err
+	}
+	if access < need {
+		return playlist, errPlaylistForbidden
+	}
+
+	return playlist, nil
+}
+
+// checkPlaylistVersion はクライアントが見ていた版と現在の版を比べる。
+// 並び替えのように前提の並びが変わると意味が変わる操作では required にする。
+func checkPlaylistVersion(playlist model.Playlist, version *uint, required bool) error {
+	if version == nil {
+		if required {
+			return errPlaylistConflict
+		}
+		return nil
+	}
+
+	if *version != playlist.Version {
+		return errPlaylistConflict
+	}
+
+	return nil
+}
+
+// recordPlaylistActivity は版を上げ、操作をアクティビティに記録する。
+func recordPlaylistActivity(tx *gorm.DB, playlist *model.Playlist, user model.User, action string, songID *uint) error {
+	playlist.Version++
+	if err := tx.Model(playlist).Update("version", playlist.Version).Error; err != nil {
+		return err
+	}
+
+	activity := model.PlaylistActivity{
+		PlaylistID: playlist.ID,
+		UserID:     user.ID,
+		Action:     action,
+		SongID:     songID,
+		Version:    playlist.Version}
+
+	return tx.Create(&activity).Error
+}
+
+func playlistItems(tx *gorm.DB, playlistID uint) ([]model.PlaylistItem, error) {
+	var items []model.PlaylistItem
+	err := tx.Where("playlist_id = ?", playlistID).Order("position asc, id asc").Find(&items).Error
+
+	return items, err
+}
+
+// writePlaylistOrder は items の並びどおりに 1 からの連番を振り直す。変わった行だけ更新する。
+func writePlaylistOrder(tx *gorm.DB, items []model.PlaylistItem) error {
+	for i, item := range items {
+		if item.Position == i+1 {
+			continue
+		}
+		if err := tx.Model(&item).UpdateColumn("position", i+1).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compactPlaylistPositions は削除で空いた番号を詰める。
+func compactPlaylistPositions(tx *gorm.DB, playlistID uint) error {
+	items, err := playlistItems(tx, playlistID)
+	if err != nil {
+		return err
+	}
+
+	return writePlaylistOrder(tx, items)
+}
+
+func decodePlaylistForm(w http.ResponseWriter, r *http.Request) (model.PlaylistForm, bool) {
+	dec := json.NewDecoder(r.Body)
+	var d model.PlaylistForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return d, false
+	}
+
+	if d.Title == "" {
+		var error model.Error
+		error.Message = "タイトルは必須です。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return d, false
+	}
+
+	if d.Visibility == "" {
+		d.Visibility = visibilityPublic
+	}
+	if !hasScope(profileVisibilities, d.Visibility) {
+		var error model.Error
+		error.Message = "公開範囲が正しくありません: " + d.Visibility
+		errorInResponse(w, http.StatusBadRequest, error)
+		return d, false
+	}
+
+	return d, true
+}
+
+type CreatePlaylistHandler struct {
+	DB *gorm.DB
+}
+
+func (f *CreatePlaylistHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	d, ok := decodePlaylistForm(w, r)
+	if !ok {
+		return
+	}
+
+	playlist := model.Playlist{
+		UserID:      user.ID,
+		Title:       d.Title,
+		Description: d.Description,
+		Visibility:  d.Visibility,
+		CoverImage:  d.CoverImage}
+
+	if err := f.DB.Create(&playlist).Error; err != nil {
+		var error model.Error
+		error.Message = "プレイリストの作成に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, playlist)
+}
+
+type GetPlaylistHandler struct {
+	DB *gorm.DB
+}
+
+// プレイリストと曲を並び順で返す。非表示にされた曲と、リクエストユーザーが見られない曲
+// (ブロック関係・フォローしていない非公開アカウントの曲)は song を空にする
+func (f *GetPlaylistHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	blockedIDs, err := blockedUserIDs(f.DB, user.ID)
+	if err != nil {
+		var error model.Error
+		error.Message = "プレイリストの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	visibleSongs := func(db *gorm.DB) *gorm.DB {
+		return excludePrivateUsers(excludeUsers(db, "user_id", blockedIDs), "user_id", user.ID).
+			Where("hidden_at IS NULL")
+	}
+
+	var playlist model.Playlist
+	err = f.DB.
+		Preload("Items", func(db *gorm.DB) *gorm.DB { return db.Order("position asc") }).
+		Preload("Items.Song", visibleSongs).
+		Where("id = ?", mux.Vars(r)["id"]).Find(&playlist).Error
+	if err != nil {
+		playlistErrorInResponse(w, errPlaylistNotFound, "")
+		return
+	}
+
+	if visible, err := canSeePlaylist(f.DB, user.ID, playlist); err != nil || !visible {
+		playlistErrorInResponse(w, errPlaylistNotFound, "")
+		return
+	}
+
+	writeJSON(w, playlist)
+}
+
+type UserPlaylistsHandler struct {
+	DB *gorm.DB
+}
+
+// 指定されたユーザーのプレイリストのうち、リクエストユーザーが見られるものを返す
+func (f *UserPlaylistsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	var playlists []model.Playlist
+	if err := f.DB.Where("user_id = ?", mux.Vars(r)["id"]).Order("updated_at desc").Find(&playlists).Error; err != nil {
+		var error model.Error
+		error.Message = "プレイリスト一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	visible := []model.Playlist{}
+	for _, playlist := range playlists {
+		ok, err := canSeePlaylist(f.DB, user.ID, playlist)
+		if err != nil {
+			var error model.Error
+			error.Message = "プレイリスト一覧の取得に失敗しました。"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+		if ok {
+			visible = append(visible, playlist)
+		}
+	}
+
+	writeJSON(w, visible)
+}
+
+type UpdatePlaylistHandler struct {
+	DB *gorm.DB
+}
+
+func (f *UpdatePlaylistHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	d, ok := decodePlaylistForm(w, r)
+	if !ok {
+		return
+	}
+
+	var playlist model.Playlist
+	err := f.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		playlist, err = lockEditablePlaylist(tx, mux.Vars(r)["id"], user, playlistAccessOwner)
+		if err != nil {
+			return err
+		}
+		if err := checkPlaylistVersion(playlist, d.Version, false); err != nil {
+			return err
+		}
+
+		err = tx.Model(&playlist).Updates(map[string]interface{}{
+			"title":       d.Title,
+			"description": d.Description,
+			"visibility":  d.Visibility,
+			"cover_image": d.CoverImage,
+		}).Error
+		if err != nil {
+			return err
+		}
+
+		return recordPlaylistActivity(tx, &playlist, user, playlistActivityUpdate, nil)
+	})
+	if err != nil {
+		playlistErrorInResponse(w, err, "プレイリストの更新に失敗しました。")
+		return
+	}
+
+	writeJSON(w, playlist)
+}
+
+type DeletePlaylistHandler struct {
+	DB *gorm.DB
+}
+
+func (f *DeletePlaylistHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	err := f.DB.Transaction(func(tx *gorm.DB) error {
+		playlist, err := lockEditablePlaylist(tx, mux.Vars(r)["id"], user, playlistAccessOwner)
+		if err != nil {
+			return err
+		}
+
+		return tx.Delete(&playlist).Error
+	})
+	if err != nil {
+		playlistErrorInResponse(w, err, "プレイリストの削除に失敗しました。")
+		return
+	}
+}
+
+type AddPlaylistItemHandler struct {
+	DB *gorm.DB
+}
+
+// 曲を追加する。position を省略すると末尾に追加する。追加のみの共同編集者も使える
+func (f *AddPlaylistItemHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.PlaylistItemForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	song, err := visibleSong(f.DB, r, user, d.SongID)
+	if err != nil && err != errSongNotFound {
+		var error model.Error
+		error.Message = "曲の追加に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+	if err == errSongNotFound || song.HiddenAt != nil {
+		var error model.Error
+		error.Message = "該当する曲が見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	var item model.PlaylistItem
+	err = f.DB.Transaction(func(tx *gorm.DB) error {
+		playlist, err := lockEditablePlaylist(tx, mux.Vars(r)["id"], user, playlistAccessAdd)
+		if err != nil {
+			return err
+		}
+		if err := checkPlaylistVersion(playlist, d.Version, false); err != nil {
+			return err
+		}
+
+		items, err := playlistItems(tx, playlist.ID)
+		if err != nil {
+			return err
+		}
+
+		index := len(items)
+		if d.Position >= 1 && d.Position <= len(items) {
+			index = d.Position - 1
+		}
+
+		item = model.PlaylistItem{
+			PlaylistID: playlist.ID,
+			SongID:     song.ID,
+			Position:   index + 1,
+			Note:       d.Note,
+			AddedByID:  user.ID}
+		if err := tx.Create(&item).Error; err != nil {
+			return err
+		}
+
+		items = append(items[:index], append([]model.PlaylistItem{item}, items[index:]...)...)
+
+		if err := writePlaylistOrder(tx, items); err != nil {
+			return err
+		}
+
+		return recordPlaylistActivity(tx, &playlist, user, playlistActivityAdd, &song.ID)
+	})
+	if err != nil {
+		playlistErrorInResponse(w, err, "曲の追加に失敗しました。")
+		return
+	}
+
+	writeJSON(w, item)
+}
+
+type RemovePlaylistItemHandler struct {
+	DB *gorm.DB
+}
+
+// 曲を外す。クエリの version を指定すると、その版から変わっていた場合は 409 を返す
+func (f *RemovePlaylistItemHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	var version *uint
+	if v := r.URL.Query().Get("version"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			var error model.Error
+			error.Message = "versionの指定が正しくありません。"
+			errorInResponse(w, http.StatusBadRequest, error)
+			return
+		}
+		u := uint(n)
+		version = &u
+	}
+
+	err := f.DB.Transaction(func(tx *gorm.DB) error {
+		playlist, err := lockEditablePlaylist(tx, vars["id"], user, playlistAccessEdit)
+		if err != nil {
+			return err
+		}
+		if err := checkPlaylistVersion(playlist, version, false); err != nil {
+			return err
+		}
+
+		var item model.PlaylistItem
+		if err := tx.Where("id = ? AND playlist_id = ?", vars["itemId"], playlist.ID).Find(&item).Error; err != nil {
+			if gorm.IsRecordNotFoundError(err) {
+				return errPlaylistItemNotFound
+			}
+			return err
+		}
+
+		// 番号を詰めるため、論理削除ではなく物理削除する
+		if err := tx.Unscoped().Delete(&item).Error; err != nil {
+			return err
+		}
+
+		if err := compactPlaylistPositions(tx, playlist.ID); err != nil {
+			return err
+		}
+
+		return recordPlaylistActivity(tx, &playlist, user, playlistActivityRemove, &item.SongID)
+	})
+	if err != nil {
+		playlistErrorInResponse(w, err, "曲の削除に失敗しました。")
+		return
+	}
+}
+
+type MovePlaylistItemHandler struct {
+	DB *gorm.DB
+}
+
+// 1曲を指定した位置に移動する。version は必須
+func (f *MovePlaylistItemHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.MovePlaylistItemForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	vars := mux.Vars(r)
+	itemID, err := strconv.Atoi(vars["itemId"])
+	if err != nil {
+		playlistErrorInResponse(w, errPlaylistItemNotFound, "")
+		return
+	}
+
+	err = f.DB.Transaction(func(tx *gorm.DB) error {
+		playlist, err := lockEditablePlaylist(tx, vars["id"], user, playlistAccessEdit)
+		if err != nil {
+			return err
+		}
+		if err := checkPlaylistVersion(playlist, d.Version, true); err != nil {
+			return err
+		}
+
+		items, err := playlistItems(tx, playlist.ID)
+		if err != nil {
+			return err
+		}
+
+		from := -1
+		for i, item := range items {
+			if item.ID == uint(itemID) {
+				from = i
+			}
+		}
+		if from < 0 {
+			return errPlaylistItemNotFound
+		}
+		if d.Position < 1 || d.Position > len(items) {
+			return errInvalidPlaylistOrder
+		}
+
+		item := items[from]
+		items = append(items[:from], items[from+1:]...)
+		to := d.Position - 1
+		items = append(items[:to], append([]model.PlaylistItem{item}, items[to:]...)...)
+
+		if err := writePlaylistOrder(tx, items); err != nil {
+			return err
+		}
+
+		return recordPlaylistActivity(tx, &playlist, user, playlistActivityMove, &item.SongID)
+	})
+	if err != nil {
+		playlistErrorInResponse(w, err, "曲の移動に失敗しました。")
+		return
+	}
+}
+
+type ReorderPlaylistHandler struct {
+	DB *gorm.DB
+}
+
+// 全曲の並び順を itemIds の順に置き換える。今入っている曲をすべて1回ずつ指定する必要がある。version は必須
+func (f *ReorderPlaylistHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.ReorderPlaylistForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	err := f.DB.Transaction(func(tx *gorm.DB) error {
+		playlist, err := lockEditablePlaylist(tx, mux.Vars(r)["id"], user, playlistAccessEdit)
+		if err != nil {
+			return err
+		}
+		if err := checkPlaylistVersion(playlist, d.Version, true); err != nil {
+			return err
+		}
+
+		items, err := playlistItems(tx, playlist.ID)
+		if err != nil {
+			return err
+		}
+
+		if len(d.ItemIDs) != len(items) {
+			return errInvalidPlaylistOrder
+		}
+
+		byID := map[uint]model.PlaylistItem{}
+		for _, item := range items {
+			byID[item.ID] = item
+		}
+
+		ordered := []model.PlaylistItem{}
+		for _, id := range d.ItemIDs {
+			item, ok := byID[id]
+			if !ok {
+				return errInvalidPlaylistOrder
+			}
+			delete(byID, id)
+			ordered = append(ordered, item)
+		}
+
+		if err := writePlaylistOrder(tx, ordered); err != nil {
+			return err
+		}
+
+		return recordPlaylistActivity(tx, &playlist, user, playlistActivityReorder, nil)
+	})
+	if err != nil {
+		playlistErrorInResponse(w, err, "並び替えに失敗しました。")
+		return
+	}
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"golang-songs/model"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+const playlistActivitiesPerPage = 50
+
+var (
+	errPlaylistCollaboratorNotFound = errors.New("playlist collaborator not found")
+	errPlaylistCollaboratorExists   = errors.New("playlist collaborator already exists")
+)
+
+// collaboratorErrorInResponse は共同編集者の操作のエラーを返す。プレイリスト共通のエラーはそちらに任せる。
+func collaboratorErrorInResponse(w http.ResponseWriter, err error, message string) {
+	var error model.Error
+
+	switch err {
+	case errPlaylistCollaboratorNotFound:
+		error.Message = "該当する共同編集者が見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+	case errPlaylistCollaboratorExists:
+		error.Message = "このユーザーは既に招待されています。"
+		errorInResponse(w, http.StatusConflict, error)
+	default:
+		playlistErrorInResponse(w, err, message)
+	}
+}
+
+// visiblePlaylist は id のプレイリストのうち、リクエストユーザーが見られるものを返す。
+func visiblePlaylist(db *gorm.DB, id interface{}, user model.User) (model.Playlist, error) {
+	var playlist model.Playlist
+	if err := db.Where("id = ?", id).Find(&playlist).Error; err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return playlist, errPlaylistNotFound
+		}
+		return playlist, err
+	}
+
+	visible, err := canSeePlaylist(db, user.ID, playlist)
+	if err != nil {
+		return playlist, err
+	}
+	if !visible {
+		return playlist, errPlaylistNotFound
+	}
+
+	return playlist, nil
+}
+
+// findCollaborator はプレイリストの userId の共同編集者を返す。
+func findCollaborator(tx *gorm.DB, playlistID uint, userID interface{}) (model.PlaylistCollaborator, error) {
+	var collaborator model.PlaylistCollaborator
+
+	err := tx.Where("playlist_id = ? AND user_id = ?", playlistID, userID).Find(&collaborator).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return collaborator, errPlaylistCollaboratorNotFound
+	}
+
+	return collaborator, err
+}
+
+func decodeCollaboratorRole(w http.ResponseWriter, r *http.Request) (model.PlaylistCollaboratorForm, bool) {
+	dec := json.NewDecoder(r.Body)
+	var d model.PlaylistCollaboratorForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return d, false
+	}
+
+	if !hasScope(playlistRoles, d.Role) {
+		var error model.Error
+		error.Message = "共同編集者の役割が正しくありません: " + d.Role
+		errorInResponse(w, http.StatusBadRequest, error)
+		return d, false
+	}
+
+	return d, true
+}
+
+type PlaylistCollaboratorsHandler struct {
+	DB *gorm.DB
+}
+
+// 共同編集者の一覧を返す。承諾前の招待はオーナーにだけ見せる
+func (f *PlaylistCollaboratorsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	playlist, err := visiblePlaylist(f.DB, mux.Vars(r)["id"], user)
+	if err != nil {
+		playlistErrorInResponse(w, err, "共同編集者の取得に失敗しました。")
+		return
+	}
+
+	query := f.DB.Where("playlist_id = ?", playlist.ID).Order("created_at asc")
+	if playlist.UserID != user.ID {
+		query = query.Where("accepted_at IS NOT NULL")
+	}
+
+	collaborators := []model.PlaylistCollaborator{}
+	if err := query.Find(&collaborators).Error; err != nil {
+		var error model.Error
+		error.Message = "共同編集者の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	ids := []uint{}
+	for _, collaborator := range collaborators {
+		ids = append(ids, collaborator.UserID)
+	}
+
+	var users []model.User
+	if err := f.DB.Where("id IN (?)", ids).Find(&users).Error; err != nil {
+		var error model.Error
+		error.Message = "共同編集者の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	profiles, err := profilesFor(f.DB, user.ID, users)
+	if err != nil {
+		var error model.Error
+		error.Message = "共同編集者の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	byID := map[uint]model.Profile{}
+	for _, profile := range profiles {
+		byID[profile.ID] = profile
+	}
+	for i := range collaborators {
+		if profile, ok := byID[collaborators[i].UserID]; ok {
+			collaborators[i].User = &profile
+		}
+	}
+
+	writeJSON(w, collaborators)
+}
+
+type InvitePlaylistCollaboratorHandler struct {
+	DB *gorm.DB
+}
+
+// ユーザーを共同編集者として招待する。招待されたユーザーが承諾するまで編集できない
+func (f *InvitePlaylistCollaboratorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	d, ok := decodeCollaboratorRole(w, r)
+	if !ok {
+		return
+	}
+
+	var invitee model.User
+	if err := f.DB.Where("id = ?", d.UserID).Find(&invitee).Error; err != nil {
+		var error model.Error
+		error.Message = "該当するユーザーが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	if invitee.ID == user.ID {
+		var error model.Error
+		error.Message = "自分自身は指定できません。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	if blocked, err := isBlocked(f.DB, user.ID, invitee.ID); err != nil || blocked {
+		var error model.Error
+		error.Message = "このユーザーは招待できません。"
+		errorInResponse(w, http.StatusForbidden, error)
+		return
+	}
+
+	var collaborator model.PlaylistCollaborator
+	err := f.DB.Transaction(func(tx *gorm.DB) error {
+		playlist, err := lockEditablePlaylist(tx, mux.Vars(r)["id"], user, playlistAccessOwner)
+		if err != nil {
+			return err
+		}
+
+		if _, err := findCollaborator(tx, playlist.ID, invitee.ID); err != errPlaylistCollaboratorNotFound {
+			if err == nil {
+				return errPlaylistCollaboratorExists
+			}
+			return err
+		}
+
+		collaborator = model.PlaylistCollaborator{
+			PlaylistID: playlist.ID,
+			UserID:     invitee.ID,
+			Role:       d.Role}
+
+		return tx.Create(&collaborator).Error
+	})
+	if err != nil {
+		collaboratorErrorInResponse(w, err, "共同編集者の招待に失敗しました。")
+		return
+	}
+
+	writeJSON(w, collaborator)
+}
+
+type UpdatePlaylistCollaboratorHandler struct {
+	DB *gorm.DB
+}
+
+// 共同編集者の役割を変更する
+func (f *UpdatePlaylistCollaboratorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	d, ok := decodeCollaboratorRole(w, r)
+	if !ok {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	var collaborator model.PlaylistCollaborator
+	err := f.DB.Transaction(func(tx *gorm.DB) error {
+		playlist, err := lockEditablePlaylist(tx, vars["id"], user, playlistAccessOwner)
+		if err != nil {
+			return err
+		}
+
+		collaborator, err = findCollaborator(tx, playlist.ID, vars["userId"])
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(&collaborator).Update("role", d.Role).Error
+	})
+	if err != nil {
+		collaboratorErrorInResponse(w, err, "共同編集者の更新に失敗しました。")
+		return
+	}
+
+	writeJSON(w, collaborator)
+}
+
+type RemovePlaylistCollaboratorHandler struct {
+	DB *gorm.DB
+}
+
+// 共同編集者を外す。オーナーのほか、共同編集者本人も抜けられる
+func (f *RemovePlaylistCollaboratorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	err := f.DB.Transaction(func(tx *gorm.DB) error {
+		playlist, err := lockPlaylist(tx, vars["id"])
+		if err != nil {
+			return err
+		}
+
+		collaborator, err := findCollaborator(tx, playlist.ID, vars["userId"])
+		if err != nil {
+			return err
+		}
+
+		if playlist.UserID != user.ID && collaborator.UserID != user.ID {
+			return errPlaylistForbidden
+		}
+
+		// (playlist_id, user_id) に一意制約があるため物理削除する
+		return tx.Unscoped().Delete(&collaborator).Error
+	})
+	if err != nil {
+		collaboratorErrorInResponse(w, err, "共同編集者の削除に失敗しました。")
+		return
+	}
+}
+
+type PlaylistInvitationsHandler struct {
+	DB *gorm.DB
+}
+
+// 自分宛ての承諾前の招待を返す
+func (f *PlaylistInvitationsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	invitations := []model.PlaylistCollaborator{}
+	if err := f.DB.Where("user_id = ? AND accepted_at IS NULL", user.ID).Order("created_at desc").Find(&invitations).Error; err != nil {
+		var error model.Error
+		error.Message = "招待の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, invitations)
+}
+
+type RespondPlaylistInvitationHandler struct {
+	DB     *gorm.DB
+	Accept bool
+}
+
+// 自分宛ての招待を承諾または辞退する
+func (f *RespondPlaylistInvitationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	var collaborator model.PlaylistCollaborator
+	err := f.DB.Transaction(func(tx *gorm.DB) error {
+		playlist, err := lockPlaylist(tx, mux.Vars(r)["id"])
+		if err != nil {
+			return err
+		}
+
+		collaborator, err = findCollaborator(tx, playlist.ID, user.ID)
+		if err != nil {
+			return err
+		}
+
+		if !f.Accept {
+			return tx.Unscoped().Delete(&collaborator).Error
+		}
+
+		if collaborator.AcceptedAt != nil {
+			return nil
+		}
+
+		now := time.Now()
+		collaborator.AcceptedAt = &now
+
+		return tx.Model(&collaborator).Update("accepted_at", now).Error
+	})
+	if err != nil {
+		collaboratorErrorInResponse(w, err, "招待の処理に失敗しました。")
+		return
+	}
+
+	if f.Accept {
+		writeJSON(w, collaborator)
+	}
+}
+
+type PlaylistActivitiesHandler struct {
+	DB *gorm.DB
+}
+
+// プレイリストの変更履歴を新しい順に返す
+func (f *PlaylistActivitiesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	playlist, err := visiblePlaylist(f.DB, mux.Vars(r)["id"], user)
+	if err != nil {
+		playlistErrorInResponse(w, err, "変更履歴の取得に失敗しました。")
+		return
+	}
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	activities := []model.PlaylistActivity{}
+	err = f.DB.Where("playlist_id = ?", playlist.ID).Order("id desc").
+		Limit(playlistActivitiesPerPage).Offset((page - 1) * playlistActivitiesPerPage).
+		Find(&activities).Error
+	if err != nil {
+		var error model.Error
+		error.Message = "変更履歴の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, activities)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"golang-songs/model"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// isFollowing は userID のユーザーが followID のユーザーをフォローしているかを返す。
+func isFollowing(db *gorm.DB, userID uint, followID uint) (bool, error) {
+	var count int
+	err := db.Model(&model.UserFollow{}).Where("user_id = ? AND follow_id = ?", userID, followID).Count(&count).Error
+
+	return count > 0, err
+}
+
+// canSeeProfileContent は viewerID のユーザーが owner の曲・お気に入り・フォローを見られるかを返す。
+// 非公開アカウントは本人と承認済みのフォロワーにだけ見せる。
+func canSeeProfileContent(db *gorm.DB, viewerID uint, owner model.User) (bool, error) {
+	if !owner.IsPrivate || viewerID == owner.ID {
+		return true, nil
+	}
+
+	return isFollowing(db, viewerID, owner.ID)
+}
+
+// excludePrivateUsers は viewerID のユーザーが見られない非公開アカウントのレコードを除く。
+func excludePrivateUsers(db *gorm.DB, column string, viewerID uint) *gorm.DB {
+	following := db.New().Model(&model.UserFollow{}).Select("follow_id").Where("user_id = ?", viewerID).QueryExpr()
+	private := db.New().Model(&model.User{}).Select("id").
+		Where("is_private = ? AND id <> ? AND id NOT IN (?)", true, viewerID, following).QueryExpr()
+
+	return db.Where(column+" NOT IN (?)", private)
+}
+
+// approveFollowRequest は申請をフォローに置き換える。
+func approveFollowRequest(db *gorm.DB, request model.FollowRequest) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		// (user_id, follow_id) に一意制約があるため物理削除する
+		if err := tx.Unscoped().Delete(&request).Error; err != nil {
+			return err
+		}
+
+		var follow model.UserFollow
+		return tx.Where(model.UserFollow{UserID: request.UserID, FollowID: request.FollowID}).FirstOrCreate(&follow).Error
+	})
+}
+
+type UpdatePrivacyHandler struct {
+	DB *gorm.DB
+}
+
+// アカウントの公開・非公開を切り替える。公開に戻した場合は保留中の申請をすべて承認する
+func (f *UpdatePrivacyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.PrivacyForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err := f.DB.Model(&user).UpdateColumn("is_private", d.IsPrivate).Error; err != nil {
+		var error model.Error
+		error.Message = "ユーザー情報の更新に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if !d.IsPrivate {
+		var requests []model.FollowRequest
+		if err := f.DB.Where("follow_id = ?", user.ID).Find(&requests).Error; err != nil {
+			var error model.Error
+			error.Message = "フォロー申請の取得に失敗しました。"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+
+		for _, request := range requests {
+			if err := approveFollowRequest(f.DB, request); err != nil {
+				var error model.Error
+				error.Message = "フォロー申請の承認に失敗しました。"
+				errorInResponse(w, http.StatusInternalServerError, error)
+				return
+			}
+		}
+	}
+}
+
+type FollowRequestsHandler struct {
+	DB *gorm.DB
+}
+
+// 自分宛ての保留中のフォロー申請を返す
+func (f *FollowRequestsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	requests := []model.FollowRequest{}
+
+	if err := f.DB.Preload("User").Where("follow_id = ?", user.ID).Order("created_at desc").Find(&requests).Error; err != nil {
+		var error model.Error
+		error.Message = "フォロー申請の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	requesters := []model.User{}
+	for _, request := range requests {
+		if request.User != nil {
+			requesters = append(requesters, *request.User)
+		}
+	}
+
+	profiles, err := profilesFor(f.DB, user.ID, requesters)
+	if err != nil {
+		var error model.Error
+		error.Message = "フォロー申請の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	byID := map[uint]model.Profile{}
+	for _, profile := range profiles {
+		byID[profile.ID] = profile
+	}
+	for i := range requests {
+		if profile, ok := byID[requests[i].UserID]; ok {
+			requests[i].Requester = &profile
+		}
+	}
+
+	writeJSON(w, requests)
+}
+
+type RespondFollowRequestHandler struct {
+	DB      *gorm.DB
+	Approve bool
+}
+
+// 自分宛てのフォロー申請を承認または拒否する
+func (f *RespondFollowRequestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		var error model.Error
+		error.Message = "idの取得に失敗しました"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	var request model.FollowRequest
+	if err := f.DB.Where("id = ? AND follow_id = ?", id, user.ID).Find(&request).Error; err != nil {
+		var error model.Error
+		error.Message = "該当するフォロー申請が見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	var err error
+	if f.Approve {
+		err = approveFollowRequest(f.DB, request)
+	} else {
+		err = f.DB.Unscoped().Delete(&request).Error
+	}
+	if err != nil {
+		var error model.Error
+		error.Message = "フォロー申請の処理に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"golang-songs/model"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+)
+
+// プロフィールの項目の公開範囲
+const (
+	visibilityPublic    = "public"
+	visibilityFollowers = "followers"
+	visibilityPrivate   = "private"
+)
+
+var profileVisibilities = []string{visibilityPublic, visibilityFollowers, visibilityPrivate}
+
+// profileAudience はプロフィールを見ているユーザーと本人の関係。
+type profileAudience int
+
+const (
+	audiencePublic profileAudience = iota
+	audienceFollower
+	audienceSelf
+)
+
+func visibleTo(visibility string, audience profileAudience) bool {
+	switch visibility {
+	case visibilityPrivate:
+		return audience == audienceSelf
+	case visibilityFollowers:
+		return audience >= audienceFollower
+	}
+
+	return true
+}
+
+// newProfile は audience に見せてよい項目だけのプロフィールを作る。
+func newProfile(user model.User, audience profileAudience) model.Profile {
+	profile := model.Profile{
+		ID:        user.ID,
+		CreatedAt: user.CreatedAt,
+		Name:      user.Name,
+		ImageUrl:  user.ImageUrl,
+		Comment:   user.Comment,
+		IsPrivate: user.IsPrivate,
+	}
+
+	if visibleTo(user.AgeVisibility, audience) {
+		profile.Age = &user.Age
+	}
+	if visibleTo(user.GenderVisibility, audience) {
+		profile.Gender = &user.Gender
+	}
+	if visibleTo(user.FavoriteMusicAgeVisibility, audience) {
+		profile.FavoriteMusicAge = &user.FavoriteMusicAge
+	}
+	if visibleTo(user.FavoriteArtistVisibility, audience) {
+		profile.FavoriteArtist = &user.FavoriteArtist
+		profile.FavoriteArtistID = user.FavoriteArtistID
+	}
+
+	return profile
+}
+
+// profilesFor は viewerID のユーザーから見た users のプロフィールを返す。
+func profilesFor(db *gorm.DB, viewerID uint, users []model.User) ([]model.Profile, error) {
+	var follows []model.UserFollow
+	if err := db.Where("user_id = ?", viewerID).Find(&follows).Error; err != nil {
+		return nil, err
+	}
+
+	following := map[uint]bool{}
+	for _, follow := range follows {
+		following[follow.FollowID] = true
+	}
+
+	profiles := []model.Profile{}
+	for _, user := range users {
+		audience := audiencePublic
+		switch {
+		case user.ID == viewerID:
+			audience = audienceSelf
+		case following[user.ID]:
+			audience = audienceFollower
+		}
+
+		profiles = append(profiles, newProfile(user, audience))
+	}
+
+	return profiles, nil
+}
+
+// ownProfile は本人に返すプロフィール。フォロー中のユーザーは他人なので Profile にする。
+type ownProfile struct {
+	model.User
+	Followings []model.Profile `json:"followings"`
+}
+
+func newOwnProfile(db *gorm.DB, user model.User) (ownProfile, error) {
+	followings := []model.User{}
+	for _, following := range user.Followings {
+		followings = append(followings, *following)
+	}
+
+	profiles, err := profilesFor(db, user.ID, followings)
+
+	return ownProfile{User: user, Followings: profiles}, err
+}
+
+type UpdateProfileVisibilityHandler struct {
+	DB *gorm.DB
+}
+
+// プロフィールの項目ごとの公開範囲を変更する。空の項目は変更しない
+func (f *UpdateProfileVisibilityHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.ProfileVisibility
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	updates := map[string]interface{}{}
+	for column, v := range map[string]string{
+		"age_visibility":                d.AgeVisibility,
+		"gender_visibility":             d.GenderVisibility,
+		"favorite_music_age_visibility": d.FavoriteMusicAgeVisibility,
+		"favorite_artist_visibility":    d.FavoriteArtistVisibility,
+	} {
+		if v == "" {
+			continue
+		}
+		if !hasScope(profileVisibilities, v) {
+			var error model.Error
+			error.Message = "公開範囲が正しくありません: " + v
+			errorInResponse(w, http.StatusBadRequest, error)
+			return
+		}
+		updates[column] = v
+	}
+
+	if err := f.DB.Model(&user).Updates(updates).Error; err != nil {
+		var error model.Error
+		error.Message = "ユーザー情報の更新に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, user.ProfileVisibility)
+}
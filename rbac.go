@@ -0,0 +1,115 @@
+package main
+
+import (
+	"golang-songs/model"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ロール。user_roles に行が無いユーザーは roleUser として扱う
+const (
+	roleUser      = "user"
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+// 管理APIの権限
+const (
+	permissionViewUsers    = "users:view"
+	permissionSuspendUsers = "users:suspend"
+	permissionDeleteSongs  = "songs:delete"
+	permissionViewStats    = "stats:view"
+	permissionManageRoles  = "roles:manage"
+	permissionModerate     = "moderation:review"
+
+	permissionConfigureModeration = "moderation:configure"
+	permissionReindexHashtags     = "hashtags:reindex"
+	permissionManageArtists       = "artists:manage"
+)
+
+var rolePermissions = map[string][]string{
+	roleUser: {},
+	roleModerator: {
+		permissionViewUsers,
+		permissionSuspendUsers,
+		permissionDeleteSongs,
+		permissionModerate,
+	},
+	roleAdmin: {
+		permissionViewUsers,
+		permissionSuspendUsers,
+		permissionDeleteSongs,
+		permissionViewStats,
+		permissionManageRoles,
+		permissionModerate,
+		permissionConfigureModeration,
+		permissionReindexHashtags,
+		permissionManageArtists,
+	},
+}
+
+// userRoles はユーザーのロール一覧を返す。
+func userRoles(db *gorm.DB, userID uint) ([]string, error) {
+	var rows []model.UserRole
+	if err := db.Where("user_id = ?", userID).Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	roles := []string{roleUser}
+	for _, row := range rows {
+		if row.Role != roleUser {
+			roles = append(roles, row.Role)
+		}
+	}
+
+	return roles, nil
+}
+
+func (ac *authContext) hasPermission(permission string) bool {
+	for _, role := range ac.Roles {
+		if hasScope(rolePermissions[role], permission) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// canSuspend はリクエストユーザーが target を利用停止できるかを返す。
+// モデレーター・管理者を停止できるのは、ロールを管理できるユーザーだけにする。
+func canSuspend(db *gorm.DB, r *http.Request, target model.User) (bool, error) {
+	ac, ok := r.Context().Value(authKey).(*authContext)
+	if !ok {
+		return false, nil
+	}
+
+	roles, err := userRoles(db, target.ID)
+	if err != nil {
+		return false, err
+	}
+
+	for _, role := range roles {
+		if role != roleUser && !ac.hasPermission(permissionManageRoles) {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// RequirePermission はログインした JWT で、permission を持つロールのユーザーだけを h に渡す。
+// 管理APIはパーソナルアクセストークンでは使えない。
+func (m *AuthMiddleware) RequirePermission(permission string, h http.Handler) http.Handler {
+	return m.Handler(scopeAccount, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ac, ok := r.Context().Value(authKey).(*authContext)
+		if !ok || !ac.hasPermission(permission) {
+			var error model.Error
+			error.Message = "この操作を行う権限がありません。"
+			errorInResponse(w, http.StatusForbidden, error)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	}))
+}
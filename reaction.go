@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"golang-songs/model"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// リアクションの種類。お気に入り(あとで聴く)とは別に、曲への気持ちを表す
+const (
+	reactionLove      = "love"
+	reactionFire      = "fire"
+	reactionNostalgic = "nostalgic"
+	reactionChill     = "chill"
+	reactionSad       = "sad"
+)
+
+var reactionTypes = []string{reactionLove, reactionFire, reactionNostalgic, reactionChill, reactionSad}
+
+const songReactionsPerPage = 50
+
+// loadReactionCounts は曲一覧に種類ごとのリアクション数を入れる。リアクションの無い種類も 0 で返す。
+func loadReactionCounts(db *gorm.DB, songs []model.Song, ids []uint) error {
+	var counts []struct {
+		SongID uint
+		Type   string
+		Count  int
+	}
+	err := db.Model(&model.SongReaction{}).Select("song_id, type, count(*) AS count").
+		Where("song_id IN (?)", ids).Group("song_id, type").Scan(&counts).Error
+	if err != nil {
+		return err
+	}
+
+	for i := range songs {
+		songs[i].Reactions = map[string]int{}
+		for _, t := range reactionTypes {
+			songs[i].Reactions[t] = 0
+		}
+	}
+
+	index := map[uint]int{}
+	for i, song := range songs {
+		index[song.ID] = i
+	}
+	for _, c := range counts {
+		if i, ok := index[c.SongID]; ok {
+			songs[i].Reactions[c.Type] = c.Count
+		}
+	}
+
+	return nil
+}
+
+type ReactHandler struct {
+	DB *gorm.DB
+}
+
+// 曲にリアクションする。既にリアクションしている場合は種類を置き換える
+func (f *ReactHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.SongReactionForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if !hasScope(reactionTypes, d.Type) {
+		var error model.Error
+		error.Message = "リアクションの種類が正しくありません: " + d.Type
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	song, err := visibleSong(f.DB, r, user, mux.Vars(r)["id"])
+	if err != nil || song.HiddenAt != nil {
+		var error model.Error
+		error.Message = "該当する曲が見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	var reaction model.SongReaction
+	err = f.DB.Where(model.SongReaction{UserID: user.ID, SongID: song.ID}).
+		Assign(model.SongReaction{Type: d.Type}).FirstOrCreate(&reaction).Error
+	if err != nil {
+		var error model.Error
+		error.Message = "リアクションに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, reaction)
+}
+
+type RemoveReactionHandler struct {
+	DB *gorm.DB
+}
+
+func (f *RemoveReactionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	// (user_id, song_id) に一意制約があるため物理削除する
+	if err := f.DB.Unscoped().Where("user_id = ? AND song_id = ?", user.ID, mux.Vars(r)["id"]).Delete(&model.SongReaction{}).Error; err != nil {
+		var error model.Error
+		error.Message = "リアクションの取り消しに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type SongReactionsHandler struct {
+	DB *gorm.DB
+}
+
+// 曲にリアクションしたユーザーを新しい順に返す。type で種類を絞り込める
+func (f *SongReactionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	song, err := visibleSong(f.DB, r, user, mux.Vars(r)["id"])
+	if err != nil {
+		var error model.Error
+		error.Message = "該当する曲が見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	// ブロック・ミュートしたユーザーは出さない
+	hiddenIDs, err := hiddenUserIDs(f.DB, user.ID)
+	if err != nil {
+		var error model.Error
+		error.Message = "リアクションの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	query := excludeUsers(f.DB, "user_id", hiddenIDs).Where("song_id = ?", song.ID)
+	if t := r.URL.Query().Get("type"); t != "" {
+		if !hasScope(reactionTypes, t) {
+			var error model.Error
+			error.Message = "リアクションの種類が正しくありません: " + t
+			errorInResponse(w, http.StatusBadRequest, error)
+			return
+		}
+		query = query.Where("type = ?", t)
+	}
+
+	reactions := []model.SongReaction{}
+	err = query.Order("updated_at desc").Limit(songReactionsPerPage).Offset((page - 1) * songReactionsPerPage).Find(&reactions).Error
+	if err != nil {
+		var error model.Error
+		error.Message = "リアクションの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	ids := []uint{}
+	for _, reaction := range reactions {
+		ids = append(ids, reaction.UserID)
+	}
+
+	var users []model.User
+	if err := f.DB.Where("id IN (?)", ids).Find(&users).Error; err != nil {
+		var error model.Error
+		error.Message = "リアクションの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	profiles, err := profilesFor(f.DB, user.ID, users)
+	if err != nil {
+		var error model.Error
+		error.Message = "リアクションの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	byID := map[uint]model.Profile{}
+	for _, profile := range profiles {
+		byID[profile.ID] = profile
+	}
+	for i := range reactions {
+		if profile, ok := byID[reactions[i].UserID]; ok {
+			reactions[i].User = &profile
+		}
+	}
+
+	writeJSON(w, reactions)
+}
@@ -0,0 +1,12 @@
+package service
+
+// NormalizeArtist はアーティスト名を比較するためのキーを返す。
+// 略称のように表記が大きく違う名前は別名(ArtistAlias)で結び付ける。
+func NormalizeArtist(name string) string {
+	return normalizeName(name)
+}
+
+// CleanArtist は表示用のアーティスト名を返す。
+func CleanArtist(name string) string {
+	return cleanName(name)
+}
@@ -0,0 +1,58 @@
+package service
+
+import (
+	"golang-songs/model"
+	"regexp"
+	"unicode"
+)
+
+// hashtagPattern は # または全角の ＃ から始まるハッシュタグ。
+// 日本語の文に続けて書かれることが多いので、直前が日本語でもよい。
+// 直前が英数字や URL の一部(#fragment や &#39; など)の場合はハッシュタグとみなさない。
+var hashtagPattern = regexp.MustCompile(`(?:^|[^0-9A-Za-z_&/#＃])([#＃])([\p{L}\p{N}\p{M}_]+)`)
+
+// ExtractHashtags は text のハッシュタグを出てくる順に返す。数字だけのものは除く。
+// 位置はブラウザの文字列と同じく UTF-16 のコード単位で数える。
+func ExtractHashtags(text string) []model.Hashtag {
+	hashtags := []model.Hashtag{}
+	for _, m := range hashtagPattern.FindAllStringSubmatchIndex(text, -1) {
+		tag := text[m[4]:m[5]]
+		if !hasNonDigit(tag) {
+			continue
+		}
+
+		start := utf16Len(text[:m[2]])
+		hashtags = append(hashtags, model.Hashtag{
+			Text:  tag,
+			Start: start,
+			End:   start + utf16Len(text[m[2]:m[5]]),
+		})
+	}
+
+	return hashtags
+}
+
+func hasNonDigit(s string) bool {
+	for _, r := range s {
+		if !unicode.IsDigit(r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// utf16Len は s を UTF-16 にしたときのコード単位の数を返す。
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		// 基本多言語面の外の文字はサロゲートペアの2つになる
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,56 @@
+package service
+
+import (
+	"golang-songs/model"
+	"reflect"
+	"testing"
+)
+
+func TestExtractHashtags(t *testing.T) {
+	tests := []struct {
+		text string
+		want []model.Hashtag
+	}{
+		{"", []model.Hashtag{}},
+		{"#rock", []model.Hashtag{{Text: "rock", Start: 0, End: 5}}},
+		{"好きな曲 #ロック と #jazz", []model.Hashtag{
+			{Text: "ロック", Start: 5, End: 9},
+			{Text: "jazz", Start: 12, End: 17},
+		}},
+		{"日本語の後に＃シティポップ", []model.Hashtag{{Text: "シティポップ", Start: 6, End: 13}}},
+		// 絵文字は UTF-16 では2つと数える
+		{"🎸 #guitar", []model.Hashtag{{Text: "guitar", Start: 3, End: 10}}},
+		{"🎸🎸#guitar", []model.Hashtag{{Text: "guitar", Start: 4, End: 11}}},
+		{"#123", []model.Hashtag{}},
+		{"#2020s", []model.Hashtag{{Text: "2020s", Start: 0, End: 6}}},
+		{"abc#def", []model.Hashtag{}},
+		{"https://example.com/#section", []model.Hashtag{}},
+		{"&#39;", []model.Hashtag{}},
+		{"##double", []model.Hashtag{}},
+	}
+
+	for _, tt := range tests {
+		if got := ExtractHashtags(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ExtractHashtags(%q) = %+v, want %+v", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestUTF16Len(t *testing.T) {
+	tests := []struct {
+		s    string
+		want int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"あいう", 3},
+		{"🎸", 2},
+		{"a🎸b", 4},
+	}
+
+	for _, tt := range tests {
+		if got := utf16Len(tt.s); got != tt.want {
+			t.Errorf("utf16Len(%q) = %d, want %d", tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package service
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+const (
+	// hubHistorySize はユーザーごとに再送用に残すイベントの件数
+	hubHistorySize = 100
+	// hubHistoryTTL を過ぎたイベントは再送しない
+	hubHistoryTTL = 10 * time.Minute
+	// hubBufferSize は接続ごとの送信待ちの上限。溢れた接続は切断し、再接続で再送させる
+	hubBufferSize = 64
+)
+
+// Event はストリームで配るイベント。ID はユーザーごとの再送位置に使い、後のイベントほど大きい。
+type Event struct {
+	ID     uint64          `json:"id"`
+	UserID uint            `json:"-"`
+	Type   string          `json:"type"`
+	Data   json.RawMessage `json:"data"`
+	at     time.Time
+}
+
+// Broker はイベントをサーバーのインスタンス間で配るためのインターフェース。
+// Publish したイベントは Subscribe した全インスタンスの deliver に届ける。
+// 複数台で動かす場合は Redis などの pub/sub で実装して差し替える。
+type Broker interface {
+	Publish(e Event) error
+	Subscribe(deliver func(Event)) error
+}
+
+// NewBroker はストリームに使う Broker を返す。今はプロセス内の LocalBroker だけで、
+// 複数台で動かす実装を足す場合はここで切り替える。
+func NewBroker() Broker {
+	return &LocalBroker{}
+}
+
+// LocalBroker は1台で動かす場合の Broker。同じプロセスの購読者にそのまま渡す。
+type LocalBroker struct {
+	mu       sync.RWMutex
+	handlers []func(Event)
+}
+
+func (b *LocalBroker) Publish(e Event) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, deliver := range b.handlers {
+		deliver(e)
+	}
+
+	return nil
+}
+
+func (b *LocalBroker) Subscribe(deliver func(Event)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers = append(b.handlers, deliver)
+
+	return nil
+}
+
+// Subscription は1本のストリーム接続。Events が閉じられたら接続を終える。
+// Overflowed が true なら送信が追いつかずに切られたので、クライアントは最後の ID から再接続する。
+type Subscription struct {
+	UserID     uint
+	Events     chan Event
+	Overflowed bool
+
+	hub  *Hub
+	once sync.Once
+}
+
+// Close は購読をやめる。
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+
+	s.hub.remove(s)
+}
+
+// Hub はユーザーごとのストリーム接続にイベントを配る。
+// 再接続したクライアントには、直近のイベントのうち Last-Event-ID より後のものを再送する。
+type Hub struct {
+	broker Broker
+
+	mu          sync.Mutex
+	lastID      uint64
+	startID     uint64
+	floors      map[uint]uint64
+	subscribers map[uint]map[*Subscription]bool
+	history     map[uint][]Event
+}
+
+// NewHub は broker から届いたイベントを接続に配る Hub を作る。
+func NewHub(broker Broker) (*Hub, error) {
+	h := &Hub{
+		broker:      broker,
+		floors:      map[uint]uint64{},
+		subscribers: map[uint]map[*Subscription]bool{},
+		history:     map[uint][]Event{},
+	}
+	// 起動前のイベントは残っていないので、それより前の ID からの再接続は取り直してもらう
+	h.startID = h.nextID()
+
+	if err := broker.Subscribe(h.deliver); err != nil {
+		return nil, err
+	}
+
+	go h.expire()
+
+	return h, nil
+}
+
+// nextID は現在時刻(マイクロ秒)を元に、直前より大きい ID を返す。
+func (h *Hub) nextID() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	id := uint64(time.Now().UnixNano() / int64(time.Microsecond))
+	if id <= h.lastID {
+		id = h.lastID + 1
+	}
+	h.lastID = id
+
+	return id
+}
+
+// Publish は userID のユーザーの接続に typ のイベントを送る。
+func (h *Hub) Publish(userID uint, typ string, data interface{}) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	return h.broker.Publish(Event{ID: h.nextID(), UserID: userID, Type: typ, Data: b})
+}
+
+// Subscribe は userID のユーザーの接続を登録する。
+// lastEventID より後の再送できるイベントと、再送しきれない場合は resync に true を返す。
+func (h *Hub) Subscribe(userID uint, lastEventID uint64) (*Subscription, []Event, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := &Subscription{UserID: userID, Events: make(chan Event, hubBufferSize), hub: h}
+	if h.subscribers[userID] == nil {
+		h.subscribers[userID] = map[*Subscription]bool{}
+	}
+	h.subscribers[userID][s] = true
+
+	if lastEventID == 0 {
+		return s, nil, false
+	}
+
+	replay := []Event{}
+	for _, e := range h.history[userID] {
+		if e.ID > lastEventID {
+			replay = append(replay, e)
+		}
+	}
+
+	return s, replay, lastEventID < h.startID || lastEventID < h.floors[userID]
+}
+
+func (h *Hub) deliver(e Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if e.ID > h.lastID {
+		h.lastID = e.ID
+	}
+
+	e.at = time.Now()
+	history := append(h.history[e.UserID], e)
+	if len(history) > hubHistorySize {
+		h.evict(e.UserID, history[len(history)-hubHistorySize-1].ID)
+		history = history[len(history)-hubHistorySize:]
+	}
+	h.history[e.UserID] = history
+
+	for s := range h.subscribers[e.UserID] {
+		select {
+		case s.Events <- e:
+		default:
+			s.Overflowed = true
+			h.remove(s)
+		}
+	}
+}
+
+// evict は userID のユーザーの id までのイベントを再送できなくなったことを記録する。
+func (h *Hub) evict(userID uint, id uint64) {
+	if id > h.floors[userID] {
+		h.floors[userID] = id
+	}
+}
+
+func (h *Hub) remove(s *Subscription) {
+	s.once.Do(func() {
+		delete(h.subscribers[s.UserID], s)
+		if len(h.subscribers[s.UserID]) == 0 {
+			delete(h.subscribers, s.UserID)
+		}
+		close(s.Events)
+	})
+}
+
+// expire は古いイベントを定期的に捨てる。
+func (h *Hub) expire() {
+	for range time.Tick(time.Minute) {
+		h.mu.Lock()
+		deadline := time.Now().Add(-hubHistoryTTL)
+		for userID, history := range h.history {
+			i := 0
+			for i < len(history) && history[i].at.Before(deadline) {
+				h.evict(userID, history[i].ID)
+				i++
+			}
+			if i == len(history) {
+				delete(h.history, userID)
+			} else {
+				h.history[userID] = history[i:]
+			}
+		}
+		h.mu.Unlock()
+	}
+}
@@ -0,0 +1,150 @@
+package service
+
+import "testing"
+
+func newTestHub(t *testing.T) *Hub {
+	h, err := NewHub(NewBroker())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return h
+}
+
+func publishN(t *testing.T, h *Hub, userID uint, n int) []Event {
+	s, _, _ := h.Subscribe(userID, 0)
+	defer s.Close()
+
+	events := []Event{}
+	for i := 0; i < n; i++ {
+		if err := h.Publish(userID, "notification", i); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case e := <-s.Events:
+			events = append(events, e)
+		default:
+			t.Fatalf("event %d was not delivered", i)
+		}
+	}
+
+	return events
+}
+
+func TestHubDeliversOnlyToTheUser(t *testing.T) {
+	h := newTestHub(t)
+
+	s1, _, _ := h.Subscribe(1, 0)
+	defer s1.Close()
+	s2, _, _ := h.Subscribe(2, 0)
+	defer s2.Close()
+
+	if err := h.Publish(1, "notification", "hello"); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-s1.Events:
+		if e.Type != "notification" || string(e.Data) != `"hello"` {
+			t.Errorf("event = %+v", e)
+		}
+	default:
+		t.Error("user 1 did not receive the event")
+	}
+
+	select {
+	case e := <-s2.Events:
+		t.Errorf("user 2 received %+v", e)
+	default:
+	}
+}
+
+func TestHubReplay(t *testing.T) {
+	h := newTestHub(t)
+	events := publishN(t, h, 1, 3)
+
+	tests := []struct {
+		name       string
+		after      uint64
+		wantReplay int
+		wantResync bool
+	}{
+		{"new connection", 0, 0, false},
+		{"after first", events[0].ID, 2, false},
+		{"after last", events[2].ID, 0, false},
+		{"before start", 1, 3, true},
+	}
+
+	for _, tt := range tests {
+		s, replay, resync := h.Subscribe(1, tt.after)
+		s.Close()
+
+		if len(replay) != tt.wantReplay || resync != tt.wantResync {
+			t.Errorf("%s: Subscribe = (%d events, resync %v), want (%d, %v)", tt.name, len(replay), resync, tt.wantReplay, tt.wantResync)
+		}
+	}
+
+	_, replay, _ := h.Subscribe(1, events[0].ID)
+	for i, e := range replay {
+		if e.ID != events[i+1].ID {
+			t.Errorf("replay[%d].ID = %d, want %d", i, e.ID, events[i+1].ID)
+		}
+	}
+}
+
+func TestHubResyncIsPerUser(t *testing.T) {
+	h := newTestHub(t)
+
+	other := publishN(t, h, 2, 1)
+	events := publishN(t, h, 1, hubHistorySize+1)
+
+	// events[0] は履歴から消えたので、それを受け取る前からの再接続は取り直しになる
+	_, replay, resync := h.Subscribe(1, events[0].ID-1)
+	if !resync {
+		t.Error("user 1 was not asked to resync after its history overflowed")
+	}
+	if len(replay) != hubHistorySize {
+		t.Errorf("len(replay) = %d, want %d", len(replay), hubHistorySize)
+	}
+
+	// user 1 の履歴が溢れても、user 2 の再接続は取り直しにならない
+	_, replay, resync = h.Subscribe(2, other[0].ID)
+	if resync {
+		t.Error("user 2 was asked to resync because of another user's history")
+	}
+	if len(replay) != 0 {
+		t.Errorf("len(replay) = %d, want 0", len(replay))
+	}
+}
+
+func TestHubOverflow(t *testing.T) {
+	h := newTestHub(t)
+
+	s, _, _ := h.Subscribe(1, 0)
+	for i := 0; i < hubBufferSize+1; i++ {
+		if err := h.Publish(1, "notification", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := 0
+	for range s.Events {
+		received++
+	}
+
+	if received != hubBufferSize {
+		t.Errorf("received %d events before the subscription was closed, want %d", received, hubBufferSize)
+	}
+	if !s.Overflowed {
+		t.Error("Overflowed = false, want true")
+	}
+
+	// 閉じた購読を Close しても panic しない
+	s.Close()
+
+	// 再接続すれば溢れた分も再送される
+	_, replay, resync := h.Subscribe(1, 1)
+	if len(replay) != hubBufferSize+1 || !resync {
+		t.Errorf("Subscribe = (%d events, resync %v), want (%d, true)", len(replay), resync, hubBufferSize+1)
+	}
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Mailer はメール送信の実装を差し替えるためのインターフェース
+type Mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// NewMailer は環境変数 MAILER に応じた Mailer を返す。
+// smtp 以外が指定された場合はローカル用に MAIL_DIR へファイルとして書き出す。
+func NewMailer() Mailer {
+	switch os.Getenv("MAILER") {
+	case "smtp":
+		host := os.Getenv("SMTP_HOST")
+		var auth smtp.Auth
+		if os.Getenv("SMTP_USERNAME") != "" {
+			auth = smtp.PlainAuth("", os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), host)
+		}
+		return &SMTPMailer{
+			Addr: host + ":" + os.Getenv("SMTP_PORT"),
+			Auth: auth,
+			From: os.Getenv("MAIL_FROM"),
+		}
+	case "memory":
+		return &MemoryMailer{}
+	default:
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "tmp/mail"
+		}
+		return &FileMailer{Dir: dir, From: os.Getenv("MAIL_FROM")}
+	}
+}
+
+// SMTPMailer は SMTP サーバー経由でメールを送信する。
+type SMTPMailer struct {
+	Addr string
+	Auth smtp.Auth
+	From string
+}
+
+func (m *SMTPMailer) Send(to string, subject string, body string) error {
+	msg, err := buildMessage(m.From, to, subject, body)
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{to}, msg)
+}
+
+// FileMailer は送信する代わりにメールを Dir 以下へ書き出す。
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(to string, subject string, body string) error {
+	msg, err := buildMessage(m.From, to, subject, body)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.Replace(to, "@", "_at_", -1))
+
+	return ioutil.WriteFile(filepath.Join(m.Dir, filepath.Base(name)), msg, 0644)
+}
+
+// Mail は MemoryMailer に溜められた送信済みメールを表す。
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// MemoryMailer は送信したメールをメモリ上に保持する。
+type MemoryMailer struct {
+	mu    sync.Mutex
+	mails []Mail
+}
+
+func (m *MemoryMailer) Send(to string, subject string, body string) error {
+	if _, err := buildMessage("", to, subject, body); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.mails = append(m.mails, Mail{To: to, Subject: subject, Body: body})
+
+	return nil
+}
+
+// Mails はこれまでに送信されたメールを返す。
+func (m *MemoryMailer) Mails() []Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mails := make([]Mail, len(m.mails))
+	copy(mails, m.mails)
+
+	return mails
+}
+
+func buildMessage(from string, to string, subject string, body string) ([]byte, error) {
+	//ヘッダインジェクション対策
+	if strings.ContainsAny(from+to, "\r\n") {
+		return nil, errors.Errorf("invalid address: %q", to)
+	}
+
+	header := "From: " + from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + mime.BEncoding.Encode("UTF-8", subject) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n"
+
+	return []byte(header + body), nil
+}
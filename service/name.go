@@ -0,0 +1,28 @@
+package service
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// cleanName は表示用の名前を返す。NFKC で全角・半角を揃え、前後・連続の空白を取り除く。
+func cleanName(name string) string {
+	name = norm.NFKC.String(name)
+
+	return strings.Join(strings.FieldsFunc(name, unicode.IsSpace), " ")
+}
+
+// normalizeName は cleanName で揃えた名前から比較するためのキーを返す。
+// 英字を小文字に、カタカナをひらがなに寄せる。
+func normalizeName(name string) string {
+	name = strings.ToLower(cleanName(name))
+
+	var b strings.Builder
+	for _, r := range name {
+		b.WriteRune(foldKana(r))
+	}
+
+	return b.String()
+}
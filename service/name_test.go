@@ -0,0 +1,50 @@
+package service
+
+import "testing"
+
+func TestNormalizeTag(t *testing.T) {
+	tests := []struct {
+		in        string
+		wantClean string
+		wantKey   string
+	}{
+		{"#Rock", "Rock", "rock"},
+		{"＃ロック", "ロック", "ろっく"},
+		{"  City   Pop ", "City Pop", "city pop"},
+		{"# J-POP", "J-POP", "j-pop"},
+		{"ｼﾃｨﾎﾟｯﾌﾟ", "シティポップ", "してぃぽっぷ"},
+		{"###", "", ""},
+	}
+
+	for _, tt := range tests {
+		if got := CleanTag(tt.in); got != tt.wantClean {
+			t.Errorf("CleanTag(%q) = %q, want %q", tt.in, got, tt.wantClean)
+		}
+		if got := NormalizeTag(tt.in); got != tt.wantKey {
+			t.Errorf("NormalizeTag(%q) = %q, want %q", tt.in, got, tt.wantKey)
+		}
+	}
+}
+
+func TestNormalizeArtist(t *testing.T) {
+	tests := []struct {
+		in        string
+		wantClean string
+		wantKey   string
+	}{
+		{"ＹＯＡＳＯＢＩ", "YOASOBI", "yoasobi"},
+		{"  Official髭男dism ", "Official髭男dism", "official髭男dism"},
+		{"サカナクション", "サカナクション", "さかなくしょん"},
+		// タグと違い # は名前の一部として残す
+		{"#Name", "#Name", "#name"},
+	}
+
+	for _, tt := range tests {
+		if got := CleanArtist(tt.in); got != tt.wantClean {
+			t.Errorf("CleanArtist(%q) = %q, want %q", tt.in, got, tt.wantClean)
+		}
+		if got := NormalizeArtist(tt.in); got != tt.wantKey {
+			t.Errorf("NormalizeArtist(%q) = %q, want %q", tt.in, got, tt.wantKey)
+		}
+	}
+}
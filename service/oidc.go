@@ -0,0 +1,388 @@
+package service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"gopkg.in/yaml.v2"
+)
+
+// OIDCProviderConfig は conf/oidc.yml に書く1つの IdP の設定。
+type OIDCProviderConfig struct {
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	RedirectURL  string   `yaml:"redirect_url"`
+	Scopes       []string `yaml:"scopes"`
+}
+
+// OIDCConfig は conf/oidc.yml の内容。providers のキーがURLに使うプロバイダ名になる。
+//
+//	providers:
+//	  google:
+//	    issuer: https://accounts.google.com
+//	    client_id: ${GOOGLE_CLIENT_ID}
+//	    client_secret: ${GOOGLE_CLIENT_SECRET}
+//	    redirect_url: https://example.com/oidc/google/callback
+type OIDCConfig struct {
+	Providers map[string]OIDCProviderConfig `yaml:"providers"`
+}
+
+// LoadOIDCConfig は設定ファイルを読み込む。
+// client_secret などは .env に置けるよう、${VAR} を環境変数で展開する。
+func LoadOIDCConfig(path string) (*OIDCConfig, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config OIDCConfig
+	if err := yaml.Unmarshal([]byte(os.ExpandEnv(string(b))), &config); err != nil {
+		return nil, err
+	}
+
+	for name, p := range config.Providers {
+		if p.Issuer == "" || p.ClientID == "" || p.RedirectURL == "" {
+			return nil, errors.Errorf("oidc provider %s: issuer, client_id and redirect_url are required", name)
+		}
+	}
+
+	return &config, nil
+}
+
+// OIDCClaims は ID トークンから取り出したユーザー情報。
+type OIDCClaims struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Picture       string
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksURI               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// OIDCProvider は1つの IdP に対する Relying Party。
+// ディスカバリと公開鍵は初回に取得してキャッシュする。
+type OIDCProvider struct {
+	Name   string
+	Config OIDCProviderConfig
+
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+func NewOIDCProvider(name string, config OIDCProviderConfig) *OIDCProvider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	return &OIDCProvider{
+		Name:   name,
+		Config: config,
+		client: &http.Client{
+			Timeout: 15 * time.Second,
+		},
+	}
+}
+
+// PKCEChallenge は code_verifier から S256 の code_challenge を作る。
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL は IdP の認可画面のURLを返す。
+func (p *OIDCProvider) AuthCodeURL(state string, nonce string, codeVerifier string) (string, error) {
+	config, err := p.oauth2Config()
+	if err != nil {
+		return "", err
+	}
+
+	return config.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("nonce", nonce),
+		oauth2.SetAuthURLParam("code_challenge", PKCEChallenge(codeVerifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256")), nil
+}
+
+// Exchange は code を交換し、検証済みの ID トークンの内容を返す。
+func (p *OIDCProvider) Exchange(ctx context.Context, code string, codeVerifier string, nonce string) (*OIDCClaims, error) {
+	config, err := p.oauth2Config()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, p.client)
+
+	token, err := config.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", codeVerifier))
+	if err != nil {
+		return nil, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return nil, errors.New("id_token is missing in token response")
+	}
+
+	return p.VerifyIDToken(rawIDToken, nonce)
+}
+
+// VerifyIDToken は ID トークンの署名と iss / aud / exp / nonce を検証する。
+func (p *OIDCProvider) VerifyIDToken(rawIDToken string, nonce string) (*OIDCClaims, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	// exp / iat / nbf は jwt.Parse が検証する
+	token, err := jwt.Parse(rawIDToken, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, errors.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+
+		kid, _ := token.Header["kid"].(string)
+		return p.key(discovery, kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, errors.New("invalid id_token claims")
+	}
+
+	if claims["iss"] != discovery.Issuer {
+		return nil, errors.Errorf("unexpected issuer: %v", claims["iss"])
+	}
+
+	if !containsAudience(claims["aud"], p.Config.ClientID) {
+		return nil, errors.Errorf("unexpected audience: %v", claims["aud"])
+	}
+
+	if azp, ok := claims["azp"].(string); ok && azp != p.Config.ClientID {
+		return nil, errors.Errorf("unexpected authorized party: %s", azp)
+	}
+
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("exp is missing in id_token")
+	}
+
+	if claims["nonce"] != nonce {
+		return nil, errors.New("nonce mismatch")
+	}
+
+	result := &OIDCClaims{}
+	result.Subject, _ = claims["sub"].(string)
+	result.Email, _ = claims["email"].(string)
+	result.Name, _ = claims["name"].(string)
+	result.Picture, _ = claims["picture"].(string)
+
+	// email_verified を文字列で返す IdP もある
+	switch v := claims["email_verified"].(type) {
+	case bool:
+		result.EmailVerified = v
+	case string:
+		result.EmailVerified = v == "true"
+	}
+
+	if result.Subject == "" {
+		return nil, errors.New("sub is missing in id_token")
+	}
+
+	return result, nil
+}
+
+func containsAudience(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (p *OIDCProvider) oauth2Config() (*oauth2.Config, error) {
+	discovery, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauth2.Config{
+		ClientID:     p.Config.ClientID,
+		ClientSecret: p.Config.ClientSecret,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  discovery.AuthorizationEndpoint,
+			TokenURL: discovery.TokenEndpoint,
+		},
+		RedirectURL: p.Config.RedirectURL,
+		Scopes:      p.Config.Scopes,
+	}, nil
+}
+
+func (p *OIDCProvider) getDiscovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := p.getJSON(strings.TrimSuffix(p.Config.Issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+
+	// 別の IdP の設定を返されていないか確認する
+	if discovery.Issuer != p.Config.Issuer {
+		return nil, errors.Errorf("issuer mismatch in discovery: %s", discovery.Issuer)
+	}
+
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JwksURI == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+
+	p.discovery = &discovery
+
+	return p.discovery, nil
+}
+
+// key は kid に対応する公開鍵を返す。
+// 鍵のローテーションに備えて、見つからない場合は取得し直す(1分に1回まで)。
+func (p *OIDCProvider) key(discovery *oidcDiscovery, kid string) (interface{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	if time.Since(p.keysFetched) < time.Minute {
+		return nil, errors.Errorf("unknown key id: %s", kid)
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(discovery.JwksURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]interface{}{}
+	for _, k := range jwks.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+
+	p.keys = keys
+	p.keysFetched = time.Now()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	return nil, errors.Errorf("unknown key id: %s", kid)
+}
+
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, errors.Errorf("unsupported curve: %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+
+	return nil, errors.Errorf("unsupported key type: %s", k.Kty)
+}
+
+func (p *OIDCProvider) getJSON(url string, v interface{}) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("GET %s returned %d", url, resp.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,290 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+const (
+	mockIdPClientID = "songs-client"
+	mockIdPKeyID    = "key-1"
+)
+
+// mockIdP はディスカバリ、JWKS、トークンエンドポイントを持つテスト用の IdP。
+// 認可画面は無いので、authorize で code を発行して code_challenge と nonce を覚えておく。
+type mockIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu     sync.Mutex
+	codes  map[string]mockIdPCode
+	claims jwt.MapClaims
+}
+
+type mockIdPCode struct {
+	challenge string
+	nonce     string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idp := &mockIdP{key: key, codes: map[string]mockIdPCode{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kid": mockIdPKeyID,
+				"kty": "RSA",
+				"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		idp.mu.Lock()
+		code, ok := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		idp.mu.Unlock()
+
+		if !ok || PKCEChallenge(r.PostForm.Get("code_verifier")) != code.challenge {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+
+		claims := idp.defaultClaims()
+		claims["nonce"] = code.nonce
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "access-token",
+			"token_type":   "Bearer",
+			"id_token":     idp.sign(t, claims, mockIdPKeyID),
+		})
+	})
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	return idp
+}
+
+func (idp *mockIdP) provider() *OIDCProvider {
+	return NewOIDCProvider("mock", OIDCProviderConfig{
+		Issuer:      idp.server.URL,
+		ClientID:    mockIdPClientID,
+		RedirectURL: "https://songs.example.com/oidc/mock/callback",
+	})
+}
+
+// authorize は認可画面でユーザーが同意したものとして、認可URLに対する code を発行する。
+func (idp *mockIdP) authorize(t *testing.T, authCodeURL string) string {
+	u, err := url.Parse(authCodeURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q := u.Query()
+	if q.Get("code_challenge_method") != "S256" {
+		t.Errorf("code_challenge_method = %q, want S256", q.Get("code_challenge_method"))
+	}
+	if q.Get("client_id") != mockIdPClientID {
+		t.Errorf("client_id = %q, want %q", q.Get("client_id"), mockIdPClientID)
+	}
+
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+
+	code := "code-" + q.Get("state")
+	idp.codes[code] = mockIdPCode{challenge: q.Get("code_challenge"), nonce: q.Get("nonce")}
+
+	return code
+}
+
+func (idp *mockIdP) defaultClaims() jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":            idp.server.URL,
+		"aud":            mockIdPClientID,
+		"sub":            "subject-1",
+		"email":          "user@example.com",
+		"email_verified": true,
+		"name":           "Mock User",
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func (idp *mockIdP) sign(t *testing.T, claims jwt.MapClaims, kid string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+
+	s, err := token.SignedString(idp.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+func TestOIDCLoginFlow(t *testing.T) {
+	idp := newMockIdP(t)
+	p := idp.provider()
+
+	authCodeURL, err := p.AuthCodeURL("state-1", "nonce-1", "verifier-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authCodeURL, idp.server.URL+"/authorize?") {
+		t.Errorf("AuthCodeURL = %s, want the discovered authorization endpoint", authCodeURL)
+	}
+
+	code := idp.authorize(t, authCodeURL)
+
+	claims, err := p.Exchange(context.Background(), code, "verifier-1", "nonce-1")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+
+	want := OIDCClaims{Subject: "subject-1", Email: "user@example.com", EmailVerified: true, Name: "Mock User"}
+	if *claims != want {
+		t.Errorf("claims = %+v, want %+v", *claims, want)
+	}
+}
+
+func TestOIDCExchangeRejectsWrongVerifier(t *testing.T) {
+	idp := newMockIdP(t)
+	p := idp.provider()
+
+	authCodeURL, err := p.AuthCodeURL("state-1", "nonce-1", "verifier-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := idp.authorize(t, authCodeURL)
+
+	if _, err := p.Exchange(context.Background(), code, "another-verifier", "nonce-1"); err == nil {
+		t.Error("Exchange succeeded with a code verifier that does not match the challenge")
+	}
+}
+
+func TestOIDCExchangeRejectsWrongNonce(t *testing.T) {
+	idp := newMockIdP(t)
+	p := idp.provider()
+
+	authCodeURL, err := p.AuthCodeURL("state-1", "nonce-1", "verifier-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := idp.authorize(t, authCodeURL)
+
+	if _, err := p.Exchange(context.Background(), code, "verifier-1", "nonce-2"); err == nil {
+		t.Error("Exchange succeeded with a different nonce")
+	}
+}
+
+func TestOIDCVerifyIDToken(t *testing.T) {
+	idp := newMockIdP(t)
+
+	tests := []struct {
+		name    string
+		change  func(jwt.MapClaims)
+		kid     string
+		wantErr bool
+	}{
+		{"valid", func(c jwt.MapClaims) {}, mockIdPKeyID, false},
+		{"audience list", func(c jwt.MapClaims) { c["aud"] = []string{"other", mockIdPClientID} }, mockIdPKeyID, false},
+		{"email_verified as string", func(c jwt.MapClaims) { c["email_verified"] = "true" }, mockIdPKeyID, false},
+		{"wrong nonce", func(c jwt.MapClaims) { c["nonce"] = "other" }, mockIdPKeyID, true},
+		{"wrong issuer", func(c jwt.MapClaims) { c["iss"] = "https://evil.example.com" }, mockIdPKeyID, true},
+		{"wrong audience", func(c jwt.MapClaims) { c["aud"] = "other" }, mockIdPKeyID, true},
+		{"wrong authorized party", func(c jwt.MapClaims) { c["azp"] = "other" }, mockIdPKeyID, true},
+		{"expired", func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, mockIdPKeyID, true},
+		{"without exp", func(c jwt.MapClaims) { delete(c, "exp") }, mockIdPKeyID, true},
+		{"without sub", func(c jwt.MapClaims) { delete(c, "sub") }, mockIdPKeyID, true},
+		{"unknown key", func(c jwt.MapClaims) {}, "key-2", true},
+	}
+
+	for _, tt := range tests {
+		p := idp.provider()
+
+		claims := idp.defaultClaims()
+		claims["nonce"] = "nonce-1"
+		tt.change(claims)
+
+		_, err := p.VerifyIDToken(idp.sign(t, claims, tt.kid), "nonce-1")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: VerifyIDToken error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestOIDCVerifyIDTokenRejectsHMAC(t *testing.T) {
+	idp := newMockIdP(t)
+	p := idp.provider()
+
+	claims := idp.defaultClaims()
+	claims["nonce"] = "nonce-1"
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = mockIdPKeyID
+	s, err := token.SignedString([]byte(mockIdPClientID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.VerifyIDToken(s, "nonce-1"); err == nil {
+		t.Error("VerifyIDToken accepted an HS256 token")
+	}
+}
+
+func TestOIDCDiscoveryIssuerMismatch(t *testing.T) {
+	idp := newMockIdP(t)
+
+	p := NewOIDCProvider("mock", OIDCProviderConfig{
+		Issuer:      idp.server.URL + "/",
+		ClientID:    mockIdPClientID,
+		RedirectURL: "https://songs.example.com/oidc/mock/callback",
+	})
+
+	if _, err := p.AuthCodeURL("state-1", "nonce-1", "verifier-1"); err == nil {
+		t.Error("AuthCodeURL accepted a discovery document for another issuer")
+	}
+}
+
+func TestPKCEChallenge(t *testing.T) {
+	// RFC 7636 付録 B の例
+	got := PKCEChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if want := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"; got != want {
+		t.Errorf("PKCEChallenge = %s, want %s", got, want)
+	}
+}
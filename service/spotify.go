@@ -5,11 +5,17 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
 	"golang-songs/model"
+
+	"github.com/pkg/errors"
 )
 
+// SpotifyAPIURL は Spotify Web API の接続先。テストでは偽のサーバーに差し替える
+var SpotifyAPIURL = "https://api.spotify.com"
+
 func GetTracks(token string, title string) (*model.Response, error) {
 
 	values := url.Values{}
@@ -19,7 +25,7 @@ func GetTracks(token string, title string) (*model.Response, error) {
 	values.Add("market", "JP")
 	values.Add("limit", "10")
 
-	req, err := http.NewRequest("GET", "https://api.spotify.com/v1/search", nil)
+	req, err := http.NewRequest("GET", SpotifyAPIURL+"/v1/search", nil)
 	if err != nil {
 		return nil, err
 	}
@@ -57,3 +63,115 @@ func GetTracks(token string, title string) (*model.Response, error) {
 
 	return response, nil
 }
+
+// GetMe はアクセストークンの持ち主の Spotify プロフィールを返す。
+func GetMe(token string) (*model.SpotifyUser, error) {
+	req, err := http.NewRequest("GET", SpotifyAPIURL+"/v1/me", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{
+		Timeout: 15 * time.Second,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("spotify /v1/me returned %d", resp.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var me model.SpotifyUser
+
+	if err := json.Unmarshal(b, &me); err != nil {
+		return nil, err
+	}
+
+	if me.ID == "" {
+		return nil, errors.New("spotify user id is empty")
+	}
+
+	return &me, nil
+}
+
+// spotifyGet は Spotify Web API の path を GET し、レスポンスを v に読み込む。
+func spotifyGet(token string, path string, values url.Values, v interface{}) error {
+	req, err := http.NewRequest("GET", SpotifyAPIURL+path, nil)
+	if err != nil {
+		return err
+	}
+
+	req.URL.RawQuery = values.Encode()
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{
+		Timeout: 15 * time.Second,
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("spotify %s returned %d", path, resp.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// GetTrackGenres は曲のアーティストに Spotify が付けているジャンルを重複なく返す。
+func GetTrackGenres(token string, trackID string) ([]string, error) {
+	var track model.SpotifyTrack
+	if err := spotifyGet(token, "/v1/tracks/"+url.PathEscape(trackID), url.Values{}, &track); err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, artist := range track.Artists {
+		ids = append(ids, artist.ID)
+	}
+	if len(ids) == 0 {
+		return []string{}, nil
+	}
+
+	values := url.Values{}
+	values.Add("ids", strings.Join(ids, ","))
+
+	var artists model.SpotifyArtists
+	if err := spotifyGet(token, "/v1/artists", values, &artists); err != nil {
+		return nil, err
+	}
+
+	genres := []string{}
+	seen := map[string]bool{}
+	for _, artist := range artists.Artists {
+		for _, genre := range artist.Genres {
+			if !seen[genre] {
+				seen[genre] = true
+				genres = append(genres, genre)
+			}
+		}
+	}
+
+	return genres, nil
+}
@@ -0,0 +1,14 @@
+package service
+
+import "strings"
+
+// NormalizeTag はタグを比較するためのキーを返す。先頭の # を除いたうえで、
+// アーティスト名と同じ規則(normalizeName)で表記を揃える。
+func NormalizeTag(tag string) string {
+	return normalizeName(CleanTag(tag))
+}
+
+// CleanTag は表示用のタグ名を返す。先頭の # と前後・連続の空白を取り除く。
+func CleanTag(tag string) string {
+	return cleanName(strings.TrimLeft(cleanName(tag), "#"))
+}
@@ -0,0 +1,312 @@
+package service
+
+import (
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/pkg/errors"
+	"golang.org/x/text/unicode/norm"
+	"gopkg.in/yaml.v2"
+)
+
+// フィルタに引っかかった時の扱い
+const (
+	TextFilterAllow  = ""
+	TextFilterHold   = "hold"
+	TextFilterReject = "reject"
+)
+
+// TextFilterRule は禁止語のルール。words は正規化してから部分一致で、patterns は正規化後の文字列に正規表現で照合する。
+type TextFilterRule struct {
+	Name     string   `yaml:"name"`
+	Action   string   `yaml:"action"`
+	Words    []string `yaml:"words"`
+	Patterns []string `yaml:"patterns"`
+}
+
+// LinkSpamConfig はリンクスパムの判定条件。
+type LinkSpamConfig struct {
+	Action         string   `yaml:"action"`
+	MaxLinks       int      `yaml:"max_links"`
+	BlockedDomains []string `yaml:"blocked_domains"`
+}
+
+// TextFilterConfig は conf/moderation.yml の内容。
+//
+//	variants:
+//	  氏: 死
+//	rules:
+//	  - name: abuse
+//	    action: reject
+//	    words: [しね, 死ね]
+//	link_spam:
+//	  action: hold
+//	  max_links: 2
+//	  blocked_domains: [spam.example.com]
+type TextFilterConfig struct {
+	Variants map[string]string `yaml:"variants"`
+	Rules    []TextFilterRule  `yaml:"rules"`
+	LinkSpam LinkSpamConfig    `yaml:"link_spam"`
+}
+
+// TextFilterResult は判定結果。Action が TextFilterAllow 以外なら Rule に引っかかったルール名が入る。
+type TextFilterResult struct {
+	Action string
+	Rule   string
+}
+
+// TextFilterMetric はルールごとの判定件数。
+type TextFilterMetric struct {
+	Rule    string `json:"rule"`
+	Action  string `json:"action"`
+	Matches int64  `json:"matches"`
+}
+
+// TextFilterStats は管理画面に返すフィルタの状態。
+type TextFilterStats struct {
+	LoadedAt time.Time          `json:"loadedAt"`
+	Checked  int64              `json:"checked"`
+	Rules    []TextFilterMetric `json:"rules"`
+}
+
+const linkSpamRule = "link_spam"
+
+var linkPattern = regexp.MustCompile(`(?i)(https?://|www\.)[^\s]+`)
+
+type compiledTextFilterRule struct {
+	TextFilterRule
+	words    []string
+	patterns []*regexp.Regexp
+}
+
+// TextFilter は曲の説明文やプロフィールのコメントを検査する。
+// ルールは Reload で差し替えられ、判定件数はルール名ごとに数える。
+type TextFilter struct {
+	path string
+
+	mu       sync.RWMutex
+	variants *strings.Replacer
+	rules    []compiledTextFilterRule
+	linkSpam LinkSpamConfig
+	loadedAt time.Time
+
+	metricsMu sync.Mutex
+	checked   int64
+	matches   map[string]int64
+}
+
+// NewTextFilter は path の設定でフィルタを作る。
+// 読み込みに失敗した場合も、何も引っかけないフィルタとエラーを返す。
+func NewTextFilter(path string) (*TextFilter, error) {
+	f := &TextFilter{
+		path:     path,
+		variants: strings.NewReplacer(),
+		matches:  map[string]int64{},
+	}
+
+	return f, f.Reload()
+}
+
+// Reload は設定ファイルを読み直す。失敗した場合はそれまでのルールを使い続ける。
+func (f *TextFilter) Reload() error {
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	var config TextFilterConfig
+	if err := yaml.Unmarshal(b, &config); err != nil {
+		return err
+	}
+
+	variants := []string{}
+	for from, to := range config.Variants {
+		variants = append(variants, from, to)
+	}
+	replacer := strings.NewReplacer(variants...)
+
+	rules := []compiledTextFilterRule{}
+	for _, rule := range config.Rules {
+		if rule.Name == "" {
+			return errors.New("text filter rule: name is required")
+		}
+		if rule.Action != TextFilterHold && rule.Action != TextFilterReject {
+			return errors.Errorf("text filter rule %s: unknown action %q", rule.Name, rule.Action)
+		}
+
+		c := compiledTextFilterRule{TextFilterRule: rule}
+		for _, word := range rule.Words {
+			if w := normalize(replacer, word); w != "" {
+				c.words = append(c.words, w)
+			}
+		}
+		for _, pattern := range rule.Patterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return errors.Wrapf(err, "text filter rule %s", rule.Name)
+			}
+			c.patterns = append(c.patterns, re)
+		}
+
+		rules = append(rules, c)
+	}
+
+	if config.LinkSpam.Action != "" && config.LinkSpam.Action != TextFilterHold && config.LinkSpam.Action != TextFilterReject {
+		return errors.Errorf("link_spam: unknown action %q", config.LinkSpam.Action)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.variants = replacer
+	f.rules = rules
+	f.linkSpam = config.LinkSpam
+	f.loadedAt = time.Now()
+
+	return nil
+}
+
+// Check は texts をまとめて検査し、最も重い判定を返す。
+func (f *TextFilter) Check(texts ...string) TextFilterResult {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	result := TextFilterResult{}
+	matched := map[string]bool{}
+
+	apply := func(action string, rule string) {
+		matched[rule] = true
+		if result.Action != TextFilterReject {
+			result = TextFilterResult{Action: action, Rule: rule}
+		}
+	}
+
+	for _, text := range texts {
+		if text == "" {
+			continue
+		}
+
+		normalized := normalize(f.variants, text)
+
+		for _, rule := range f.rules {
+			if matched[rule.Name] {
+				continue
+			}
+			if rule.match(normalized) {
+				apply(rule.Action, rule.Name)
+			}
+		}
+
+		if f.linkSpam.Action != "" && !matched[linkSpamRule] && f.isLinkSpam(norm.NFKC.String(text)) {
+			apply(f.linkSpam.Action, linkSpamRule)
+		}
+	}
+
+	f.metricsMu.Lock()
+	f.checked++
+	for rule := range matched {
+		f.matches[rule]++
+	}
+	f.metricsMu.Unlock()
+
+	return result
+}
+
+// Stats はルールごとの判定件数を返す。
+func (f *TextFilter) Stats() TextFilterStats {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	f.metricsMu.Lock()
+	defer f.metricsMu.Unlock()
+
+	stats := TextFilterStats{LoadedAt: f.loadedAt, Checked: f.checked, Rules: []TextFilterMetric{}}
+	for _, rule := range f.rules {
+		stats.Rules = append(stats.Rules, TextFilterMetric{Rule: rule.Name, Action: rule.Action, Matches: f.matches[rule.Name]})
+	}
+	if f.linkSpam.Action != "" {
+		stats.Rules = append(stats.Rules, TextFilterMetric{Rule: linkSpamRule, Action: f.linkSpam.Action, Matches: f.matches[linkSpamRule]})
+	}
+
+	return stats
+}
+
+func (r compiledTextFilterRule) match(normalized string) bool {
+	for _, word := range r.words {
+		if strings.Contains(normalized, word) {
+			return true
+		}
+	}
+
+	for _, re := range r.patterns {
+		if re.MatchString(normalized) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *TextFilter) isLinkSpam(text string) bool {
+	links := linkPattern.FindAllString(text, -1)
+
+	if f.linkSpam.MaxLinks > 0 && len(links) > f.linkSpam.MaxLinks {
+		return true
+	}
+
+	for _, link := range links {
+		if !strings.Contains(link, "://") {
+			link = "http://" + link
+		}
+		u, err := url.Parse(link)
+		if err != nil {
+			continue
+		}
+
+		host := strings.ToLower(u.Hostname())
+		for _, domain := range f.linkSpam.BlockedDomains {
+			domain = strings.ToLower(domain)
+			if host == domain || strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// normalize は表記ゆれによるすり抜けを防ぐため、比較用の文字列を作る。
+// NFKC で全角英数字・半角カナを揃え、カタカナをひらがなに、異体字を設定の字に寄せ、
+// 間に挟んだ空白や記号を取り除く。
+func normalize(variants *strings.Replacer, s string) string {
+	s = norm.NFKC.String(s)
+	s = strings.ToLower(s)
+	s = variants.Replace(s)
+
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == 'ー':
+			b.WriteRune(r)
+		case unicode.IsSpace(r), unicode.IsPunct(r), unicode.IsSymbol(r):
+		default:
+			b.WriteRune(foldKana(r))
+		}
+	}
+
+	return b.String()
+}
+
+// foldKana はカタカナをひらがなに寄せる。
+func foldKana(r rune) rune {
+	if r >= 'ァ' && r <= 'ヶ' {
+		return r - 'ァ' + 'ぁ'
+	}
+
+	return r
+}
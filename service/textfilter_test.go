@@ -0,0 +1,138 @@
+package service
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNormalize(t *testing.T) {
+	variants := strings.NewReplacer("氏", "死")
+
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"ＡＢＣ１２３", "abc123"},
+		{"ｼﾈ", "しね"},
+		{"シネ", "しね"},
+		{"し ね", "しね"},
+		{"し.ね!", "しね"},
+		{"し★ね", "しね"},
+		{"氏ね", "死ね"},
+		{"ラーメン", "らーめん"},
+		{"Hello World", "helloworld"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := normalize(variants, tt.in); got != tt.want {
+			t.Errorf("normalize(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func newTestTextFilter(t *testing.T, config string) *TextFilter {
+	dir, err := ioutil.TempDir("", "textfilter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	path := filepath.Join(dir, "moderation.yml")
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewTextFilter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func TestTextFilterCheck(t *testing.T) {
+	f := newTestTextFilter(t, `
+variants:
+  氏: 死
+rules:
+  - name: abuse
+    action: reject
+    words: [死ね]
+  - name: contact
+    action: hold
+    patterns: ['\d{3}\d{4}\d{4}']
+link_spam:
+  action: hold
+  max_links: 2
+  blocked_domains: [spam.example.com]
+`)
+
+	tests := []struct {
+		name  string
+		texts []string
+		want  TextFilterResult
+	}{
+		{"clean", []string{"いい曲です"}, TextFilterResult{}},
+		{"word", []string{"死ね"}, TextFilterResult{Action: TextFilterReject, Rule: "abuse"}},
+		{"variant", []string{"氏ね"}, TextFilterResult{Action: TextFilterReject, Rule: "abuse"}},
+		{"spaced", []string{"死 ね"}, TextFilterResult{Action: TextFilterReject, Rule: "abuse"}},
+		{"full width pattern", []string{"０９０-１２３４-５６７８"}, TextFilterResult{Action: TextFilterHold, Rule: "contact"}},
+		{"too many links", []string{"http://a.example.com http://b.example.com http://c.example.com"}, TextFilterResult{Action: TextFilterHold, Rule: linkSpamRule}},
+		{"blocked domain", []string{"www.spam.example.com/x"}, TextFilterResult{Action: TextFilterHold, Rule: linkSpamRule}},
+		{"blocked subdomain", []string{"https://a.spam.example.com"}, TextFilterResult{Action: TextFilterHold, Rule: linkSpamRule}},
+		{"similar domain", []string{"https://notspam.example.com"}, TextFilterResult{}},
+		{"reject wins over hold", []string{"０９０１２３４５６７８", "死ね"}, TextFilterResult{Action: TextFilterReject, Rule: "abuse"}},
+		{"empty", []string{""}, TextFilterResult{}},
+	}
+
+	for _, tt := range tests {
+		if got := f.Check(tt.texts...); got != tt.want {
+			t.Errorf("%s: Check = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTextFilterReloadKeepsRulesOnError(t *testing.T) {
+	f := newTestTextFilter(t, `
+rules:
+  - name: abuse
+    action: reject
+    words: [死ね]
+`)
+
+	if err := ioutil.WriteFile(f.path, []byte("rules:\n  - name: broken\n    action: delete\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Reload(); err == nil {
+		t.Fatal("Reload accepted an unknown action")
+	}
+
+	if got := f.Check("死ね"); got.Rule != "abuse" {
+		t.Errorf("Check after failed reload = %+v, want the previous rules", got)
+	}
+}
+
+func TestTextFilterStats(t *testing.T) {
+	f := newTestTextFilter(t, `
+rules:
+  - name: abuse
+    action: reject
+    words: [死ね]
+`)
+
+	f.Check("死ね")
+	f.Check("死ね", "死ね")
+	f.Check("いい曲")
+
+	stats := f.Stats()
+	if stats.Checked != 3 {
+		t.Errorf("Checked = %d, want 3", stats.Checked)
+	}
+	if len(stats.Rules) != 1 || stats.Rules[0].Matches != 2 {
+		t.Errorf("Rules = %+v, want abuse matched twice", stats.Rules)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"golang-songs/model"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+// startSession はログインした端末のセッションを記録し、それに紐づく JWT を発行する。
+func startSession(db *gorm.DB, user model.User, r *http.Request) (string, error) {
+	jti, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+
+	if err := db.Create(&model.Session{
+		UserID:     user.ID,
+		Jti:        jti,
+		UserAgent:  userAgent,
+		IP:         clientIP(r),
+		LastSeenAt: time.Now()}).Error; err != nil {
+		return "", err
+	}
+
+	return createToken(user, jti)
+}
+
+// revokeSessions はユーザーの全セッションを失効させる。
+func revokeSessions(db *gorm.DB, userID uint) error {
+	return db.Where("user_id = ?", userID).Delete(&model.Session{}).Error
+}
+
+type SessionsHandler struct {
+	DB *gorm.DB
+}
+
+// リクエストユーザーのログイン中の端末一覧を返す
+func (f *SessionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ac, ok := r.Context().Value(authKey).(*authContext)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	sessions := []model.Session{}
+
+	if err := f.DB.Where("user_id = ?", ac.User.ID).Order("last_seen_at desc").Find(&sessions).Error; err != nil {
+		var error model.Error
+		error.Message = "セッション一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == ac.SessionID
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	v, err := json.Marshal(sessions)
+	if err != nil {
+		var error model.Error
+		error.Message = "JSONへの変換に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if _, err := w.Write(v); err != nil {
+		var error model.Error
+		error.Message = "セッション一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type RevokeSessionHandler struct {
+	DB *gorm.DB
+}
+
+// 指定した端末をログアウトさせる
+func (f *RevokeSessionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, ok := vars["id"]
+	if !ok {
+		var error model.Error
+		error.Message = "idの取得に失敗しました"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	result := f.DB.Where("id = ? AND user_id = ?", id, user.ID).Delete(&model.Session{})
+	if result.Error != nil {
+		var error model.Error
+		error.Message = "セッションの削除に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if result.RowsAffected == 0 {
+		var error model.Error
+		error.Message = "該当するセッションが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+}
+
+type LogoutHandler struct {
+	DB *gorm.DB
+}
+
+// リクエストに使われたセッションをログアウトさせる
+func (f *LogoutHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ac, ok := r.Context().Value(authKey).(*authContext)
+	if !ok || ac.SessionID == 0 {
+		var error model.Error
+		error.Message = "セッションが見つかりません。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	if err := f.DB.Where("id = ?", ac.SessionID).Delete(&model.Session{}).Error; err != nil {
+		var error model.Error
+		error.Message = "セッションの削除に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+// writeLoginResponse は認証済みのユーザーに JWT を返す。
+// 二段階認証が有効な場合は、代わりにコード入力用のチャレンジトークンを返す。
+func writeLoginResponse(w http.ResponseWriter, r *http.Request, db *gorm.DB, user model.User) {
+	if user.SuspendedAt != nil {
+		var error model.Error
+		error.Message = "このアカウントは利用停止中です。"
+		errorInResponse(w, http.StatusForbidden, error)
+		return
+	}
+
+	var body interface{}
+
+	if user.TOTPEnabled {
+		challengeToken, err := createChallengeToken(user)
+		if err != nil {
+			var error model.Error
+			error.Message = "トークンの作成に失敗しました"
+			errorInResponse(w, http.StatusUnauthorized, error)
+			return
+		}
+
+		body = model.TwoFactorChallenge{
+			TwoFactorRequired: true,
+			ChallengeToken:    challengeToken}
+	} else {
+		//トークン作成
+		token, err := startSession(db, user, r)
+		if err != nil {
+			var error model.Error
+			error.Message = "トークンの作成に失敗しました"
+			errorInResponse(w, http.StatusUnauthorized, error)
+			return
+		}
+
+		body = model.JWT{Token: token}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	v, err := json.Marshal(body)
+	if err != nil {
+		var error model.Error
+		error.Message = "JSONへの変換に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if _, err := w.Write(v); err != nil {
+		var error model.Error
+		error.Message = "JWTトークンの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
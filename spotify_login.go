@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"golang-songs/model"
+	"golang-songs/service"
+	"net/http"
+	"os"
+
+	"github.com/jinzhu/gorm"
+	"golang.org/x/oauth2"
+)
+
+// SpotifyAccountsURL は Spotify の認可サーバー。テストでは偽のサーバーに差し替える
+var SpotifyAccountsURL = "https://accounts.spotify.com"
+
+// ログイン・連携用の設定
+// 曲検索用(controller.GetRedirectURL)とは別のリダイレクト先を使えるようにする
+func spotifyLoginConfig() oauth2.Config {
+	redirectURL := os.Getenv("spotify_login_redirect_url")
+	if redirectURL == "" {
+		redirectURL = os.Getenv("redirect_url")
+	}
+
+	return oauth2.Config{
+		ClientID:     os.Getenv("client_id"),
+		ClientSecret: os.Getenv("client_secret"),
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  SpotifyAccountsURL + "/authorize",
+			TokenURL: SpotifyAccountsURL + "/api/token",
+		},
+		RedirectURL: redirectURL,
+		Scopes:      []string{"user-read-email"},
+	}
+}
+
+// spotifyCookiePath はログインを始めたブラウザを示す Cookie を送る範囲
+const spotifyCookiePath = "/api/spotify/"
+
+// spotifyProfile は state を検証して code を交換し、Spotify のプロフィールを返す。
+// state はログインを始めたブラウザからの1回しか使えない。
+func spotifyProfile(db *gorm.DB, r *http.Request, d model.OAuthCallbackForm, mode string) (*model.SpotifyUser, map[string]string, error) {
+	state, err := parseStateToken(d.State)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if state["provider"] != "spotify" || state["mode"] != mode {
+		return nil, nil, errInvalidActionToken
+	}
+
+	loginState, err := consumeOAuthLogin(db, r, state["jti"], "spotify")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := spotifyLoginConfig()
+
+	token, err := config.Exchange(context.TODO(), d.Code, oauth2.SetAuthURLParam("code_verifier", loginState.CodeVerifier))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	me, err := service.GetMe(token.AccessToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return me, state, nil
+}
+
+type SpotifyLoginURLHandler struct {
+	DB   *gorm.DB
+	Link bool
+}
+
+// Spotify の認可画面のURLを返す
+// Link の場合はリクエストユーザーへの連携用のURLになる
+// ログインを始めたブラウザに HttpOnly の Cookie を付けるので、クライアントは Cookie 付きで呼ぶ
+func (f *SpotifyLoginURLHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	values := map[string]string{"provider": "spotify", "mode": "login"}
+
+	if f.Link {
+		user, ok := authUser(r)
+		if !ok {
+			var error model.Error
+			error.Message = "該当するアカウントが見つかりません。"
+			errorInResponse(w, http.StatusUnauthorized, error)
+			return
+		}
+
+		values["mode"] = "link"
+		values["user"] = fmt.Sprint(user.ID)
+	}
+
+	jti, verifier, _, binding, err := startOAuthLogin(f.DB, "spotify")
+	if err != nil {
+		var error model.Error
+		error.Message = "stateの作成に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+	values["jti"] = jti
+
+	state, err := createStateToken(values)
+	if err != nil {
+		var error model.Error
+		error.Message = "stateの作成に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	config := spotifyLoginConfig()
+
+	url := config.AuthCodeURL(state,
+		oauth2.SetAuthURLParam("code_challenge", service.PKCEChallenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
+
+	setBindingCookie(w, r, spotifyCookiePath, binding)
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Encodeを用いたJson変換
+	encoder := json.NewEncoder(w)
+	//自動エスケープを無効に
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(url); err != nil {
+		var error model.Error
+		error.Message = "JSONへの変換に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type SpotifyLoginHandler struct {
+	DB *gorm.DB
+}
+
+// Spotify アカウントでログインする
+// 連携済みのユーザーが無ければ新しく作る
+func (f *SpotifyLoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dec := json.NewDecoder(r.Body)
+	var d model.OAuthCallbackForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	me, _, err := spotifyProfile(f.DB, r, d, "login")
+	clearBindingCookie(w, r, spotifyCookiePath)
+	if err != nil {
+		var error model.Error
+		error.Message = "Spotifyの認証に失敗しました。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	var user model.User
+	err = f.DB.Where("spotify_id = ?", me.ID).Find(&user).Error
+	if err != nil && !gorm.IsRecordNotFoundError(err) {
+		var error model.Error
+		error.Message = "ユーザー情報の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if gorm.IsRecordNotFoundError(err) {
+		if me.Email == "" {
+			var error model.Error
+			error.Message = "SpotifyアカウントのEmailが取得できません。"
+			errorInResponse(w, http.StatusBadRequest, error)
+			return
+		}
+
+		// Spotify 側のメールアドレスは確認済みとは限らないので、既存のアカウントには自動で連携しない
+		var count int
+		if err := f.DB.Model(&model.User{}).Where("email = ?", me.Email).Count(&count).Error; err != nil {
+			var error model.Error
+			error.Message = "ユーザー情報の取得に失敗しました。"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+
+		if count > 0 {
+			var error model.Error
+			error.Message = "このEmailのアカウントが既にあります。ログインしてからSpotifyと連携してください。"
+			errorInResponse(w, http.StatusConflict, error)
+			return
+		}
+
+		user = model.User{
+			Email:     me.Email,
+			Name:      me.DisplayName,
+			SpotifyID: &me.ID,
+		}
+		if len(me.Images) > 0 {
+			user.ImageUrl = me.Images[0].URL
+		}
+
+		// パスワードは空のままにし、パスワードでのログインはできないようにする
+		if err := f.DB.Create(&user).Error; err != nil {
+			var error model.Error
+			error.Message = "アカウントの作成に失敗しました"
+			errorInResponse(w, http.StatusInternalServerError, error)
+			return
+		}
+	}
+
+	writeLoginResponse(w, r, f.DB, user)
+}
+
+type LinkSpotifyHandler struct {
+	DB *gorm.DB
+}
+
+// リクエストユーザーに Spotify アカウントを連携する
+func (f *LinkSpotifyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.OAuthCallbackForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	me, state, err := spotifyProfile(f.DB, r, d, "link")
+	clearBindingCookie(w, r, spotifyCookiePath)
+	if err != nil || state["user"] != fmt.Sprint(user.ID) {
+		var error model.Error
+		error.Message = "Spotifyの認証に失敗しました。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	var count int
+	if err := f.DB.Model(&model.User{}).Where("spotify_id = ? AND id <> ?", me.ID, user.ID).Count(&count).Error; err != nil {
+		var error model.Error
+		error.Message = "ユーザー情報の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if count > 0 {
+		var error model.Error
+		error.Message = "このSpotifyアカウントは別のユーザーに連携されています。"
+		errorInResponse(w, http.StatusConflict, error)
+		return
+	}
+
+	if err := f.DB.Model(&user).Update("spotify_id", me.ID).Error; err != nil {
+		var error model.Error
+		error.Message = "Spotifyとの連携に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type UnlinkSpotifyHandler struct {
+	DB *gorm.DB
+}
+
+func (f *UnlinkSpotifyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	if user.SpotifyID == nil {
+		var error model.Error
+		error.Message = "Spotifyと連携されていません。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	// ログインする手段が無くならないようにする
+	if user.Password == "" {
+		var error model.Error
+		error.Message = "パスワードを設定してから連携を解除してください。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	if err := f.DB.Model(&user).Update("spotify_id", gorm.Expr("NULL")).Error; err != nil {
+		var error model.Error
+		error.Message = "Spotifyとの連携の解除に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
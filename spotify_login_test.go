@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"golang-songs/model"
+	"golang-songs/service"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jinzhu/gorm"
+)
+
+const fakeSpotifyAccessToken = "fake-access-token"
+
+// fakeSpotify は Spotify の認可サーバーと Web API の代わりをするサーバー。
+// 認可画面は無いので、authorize で認可URLの code_challenge に対する code を発行する。
+type fakeSpotify struct {
+	server *httptest.Server
+
+	mu    sync.Mutex
+	next  int
+	codes map[string]string
+	me    model.SpotifyUser
+}
+
+// newFakeSpotify は偽のサーバーを立て、向き先を差し替える。
+func newFakeSpotify(t *testing.T, me model.SpotifyUser) *fakeSpotify {
+	fake := &fakeSpotify{codes: map[string]string{}, me: me}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		fake.mu.Lock()
+		challenge, ok := fake.codes[r.PostForm.Get("code")]
+		delete(fake.codes, r.PostForm.Get("code"))
+		fake.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if !ok || service.PKCEChallenge(r.PostForm.Get("code_verifier")) != challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fakeSpotifyAccessToken,
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+	})
+	mux.HandleFunc("/v1/me", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+fakeSpotifyAccessToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		json.NewEncoder(w).Encode(fake.me)
+	})
+
+	fake.server = httptest.NewServer(mux)
+
+	accountsURL, apiURL := SpotifyAccountsURL, service.SpotifyAPIURL
+	SpotifyAccountsURL, service.SpotifyAPIURL = fake.server.URL, fake.server.URL
+	t.Cleanup(func() {
+		SpotifyAccountsURL, service.SpotifyAPIURL = accountsURL, apiURL
+		fake.server.Close()
+	})
+
+	return fake
+}
+
+// authorize はユーザーが認可画面で同意したものとして code を発行する。
+func (fake *fakeSpotify) authorize(t *testing.T, authCodeURL string) string {
+	u, err := url.Parse(authCodeURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("code_challenge_method") != "S256" {
+		t.Errorf("code_challenge_method = %q, want S256", u.Query().Get("code_challenge_method"))
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.next++
+	code := fmt.Sprintf("code-%d", fake.next)
+	fake.codes[code] = u.Query().Get("code_challenge")
+
+	return code
+}
+
+func newSpotifyTestDB(t *testing.T) *gorm.DB {
+	return newTestDB(t, &model.User{}, &model.Session{}, &model.OAuthLoginState{})
+}
+
+// spotifyLogin は r で認可URLを取得して同意するところまで進め、コールバックに渡す値とブラウザの Cookie を返す。
+func spotifyLogin(t *testing.T, fake *fakeSpotify, handler http.Handler, r *http.Request) (model.OAuthCallbackForm, *http.Cookie) {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login-url status = %d, want 200: %s", w.Code, w.Body)
+	}
+
+	var raw string
+	if err := json.NewDecoder(w.Body).Decode(&raw); err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == loginBindingCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("login-url did not set the binding cookie")
+	}
+
+	return model.OAuthCallbackForm{Code: fake.authorize(t, raw), State: u.Query().Get("state")}, cookie
+}
+
+func spotifyCallback(d model.OAuthCallbackForm, cookie *http.Cookie) *http.Request {
+	b, _ := json.Marshal(d)
+	r := httptest.NewRequest("POST", "/api/spotify/login", strings.NewReader(string(b)))
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+
+	return r
+}
+
+func TestSpotifyLoginURL(t *testing.T) {
+	db := newSpotifyTestDB(t)
+	newFakeSpotify(t, model.SpotifyUser{ID: "spotify-user"})
+
+	w := httptest.NewRecorder()
+	(&SpotifyLoginURLHandler{DB: db}).ServeHTTP(w, httptest.NewRequest("GET", "/api/spotify/login-url", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+
+	var raw string
+	if err := json.NewDecoder(w.Body).Decode(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(raw, SpotifyAccountsURL+"/authorize") {
+		t.Errorf("url = %s, want the fake authorize endpoint", raw)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := parseStateToken(u.Query().Get("state"))
+	if err != nil {
+		t.Fatalf("state is not a valid state token: %v", err)
+	}
+	if state["provider"] != "spotify" || state["mode"] != "login" || state["jti"] == "" {
+		t.Errorf("state = %v, want spotify login with a jti", state)
+	}
+
+	// code_verifier は state に入れずサーバーに保存する
+	var loginState model.OAuthLoginState
+	if err := db.Where("jti = ?", state["jti"]).Find(&loginState).Error; err != nil {
+		t.Fatalf("login state was not stored: %v", err)
+	}
+	if u.Query().Get("code_challenge") != service.PKCEChallenge(loginState.CodeVerifier) {
+		t.Error("code_challenge does not match the stored code_verifier")
+	}
+
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != loginBindingCookie || !cookies[0].HttpOnly || cookies[0].Path != spotifyCookiePath {
+		t.Fatalf("cookies = %+v, want an HttpOnly binding cookie for %s", cookies, spotifyCookiePath)
+	}
+	if loginState.BindingHash != hashBinding(cookies[0].Value) {
+		t.Error("stored binding hash does not match the cookie")
+	}
+}
+
+func TestSpotifyProfile(t *testing.T) {
+	db := newSpotifyTestDB(t)
+	fake := newFakeSpotify(t, model.SpotifyUser{ID: "spotify-user", DisplayName: "Spotify User", Email: "user@example.com"})
+	login := &SpotifyLoginURLHandler{DB: db}
+
+	d, cookie := spotifyLogin(t, fake, login, httptest.NewRequest("GET", "/api/spotify/login-url", nil))
+	me, _, err := spotifyProfile(db, spotifyCallback(d, cookie), d, "login")
+	if err != nil {
+		t.Fatalf("spotifyProfile: %v", err)
+	}
+	if me.ID != "spotify-user" || me.Email != "user@example.com" {
+		t.Errorf("profile = %+v", me)
+	}
+
+	// 同じ state は二度使えない
+	if _, _, err := spotifyProfile(db, spotifyCallback(d, cookie), d, "login"); err == nil {
+		t.Error("spotifyProfile accepted a state that was already used")
+	}
+}
+
+func TestSpotifyProfileRejects(t *testing.T) {
+	db := newSpotifyTestDB(t)
+	fake := newFakeSpotify(t, model.SpotifyUser{ID: "spotify-user"})
+	login := &SpotifyLoginURLHandler{DB: db}
+
+	tests := []struct {
+		name   string
+		change func(d *model.OAuthCallbackForm, cookie **http.Cookie)
+		mode   string
+	}{
+		{"without cookie", func(d *model.OAuthCallbackForm, cookie **http.Cookie) { *cookie = nil }, "login"},
+		{"cookie of another browser", func(d *model.OAuthCallbackForm, cookie **http.Cookie) {
+			*cookie = &http.Cookie{Name: loginBindingCookie, Value: "another-browser"}
+		}, "login"},
+		{"login state used for link", func(d *model.OAuthCallbackForm, cookie **http.Cookie) {}, "link"},
+		{"tampered state", func(d *model.OAuthCallbackForm, cookie **http.Cookie) { d.State += "x" }, "login"},
+		{"state without a stored row", func(d *model.OAuthCallbackForm, cookie **http.Cookie) {
+			s, err := createStateToken(map[string]string{"provider": "spotify", "mode": "login", "jti": "unknown"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			d.State = s
+		}, "login"},
+		{"bad code", func(d *model.OAuthCallbackForm, cookie **http.Cookie) { d.Code = "bad-code" }, "login"},
+	}
+
+	for _, tt := range tests {
+		d, cookie := spotifyLogin(t, fake, login, httptest.NewRequest("GET", "/api/spotify/login-url", nil))
+		tt.change(&d, &cookie)
+
+		if _, _, err := spotifyProfile(db, spotifyCallback(d, cookie), d, tt.mode); err == nil {
+			t.Errorf("%s: spotifyProfile succeeded, want an error", tt.name)
+		}
+	}
+}
+
+func TestSpotifyProfileWithoutID(t *testing.T) {
+	db := newSpotifyTestDB(t)
+	fake := newFakeSpotify(t, model.SpotifyUser{})
+
+	d, cookie := spotifyLogin(t, fake, &SpotifyLoginURLHandler{DB: db}, httptest.NewRequest("GET", "/api/spotify/login-url", nil))
+	if _, _, err := spotifyProfile(db, spotifyCallback(d, cookie), d, "login"); err == nil {
+		t.Error("spotifyProfile accepted a profile without an id")
+	}
+}
+
+func serveSpotifyCallback(handler http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	return w
+}
+
+func TestSpotifyLoginCreatesUser(t *testing.T) {
+	db := newSpotifyTestDB(t)
+	fake := newFakeSpotify(t, model.SpotifyUser{ID: "spotify-user", DisplayName: "Spotify User", Email: "user@example.com"})
+	login := &SpotifyLoginURLHandler{DB: db}
+	callback := &SpotifyLoginHandler{DB: db}
+
+	for i := 0; i < 2; i++ {
+		d, cookie := spotifyLogin(t, fake, login, httptest.NewRequest("GET", "/api/spotify/login-url", nil))
+		w := serveSpotifyCallback(callback, spotifyCallback(d, cookie))
+		if w.Code != http.StatusOK {
+			t.Fatalf("login %d: status = %d, want 200: %s", i+1, w.Code, w.Body)
+		}
+
+		var token model.JWT
+		if err := json.NewDecoder(w.Body).Decode(&token); err != nil || token.Token == "" {
+			t.Fatalf("login %d: response has no token: %v", i+1, err)
+		}
+	}
+
+	// 2回目は同じ Spotify ID のユーザーでログインする
+	var users []model.User
+	if err := db.Find(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 {
+		t.Fatalf("len(users) = %d, want 1", len(users))
+	}
+	if users[0].SpotifyID == nil || *users[0].SpotifyID != "spotify-user" || users[0].Email != "user@example.com" || users[0].Password != "" {
+		t.Errorf("user = %+v, want a passwordless user linked to spotify-user", users[0])
+	}
+
+	var sessions int
+	if err := db.Model(&model.Session{}).Where("user_id = ?", users[0].ID).Count(&sessions).Error; err != nil {
+		t.Fatal(err)
+	}
+	if sessions != 2 {
+		t.Errorf("sessions = %d, want 2", sessions)
+	}
+}
+
+func TestSpotifyLoginEmailConflict(t *testing.T) {
+	db := newSpotifyTestDB(t)
+	fake := newFakeSpotify(t, model.SpotifyUser{ID: "spotify-user", Email: "user@example.com"})
+
+	existing := model.User{Email: "user@example.com", Name: "existing", Password: "hash"}
+	if err := db.Create(&existing).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	d, cookie := spotifyLogin(t, fake, &SpotifyLoginURLHandler{DB: db}, httptest.NewRequest("GET", "/api/spotify/login-url", nil))
+	w := serveSpotifyCallback(&SpotifyLoginHandler{DB: db}, spotifyCallback(d, cookie))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("status = %d, want 409: %s", w.Code, w.Body)
+	}
+
+	// 確認されていないメールアドレスで既存のアカウントに連携しない
+	var user model.User
+	if err := db.Where("id = ?", existing.ID).Find(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if user.SpotifyID != nil {
+		t.Errorf("existing user was linked to %s", *user.SpotifyID)
+	}
+
+	var count int
+	if err := db.Model(&model.User{}).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("users = %d, want 1", count)
+	}
+}
+
+func TestLinkSpotify(t *testing.T) {
+	db := newSpotifyTestDB(t)
+	fake := newFakeSpotify(t, model.SpotifyUser{ID: "spotify-user", Email: "other@example.com"})
+
+	alice := model.User{Email: "alice@example.com", Name: "alice", Password: "hash"}
+	bob := model.User{Email: "bob@example.com", Name: "bob", Password: "hash"}
+	for _, u := range []*model.User{&alice, &bob} {
+		if err := db.Create(u).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	linkURL := &SpotifyLoginURLHandler{DB: db, Link: true}
+	link := &LinkSpotifyHandler{DB: db}
+
+	start := func(user model.User) (model.OAuthCallbackForm, *http.Cookie) {
+		return spotifyLogin(t, fake, linkURL, withAuthUser(httptest.NewRequest("GET", "/api/spotify/link-url", nil), user))
+	}
+
+	// 別のユーザーが始めた連携の state は使えない
+	d, cookie := start(alice)
+	if w := serveSpotifyCallback(link, withAuthUser(spotifyCallback(d, cookie), bob)); w.Code != http.StatusUnauthorized {
+		t.Errorf("link with another user's state: status = %d, want 401", w.Code)
+	}
+
+	d, cookie = start(alice)
+	if w := serveSpotifyCallback(link, withAuthUser(spotifyCallback(d, cookie), alice)); w.Code != http.StatusOK {
+		t.Fatalf("link: status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if err := db.Where("id = ?", alice.ID).Find(&alice).Error; err != nil {
+		t.Fatal(err)
+	}
+	if alice.SpotifyID == nil || *alice.SpotifyID != "spotify-user" {
+		t.Fatalf("alice.SpotifyID = %v, want spotify-user", alice.SpotifyID)
+	}
+
+	// 同じ Spotify アカウントは別のユーザーに連携できない
+	d, cookie = start(bob)
+	if w := serveSpotifyCallback(link, withAuthUser(spotifyCallback(d, cookie), bob)); w.Code != http.StatusConflict {
+		t.Errorf("link conflict: status = %d, want 409", w.Code)
+	}
+	if err := db.Where("id = ?", bob.ID).Find(&bob).Error; err != nil {
+		t.Fatal(err)
+	}
+	if bob.SpotifyID != nil {
+		t.Errorf("bob was linked to %s", *bob.SpotifyID)
+	}
+}
+
+func TestUnlinkSpotify(t *testing.T) {
+	db := newSpotifyTestDB(t)
+	spotifyID := "spotify-user"
+
+	tests := []struct {
+		name       string
+		user       model.User
+		want       int
+		wantLinked bool
+	}{
+		{"without password", model.User{Email: "a@example.com", Name: "a", SpotifyID: &spotifyID}, http.StatusBadRequest, true},
+		{"not linked", model.User{Email: "b@example.com", Name: "b", Password: "hash"}, http.StatusBadRequest, false},
+		{"with password", model.User{Email: "c@example.com", Name: "c", Password: "hash", SpotifyID: &spotifyID}, http.StatusOK, false},
+	}
+
+	for _, tt := range tests {
+		user := tt.user
+		if err := db.Create(&user).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		(&UnlinkSpotifyHandler{DB: db}).ServeHTTP(w, withAuthUser(httptest.NewRequest("POST", "/api/spotify/unlink", nil), user))
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+
+		if err := db.Where("id = ?", user.ID).Find(&user).Error; err != nil {
+			t.Fatal(err)
+		}
+		if (user.SpotifyID != nil) != tt.wantLinked {
+			t.Errorf("%s: linked = %v, want %v", tt.name, user.SpotifyID != nil, tt.wantLinked)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"golang-songs/model"
+	"golang-songs/service"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/jinzhu/gorm"
+)
+
+// ストリームで配るイベントの種類
+const (
+	streamNotification = "notification"
+	streamTimeline     = "timeline"
+	// streamResync は再送しきれなかったことを知らせる。クライアントは一覧を取り直す
+	streamResync = "resync"
+)
+
+const (
+	streamHeartbeat = 25 * time.Second
+	// streamWriteTimeout までに書き込めない遅いクライアントは切断する
+	streamWriteTimeout = 10 * time.Second
+)
+
+// チケットはログインしたクライアントしか発行できず一度しか使えないので、
+// Cookie のようにほかのサイトから勝手に使われることはない
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// publishOrLog はイベントを配る。届かなくても元の操作は成功とし、ログに残すだけにする。
+func publishOrLog(hub *service.Hub, userID uint, typ string, data interface{}) {
+	if err := hub.Publish(userID, typ, data); err != nil {
+		log.Println(err)
+	}
+}
+
+// publishSongToFollowers は新しい曲をフォロワーのタイムラインに流す。
+// 投稿者をミュート・ブロックしているフォロワーには送らない。
+func publishSongToFollowers(db *gorm.DB, hub *service.Hub, song model.Song) error {
+	var follows []model.UserFollow
+	if err := db.Where("follow_id = ?", song.UserID).Find(&follows).Error; err != nil {
+		return err
+	}
+
+	for _, follow := range follows {
+		hiddenIDs, err := hiddenUserIDs(db, follow.UserID)
+		if err != nil {
+			return err
+		}
+		if hasUserID(hiddenIDs, song.UserID) {
+			continue
+		}
+
+		publishOrLog(hub, follow.UserID, streamTimeline, song)
+	}
+
+	return nil
+}
+
+func hasUserID(ids []uint, id uint) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+type StreamTicketHandler struct {
+	DB *gorm.DB
+}
+
+// ストリームに繋ぐためのチケットを発行する。EventSource や WebSocket はヘッダーを付けられないので、
+// ログインの JWT の代わりにこのチケットをクエリの ticket で渡す
+func (f *StreamTicketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ac, ok := r.Context().Value(authKey).(*authContext)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	ticket, err := createActionTokenWith(f.DB, ac.User, tokenPurposeStream, streamTicketTTL, streamTicketValues(ac))
+	if err != nil {
+		var error model.Error
+		error.Message = "チケットの発行に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, map[string]string{"ticket": ticket})
+}
+
+type StreamHandler struct {
+	DB  *gorm.DB
+	Hub *service.Hub
+}
+
+// お知らせとタイムラインのイベントを流す。Upgrade ヘッダーがあれば WebSocket、無ければ SSE で返す
+// Last-Event-ID(またはクエリの lastEventId)を指定すると、その後のイベントから再送する
+// 接続中もハートビートのたびにセッションを確かめ、ログアウトや利用停止、パスワード変更で失効したら切断する
+func (f *StreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ac, ok := r.Context().Value(authKey).(*authContext)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	var after uint64
+	if lastEventID != "" {
+		id, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			var error model.Error
+			error.Message = "Last-Event-IDの形式が正しくありません。"
+			errorInResponse(w, http.StatusBadRequest, error)
+			return
+		}
+		after = id
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		f.serveWebSocket(w, r, ac, after)
+		return
+	}
+
+	f.serveSSE(w, r, ac, after)
+}
+
+// authorized は接続を続けてよいかを返す。確かめられなかった場合は接続を切らずにログに残す。
+func (f *StreamHandler) authorized(ac *authContext) bool {
+	ok, err := authStillValid(f.DB, ac)
+	if err != nil {
+		log.Println(err)
+		return true
+	}
+
+	return ok
+}
+
+func (f *StreamHandler) serveSSE(w http.ResponseWriter, r *http.Request, ac *authContext, after uint64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		var error model.Error
+		error.Message = "ストリーミングに対応していません。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	subscription, replay, resync := f.Hub.Subscribe(ac.User.ID, after)
+	defer subscription.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+
+	write := func(e service.Event) bool {
+		_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Data)
+		return err == nil
+	}
+
+	if resync {
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: {}\n\n", streamResync); err != nil {
+			return
+		}
+	}
+	for _, e := range replay {
+		if !write(e) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			// 失効したら切断する。EventSource は同じチケットで繋ぎ直そうとするが、使用済みなので通らない
+			if !f.authorized(ac) {
+				return
+			}
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case e, ok := <-subscription.Events:
+			if !ok {
+				// 送信が追いつかずに切られた。クライアントは最後に受け取った ID から再接続する
+				return
+			}
+			if !write(e) {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func (f *StreamHandler) serveWebSocket(w http.ResponseWriter, r *http.Request, ac *authContext, after uint64) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade がエラーのレスポンスを返している
+		log.Println(err)
+		return
+	}
+	defer conn.Close()
+
+	subscription, replay, resync := f.Hub.Subscribe(ac.User.ID, after)
+	defer subscription.Close()
+
+	// クライアントからは pong と close だけを受け取る。読み込みが止まったら接続を終える
+	closed := make(chan struct{})
+	conn.SetReadDeadline(time.Now().Add(streamHeartbeat * 2))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(streamHeartbeat * 2))
+	})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	write := func(e service.Event) bool {
+		conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		return conn.WriteJSON(e) == nil
+	}
+
+	if resync && !write(service.Event{Type: streamResync, Data: []byte("{}")}) {
+		return
+	}
+	for _, e := range replay {
+		if !write(e) {
+			return
+		}
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-heartbeat.C:
+			if !f.authorized(ac) {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "unauthorized"),
+					time.Now().Add(streamWriteTimeout))
+				return
+			}
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout)); err != nil {
+				return
+			}
+		case e, ok := <-subscription.Events:
+			if !ok {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "overflow"),
+					time.Now().Add(streamWriteTimeout))
+				return
+			}
+			if !write(e) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"golang-songs/model"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// streamTicket はログイン中の ac としてチケットを発行する。
+func streamTicket(t *testing.T, db *gorm.DB, ac *authContext) string {
+	r := httptest.NewRequest("POST", "/api/stream/ticket", nil)
+	w := httptest.NewRecorder()
+	(&StreamTicketHandler{DB: db}).ServeHTTP(w, withAuthContext(r, ac))
+	if w.Code != http.StatusOK {
+		t.Fatalf("ticket status = %d, want 200: %s", w.Code, w.Body)
+	}
+
+	var body map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	return body["ticket"]
+}
+
+// redeemStreamTicket はチケットで繋ぎ、通ればストリームに渡された authContext を返す。
+func redeemStreamTicket(db *gorm.DB, ticket string) (*authContext, int) {
+	var ac *authContext
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ac, _ = r.Context().Value(authKey).(*authContext)
+	})
+
+	w := httptest.NewRecorder()
+	(&AuthMiddleware{DB: db}).StreamTicket(h).ServeHTTP(w, httptest.NewRequest("GET", "/api/stream?ticket="+url.QueryEscape(ticket), nil))
+
+	return ac, w.Code
+}
+
+func TestStreamTicketChecksSession(t *testing.T) {
+	db := newTestDB(t, &model.User{}, &model.Session{}, &model.PersonalAccessToken{}, &model.UserToken{}, &model.UserRole{})
+
+	user := model.User{Email: "a@example.com", TokenVersion: 1}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	newSession := func() *authContext {
+		jti, err := randomHex(16)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session := model.Session{UserID: user.ID, Jti: jti}
+		if err := db.Create(&session).Error; err != nil {
+			t.Fatal(err)
+		}
+		return &authContext{User: user, Scopes: loginScopes, SessionID: session.ID}
+	}
+
+	tests := []struct {
+		name string
+		// revoke はセッションやアカウントを失効させる
+		revoke func(ac *authContext) error
+	}{
+		{"logout", func(ac *authContext) error {
+			return db.Where("id = ?", ac.SessionID).Delete(&model.Session{}).Error
+		}},
+		{"suspend", func(ac *authContext) error {
+			return db.Model(&model.User{}).Where("id = ?", user.ID).UpdateColumn("suspended_at", time.Now()).Error
+		}},
+		{"password change", func(ac *authContext) error {
+			return db.Model(&model.User{}).Where("id = ?", user.ID).UpdateColumn("token_version", gorm.Expr("token_version + 1")).Error
+		}},
+	}
+
+	for _, tt := range tests {
+		if err := db.Model(&model.User{}).Where("id = ?", user.ID).
+			UpdateColumns(map[string]interface{}{"suspended_at": nil, "token_version": user.TokenVersion}).Error; err != nil {
+			t.Fatal(err)
+		}
+
+		ticket := streamTicket(t, db, newSession())
+		ac, code := redeemStreamTicket(db, ticket)
+		if code != http.StatusOK || ac == nil {
+			t.Fatalf("%s: status = %d, want 200", tt.name, code)
+		}
+		if ok, err := authStillValid(db, ac); err != nil || !ok {
+			t.Fatalf("%s: authStillValid = %v, %v, want true", tt.name, ok, err)
+		}
+
+		// 接続中に失効したら、ハートビートでの確認で切断する
+		if err := tt.revoke(ac); err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := authStillValid(db, ac); err != nil || ok {
+			t.Errorf("%s: authStillValid = %v, %v, want false", tt.name, ok, err)
+		}
+
+		// 発行した後に失効したチケットは使えない
+		if err := db.Model(&model.User{}).Where("id = ?", user.ID).
+			UpdateColumns(map[string]interface{}{"suspended_at": nil, "token_version": user.TokenVersion}).Error; err != nil {
+			t.Fatal(err)
+		}
+		session := newSession()
+		ticket = streamTicket(t, db, session)
+		if err := tt.revoke(session); err != nil {
+			t.Fatal(err)
+		}
+		if _, code := redeemStreamTicket(db, ticket); code == http.StatusOK {
+			t.Errorf("%s: ticket issued before the revocation was accepted", tt.name)
+		}
+	}
+}
+
+func TestStreamTicketChecksAccessToken(t *testing.T) {
+	db := newTestDB(t, &model.User{}, &model.Session{}, &model.PersonalAccessToken{}, &model.UserToken{}, &model.UserRole{})
+
+	user := model.User{Email: "a@example.com"}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	token := model.PersonalAccessToken{UserID: user.ID, Scopes: scopeRead}
+	if err := db.Create(&token).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	ac, code := redeemStreamTicket(db, streamTicket(t, db, &authContext{User: user, Scopes: []string{scopeRead}, AccessTokenID: token.ID}))
+	if code != http.StatusOK || ac == nil || ac.AccessTokenID != token.ID {
+		t.Fatalf("status = %d, ac = %+v, want 200 with the access token", code, ac)
+	}
+
+	if err := db.Delete(&token).Error; err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := authStillValid(db, ac); err != nil || ok {
+		t.Errorf("authStillValid = %v, %v, want false after the token was revoked", ok, err)
+	}
+}
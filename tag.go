@@ -0,0 +1,435 @@
+package main
+
+import (
+	"encoding/json"
+	"golang-songs/model"
+	"golang-songs/service"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	songTagsMax          = 10
+	tagMaxLength         = 30
+	tagSongsPerPage      = 20
+	tagAutocompleteLimit = 10
+	trendingTagsLimit    = 20
+	// trendingTagsPeriod の間に曲に付けられた回数で急上昇のタグを決める
+	trendingTagsPeriod = 7 * 24 * time.Hour
+)
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// cleanTags は表示用に揃えたタグ名を、正規化した名前で重複を除いて返す。
+func cleanTags(names []string) []string {
+	seen := map[string]bool{}
+	tags := []string{}
+	for _, name := range names {
+		name = service.CleanTag(name)
+		normalized := service.NormalizeTag(name)
+		if normalized == "" || seen[normalized] {
+			continue
+		}
+		seen[normalized] = true
+		tags = append(tags, name)
+	}
+
+	return tags
+}
+
+// findOrCreateTags は names のタグを返す。無いタグは最初に使われた表記で作る。
+func findOrCreateTags(tx *gorm.DB, names []string) ([]model.Tag, error) {
+	tags := []model.Tag{}
+	for _, name := range names {
+		var tag model.Tag
+		err := tx.Where(model.Tag{NormalizedName: service.NormalizeTag(name)}).
+			Attrs(model.Tag{Name: name}).FirstOrCreate(&tag).Error
+		if err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, nil
+}
+
+// setSongTags は曲のタグを tags に置き換える。
+func setSongTags(tx *gorm.DB, songID uint, tags []model.Tag) error {
+	ids := []uint{}
+	for _, tag := range tags {
+		ids = append(ids, tag.ID)
+	}
+
+	// (song_id, tag_id) に一意制約があるため物理削除する
+	query := tx.Unscoped().Where("song_id = ?", songID)
+	if len(ids) > 0 {
+		query = query.Where("tag_id NOT IN (?)", ids)
+	}
+	if err := query.Delete(&model.SongTag{}).Error; err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		var songTag model.SongTag
+		if err := tx.Where(model.SongTag{SongID: songID, TagID: id}).FirstOrCreate(&songTag).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadSongTags は曲一覧にタグを入れる。
+func loadSongTags(db *gorm.DB, songs []model.Song, ids []uint) error {
+	var rows []struct {
+		SongID uint
+		TagID  uint
+		Name   string
+	}
+	err := db.Table("song_tags").Select("song_tags.song_id, tags.id AS tag_id, tags.name").
+		Joins("JOIN tags ON tags.id = song_tags.tag_id").
+		Where("song_tags.song_id IN (?) AND song_tags.deleted_at IS NULL", ids).
+		Order("song_tags.id asc").Scan(&rows).Error
+	if err != nil {
+		return err
+	}
+
+	bySong := map[uint][]model.Tag{}
+	for _, row := range rows {
+		bySong[row.SongID] = append(bySong[row.SongID], model.Tag{ID: row.TagID, Name: row.Name})
+	}
+	for i := range songs {
+		songs[i].Tags = bySong[songs[i].ID]
+		if songs[i].Tags == nil {
+			songs[i].Tags = []model.Tag{}
+		}
+	}
+
+	return nil
+}
+
+// tagsWithCount は query の行(id, name, song_count)をタグにする。
+func tagsWithCount(query *gorm.DB) ([]model.Tag, error) {
+	var rows []struct {
+		ID        uint
+		Name      string
+		SongCount int
+	}
+	if err := query.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	tags := []model.Tag{}
+	for _, row := range rows {
+		tags = append(tags, model.Tag{ID: row.ID, Name: row.Name, SongCount: row.SongCount})
+	}
+
+	return tags, nil
+}
+
+type UpdateSongTagsHandler struct {
+	DB *gorm.DB
+}
+
+// 曲のタグを置き換える。投稿者だけが変更できる
+func (f *UpdateSongTagsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.SongTagsForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	names := cleanTags(d.Tags)
+	if len(names) > songTagsMax {
+		var error model.Error
+		error.Message = "タグは" + strconv.Itoa(songTagsMax) + "個までです。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+	for _, name := range names {
+		if utf8.RuneCountInString(name) > tagMaxLength {
+			var error model.Error
+			error.Message = "タグは" + strconv.Itoa(tagMaxLength) + "文字以内で入力してください: " + name
+			errorInResponse(w, http.StatusBadRequest, error)
+			return
+		}
+	}
+
+	var song model.Song
+	if err := f.DB.Where("id = ? AND user_id = ?", mux.Vars(r)["id"], user.ID).Find(&song).Error; err != nil {
+		var error model.Error
+		error.Message = "該当する曲が見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	var tags []model.Tag
+	err := f.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		if tags, err = findOrCreateTags(tx, names); err != nil {
+			return err
+		}
+
+		return setSongTags(tx, song.ID, tags)
+	})
+	if err != nil {
+		var error model.Error
+		error.Message = "タグの更新に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, tags)
+}
+
+type TagAutocompleteHandler struct {
+	DB *gorm.DB
+}
+
+// visibleTaggedSongs はリクエストユーザーが見られる曲の id を選ぶサブクエリを返す。
+// ブロック・ミュートしたユーザー、見られない非公開アカウントの曲と非表示の曲は含めない。
+func visibleTaggedSongs(db *gorm.DB, viewerID uint) (interface{}, error) {
+	hiddenIDs, err := hiddenUserIDs(db, viewerID)
+	if err != nil {
+		return nil, err
+	}
+
+	return excludePrivateUsers(excludeUsers(db.New().Model(&model.Song{}), "user_id", hiddenIDs), "user_id", viewerID).
+		Select("id").Where("hidden_at IS NULL").QueryExpr(), nil
+}
+
+// q で始まるタグを、付けられている曲の多い順に返す。見られる曲に付いていないタグは返さない
+func (f *TagAutocompleteHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	q := service.NormalizeTag(r.URL.Query().Get("q"))
+	if q == "" {
+		writeJSON(w, []model.Tag{})
+		return
+	}
+
+	songIDs, err := visibleTaggedSongs(f.DB, user.ID)
+	if err != nil {
+		var error model.Error
+		error.Message = "タグの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	tags, err := tagsWithCount(f.DB.Table("tags").
+		Select("tags.id, tags.name, COUNT(song_tags.id) AS song_count").
+		Joins("JOIN song_tags ON song_tags.tag_id = tags.id AND song_tags.deleted_at IS NULL").
+		Where("tags.deleted_at IS NULL AND tags.normalized_name LIKE ?", likeEscaper.Replace(q)+"%").
+		Where("song_tags.song_id IN (?)", songIDs).
+		Group("tags.id, tags.name").
+		Order("song_count desc, tags.name asc").
+		Limit(tagAutocompleteLimit))
+	if err != nil {
+		var error model.Error
+		error.Message = "タグの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, tags)
+}
+
+type TrendingTagsHandler struct {
+	DB *gorm.DB
+}
+
+// 最近よく付けられているタグを返す。リクエストユーザーが見られる曲だけを数える
+func (f *TrendingTagsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	songIDs, err := visibleTaggedSongs(f.DB, user.ID)
+	if err != nil {
+		var error model.Error
+		error.Message = "タグの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	tags, err := tagsWithCount(f.DB.Table("song_tags").
+		Select("tags.id, tags.name, COUNT(song_tags.id) AS song_count").
+		Joins("JOIN tags ON tags.id = song_tags.tag_id").
+		Where("song_tags.deleted_at IS NULL AND song_tags.created_at >= ?", time.Now().Add(-trendingTagsPeriod)).
+		Where("song_tags.song_id IN (?)", songIDs).
+		Group("tags.id, tags.name").
+		Order("song_count desc").
+		Limit(trendingTagsLimit))
+	if err != nil {
+		var error model.Error
+		error.Message = "タグの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, tags)
+}
+
+type TagSongsHandler struct {
+	DB *gorm.DB
+}
+
+// タグの付いた曲を新しい順に返す。説明文のハッシュタグで付いた曲も含める。タグは表記の違いを揃えて探す
+func (f *TagSongsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	var tag model.Tag
+	if err := f.DB.Where("normalized_name = ?", service.NormalizeTag(mux.Vars(r)["tag"])).Find(&tag).Error; err != nil {
+		var error model.Error
+		error.Message = "該当するタグが見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	// ブロック・ミュートしたユーザーの曲は出さない
+	hiddenIDs, err := hiddenUserIDs(f.DB, user.ID)
+	if err != nil {
+		var error model.Error
+		error.Message = "曲一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	tagged := f.DB.New().Model(&model.SongTag{}).Select("song_id").Where("tag_id = ?", tag.ID).QueryExpr()
+	hashtagged := f.DB.New().Model(&model.SongHashtag{}).Select("song_id").Where("tag_id = ?", tag.ID).QueryExpr()
+
+	songs := []model.Song{}
+	err = excludePrivateUsers(excludeUsers(f.DB, "songs.user_id", hiddenIDs), "songs.user_id", user.ID).
+		Where("songs.id IN (?) OR songs.id IN (?)", tagged, hashtagged).
+		Where("songs.hidden_at IS NULL").
+		Order("songs.created_at desc").Limit(tagSongsPerPage).Offset((page - 1) * tagSongsPerPage).
+		Find(&songs).Error
+	if err != nil {
+		var error model.Error
+		error.Message = "曲一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err := loadSongDetails(f.DB, songs); err != nil {
+		var error model.Error
+		error.Message = "曲一覧の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, songs)
+}
+
+type SongTagSuggestionsHandler struct {
+	DB *gorm.DB
+}
+
+// Spotify の曲のアーティストのジャンルを、まだ付いていないタグの候補として返す
+// Spotify のアクセストークンは /api/tracks と同じくリクエストボディで受け取る
+func (f *SongTagSuggestionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.SpotifyTokenForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	var song model.Song
+	if err := f.DB.Where("id = ? AND user_id = ?", mux.Vars(r)["id"], user.ID).Find(&song).Error; err != nil {
+		var error model.Error
+		error.Message = "該当する曲が見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	if song.SpotifyTrackId == "" {
+		writeJSON(w, []string{})
+		return
+	}
+
+	if d.Token == "" {
+		var error model.Error
+		error.Message = "アクセストークンの取得に失敗しました"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	genres, err := service.GetTrackGenres(d.Token, song.SpotifyTrackId)
+	if err != nil {
+		var error model.Error
+		error.Message = "ジャンルの取得に失敗しました。"
+		errorInResponse(w, http.StatusBadGateway, error)
+		return
+	}
+
+	songs := []model.Song{song}
+	if err := loadSongTags(f.DB, songs, []uint{song.ID}); err != nil {
+		var error model.Error
+		error.Message = "タグの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	tagged := map[string]bool{}
+	for _, tag := range songs[0].Tags {
+		tagged[service.NormalizeTag(tag.Name)] = true
+	}
+
+	suggestions := []string{}
+	for _, genre := range cleanTags(genres) {
+		if !tagged[service.NormalizeTag(genre)] {
+			suggestions = append(suggestions, genre)
+		}
+	}
+
+	writeJSON(w, suggestions)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"golang-songs/model"
+	"golang-songs/service"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// loadTextFilter は conf/moderation.yml のルールを読み込む。
+// ファイルが無ければ何も引っかけず、管理APIから読み直せるようにしておく。
+func loadTextFilter(path string) *service.TextFilter {
+	filter, err := service.NewTextFilter(path)
+	if err != nil {
+		log.Println(path + "の読み込み失敗")
+	}
+
+	return filter
+}
+
+// filterText は texts を検査する。拒否する場合はエラーを返して false を返す。
+// 保留にする場合は引っかかったルール名を返すので、保存後に holdForReview を呼ぶ。
+func filterText(w http.ResponseWriter, filter *service.TextFilter, texts ...string) (string, bool) {
+	result := filter.Check(texts...)
+
+	switch result.Action {
+	case service.TextFilterReject:
+		var error model.Error
+		error.Message = "不適切な表現が含まれているため保存できません。"
+		errorInResponse(w, http.StatusUnprocessableEntity, error)
+		return "", false
+	case service.TextFilterHold:
+		return result.Rule, true
+	}
+
+	return "", true
+}
+
+// holdForReview は対象を非表示にし、モデレーターの確認待ちに入れる。
+// 保留で隠したときだけケースに記録し、問題なしと判断されたときに公開するのはその場合に限る。
+func holdForReview(db *gorm.DB, targetType string, targetID uint, rule string) error {
+	return retryOnDuplicate(func() error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			applied, err := hideTarget(tx, targetType, targetID, time.Now())
+			if err != nil {
+				return err
+			}
+
+			c, err := openModerationCase(tx, targetType, targetID)
+			if err != nil {
+				return err
+			}
+
+			updates := map[string]interface{}{"flagged_rule": rule}
+			if applied {
+				updates["hold_applied"] = true
+			}
+
+			return tx.Model(&c).UpdateColumns(updates).Error
+		})
+	})
+}
+
+// holdCommentForReview は自己紹介を反映せずに保留し、モデレーターの確認待ちに入れる。
+// アカウントやほかの項目は隠さない。
+func holdCommentForReview(db *gorm.DB, userID uint, comment string, rule string) error {
+	return retryOnDuplicate(func() error {
+		return db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Model(&model.User{}).Where("id = ?", userID).UpdateColumn("pending_comment", comment).Error; err != nil {
+				return err
+			}
+
+			c, err := openModerationCase(tx, reportTargetUserComment, userID)
+			if err != nil {
+				return err
+			}
+
+			return tx.Model(&c).UpdateColumns(map[string]interface{}{"flagged_rule": rule, "hold_applied": true}).Error
+		})
+	})
+}
+
+type TextFilterStatsHandler struct {
+	Filter *service.TextFilter
+}
+
+// ルールごとの判定件数を返す
+func (f *TextFilterStatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, f.Filter.Stats())
+}
+
+type ReloadTextFilterHandler struct {
+	Filter *service.TextFilter
+}
+
+// 設定ファイルを読み直す。失敗した場合はそれまでのルールのまま
+func (f *ReloadTextFilterHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f.Filter.Reload(); err != nil {
+		var error model.Error
+		error.Message = "ルールの読み込みに失敗しました: " + err.Error()
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	writeJSON(w, f.Filter.Stats())
+}
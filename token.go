@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"golang-songs/model"
+	"os"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// メールで送るトークンの用途
+const (
+	tokenPurposeVerifyEmail   = "verify_email"
+	tokenPurposeResetPassword = "reset_password"
+	tokenPurposeChangeEmail   = "change_email"
+)
+
+const (
+	tokenPurposeLoginChallenge = "login_challenge"
+	loginChallengeTTL          = 5 * time.Minute
+)
+
+// ストリームはヘッダーを付けられないクライアントからも繋ぐため、ログインの JWT の代わりに
+// 短命で一度しか使えないチケットをクエリで受け取る
+const (
+	tokenPurposeStream = "stream"
+	streamTicketTTL    = 30 * time.Second
+)
+
+var errInvalidActionToken = errors.New("invalid action token")
+
+// ログイン用の JWT として通らないよう、用途ごとに署名鍵を分ける
+func actionTokenKey(purpose string) []byte {
+	return []byte(os.Getenv("SIGNINGKEY") + ":" + purpose)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// createActionToken は有効期限付きの署名済みトークンを発行する。
+// jti を user_tokens に保存し、一度しか使えないようにする。
+func createActionToken(db *gorm.DB, user model.User, purpose string, ttl time.Duration) (string, error) {
+	return createActionTokenWith(db, user, purpose, ttl, nil)
+}
+
+// createActionTokenWith は values を署名付きで持たせたトークンを発行する。
+// 使うときに values が今の状態と合うかを確かめ、発行後に対象が変わっていないことを保証する。
+func createActionTokenWith(db *gorm.DB, user model.User, purpose string, ttl time.Duration, values map[string]string) (string, error) {
+	jti, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+
+	expiresAt := time.Now().Add(ttl)
+
+	if err := db.Create(&model.UserToken{
+		UserID:    user.ID,
+		Purpose:   purpose,
+		Jti:       jti,
+		ExpiresAt: expiresAt}).Error; err != nil {
+		return "", err
+	}
+
+	claims := jwt.MapClaims{
+		"sub":     user.ID,
+		"purpose": purpose,
+		"jti":     jti,
+		"exp":     expiresAt.Unix(),
+		"iss":     "__init__",
+	}
+	for k, v := range values {
+		claims["x_"+k] = v
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	return token.SignedString(actionTokenKey(purpose))
+}
+
+// consumeActionToken はトークンを検証して使用済みにし、発行先のユーザーIDを返す。
+// 同じ用途の未使用トークンもまとめて無効にする。
+func consumeActionToken(db *gorm.DB, signedString string, purpose string) (uint, error) {
+	userID, _, err := consumeActionTokenWith(db, signedString, purpose)
+	return userID, err
+}
+
+// consumeActionTokenWith は consumeActionToken と同じく使用済みにし、発行時に持たせた値も返す。
+func consumeActionTokenWith(db *gorm.DB, signedString string, purpose string) (uint, map[string]string, error) {
+	userToken, claims, err := useActionToken(db, signedString, purpose)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if err := db.Model(&model.UserToken{}).Where("user_id = ? AND purpose = ? AND used_at IS NULL", userToken.UserID, purpose).Update("used_at", time.Now()).Error; err != nil {
+		return 0, nil, err
+	}
+
+	return userToken.UserID, actionTokenValues(claims), nil
+}
+
+// actionTokenValues は createActionTokenWith で持たせた値を取り出す。
+func actionTokenValues(claims jwt.MapClaims) map[string]string {
+	values := map[string]string{}
+	for k, v := range claims {
+		if s, ok := v.(string); ok && len(k) > 2 && k[:2] == "x_" {
+			values[k[2:]] = s
+		}
+	}
+
+	return values
+}
+
+// useActionToken はトークンを検証してそのトークンだけを使用済みにする。
+// 同じ用途のほかのトークンは無効にしないので、複数の接続で別々に発行したものも使える。
+func useActionToken(db *gorm.DB, signedString string, purpose string) (model.UserToken, jwt.MapClaims, error) {
+	var userToken model.UserToken
+
+	token, err := jwt.Parse(signedString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return "", errors.Errorf("unexpected signing method: %v", token.Header)
+		}
+		return actionTokenKey(purpose), nil
+	})
+	if err != nil {
+		return userToken, nil, errInvalidActionToken
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["purpose"] != purpose {
+		return userToken, nil, errInvalidActionToken
+	}
+
+	jti, ok := claims["jti"].(string)
+	if !ok {
+		return userToken, nil, errInvalidActionToken
+	}
+
+	if err := db.Where("jti = ? AND purpose = ?", jti, purpose).Find(&userToken).Error; err != nil {
+		return userToken, nil, errInvalidActionToken
+	}
+
+	now := time.Now()
+	if userToken.UsedAt != nil || now.After(userToken.ExpiresAt) {
+		return userToken, nil, errInvalidActionToken
+	}
+
+	// 同時に使われた場合に片方だけ通るよう、未使用の行だけを更新する
+	result := db.Model(&model.UserToken{}).Where("id = ? AND used_at IS NULL", userToken.ID).Update("used_at", now)
+	if result.Error != nil {
+		return userToken, nil, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return userToken, nil, errInvalidActionToken
+	}
+
+	return userToken, claims, nil
+}
+
+// createChallengeToken はパスワード確認済みで二段階認証待ちであることを示す短命なトークンを発行する。
+// パスワード変更などで失効するよう ver を含める。
+func createChallengeToken(user model.User) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub":     user.ID,
+		"ver":     user.TokenVersion,
+		"purpose": tokenPurposeLoginChallenge,
+		"exp":     time.Now().Add(loginChallengeTTL).Unix(),
+		"iss":     "__init__",
+	})
+
+	return token.SignedString(actionTokenKey(tokenPurposeLoginChallenge))
+}
+
+// parseChallengeToken はトークンを検証し、ユーザーIDと ver を返す。
+func parseChallengeToken(signedString string) (uint, uint, error) {
+	token, err := jwt.Parse(signedString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return "", errors.Errorf("unexpected signing method: %v", token.Header)
+		}
+		return actionTokenKey(tokenPurposeLoginChallenge), nil
+	})
+	if err != nil {
+		return 0, 0, errInvalidActionToken
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["purpose"] != tokenPurposeLoginChallenge {
+		return 0, 0, errInvalidActionToken
+	}
+
+	userID, ok := claims["sub"].(float64)
+	if !ok {
+		return 0, 0, errInvalidActionToken
+	}
+
+	version, _ := claims["ver"].(float64)
+
+	return uint(userID), uint(version), nil
+}
+
+const (
+	tokenPurposeOAuthState = "oauth_state"
+	oauthStateTTL          = 10 * time.Minute
+)
+
+// createStateToken は外部の認可画面に渡す state を発行する。
+// 戻ってきた時に必要な値は署名付きで state 自体に持たせる。一度しか使えないことと
+// ログインを始めたブラウザからであることは、jti で startOAuthLogin の行を引いて確かめる。
+func createStateToken(values map[string]string) (string, error) {
+	nonce, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+
+	claims := jwt.MapClaims{
+		"purpose": tokenPurposeOAuthState,
+		"nonce":   nonce,
+		"exp":     time.Now().Add(oauthStateTTL).Unix(),
+		"iss":     "__init__",
+	}
+	for k, v := range values {
+		claims["x_"+k] = v
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	return token.SignedString(actionTokenKey(tokenPurposeOAuthState))
+}
+
+// parseStateToken は state を検証し、発行時に持たせた値を返す。
+func parseStateToken(signedString string) (map[string]string, error) {
+	token, err := jwt.Parse(signedString, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return "", errors.Errorf("unexpected signing method: %v", token.Header)
+		}
+		return actionTokenKey(tokenPurposeOAuthState), nil
+	})
+	if err != nil {
+		return nil, errInvalidActionToken
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["purpose"] != tokenPurposeOAuthState {
+		return nil, errInvalidActionToken
+	}
+
+	values := map[string]string{}
+	for k, v := range claims {
+		if s, ok := v.(string); ok && len(k) > 2 && k[:2] == "x_" {
+			values[k[2:]] = s
+		}
+	}
+
+	return values, nil
+}
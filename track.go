@@ -0,0 +1,243 @@
+package main
+
+import (
+	"golang-songs/model"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	trackSongsPerPage = 20
+	// trackCommentsShown は曲のページに載せる最近のコメントの件数
+	trackCommentsShown = 20
+)
+
+// findOrCreateTrack は投稿 song の曲を返す。Spotify の曲 ID、ISRC、曲名とアーティストの順に探し、
+// 見つからなければ song の内容で作る。見つかった曲に無い ID は投稿のもので埋める。
+// 同じ曲を同時に作ろうとして一意キーに当たった場合は、探すところからやり直して先に作られた曲を使う。
+func findOrCreateTrack(db *gorm.DB, song model.Song, isrc string) (model.Track, error) {
+	var track model.Track
+	err := retryOnDuplicate(func() error {
+		var err error
+		track, err = findOrCreateTrackOnce(db, song, isrc)
+		return err
+	})
+
+	return track, err
+}
+
+func findOrCreateTrackOnce(tx *gorm.DB, song model.Song, isrc string) (model.Track, error) {
+	spotifyID := strings.TrimSpace(song.SpotifyTrackId)
+	isrc = strings.ToUpper(strings.TrimSpace(isrc))
+
+	var track model.Track
+	err := gorm.ErrRecordNotFound
+	if spotifyID != "" {
+		err = tx.Where("spotify_track_id = ?", spotifyID).Find(&track).Error
+	}
+	if gorm.IsRecordNotFoundError(err) && isrc != "" {
+		err = tx.Where("isrc = ?", isrc).Find(&track).Error
+	}
+	if gorm.IsRecordNotFoundError(err) && spotifyID == "" && isrc == "" {
+		err = tx.Where("spotify_track_id IS NULL AND isrc IS NULL AND title = ? AND artist = ?", song.Title, song.Artist).
+			Order("id asc").First(&track).Error
+	}
+
+	if gorm.IsRecordNotFoundError(err) {
+		track = model.Track{
+			Title:    song.Title,
+			Artist:   song.Artist,
+			Album:    song.Album,
+			Image:    song.Image,
+			MusicAge: song.MusicAge}
+		if spotifyID != "" {
+			track.SpotifyTrackId = &spotifyID
+		}
+		if isrc != "" {
+			track.ISRC = &isrc
+		}
+		err := tx.Create(&track).Error
+
+		return track, err
+	}
+	if err != nil {
+		return track, err
+	}
+
+	updates := map[string]interface{}{}
+	if track.SpotifyTrackId == nil && spotifyID != "" {
+		updates["spotify_track_id"] = spotifyID
+	}
+	if track.ISRC == nil && isrc != "" {
+		updates["isrc"] = isrc
+	}
+	if len(updates) > 0 {
+		if err := tx.Model(&track).Updates(updates).Error; err != nil {
+			return track, err
+		}
+	}
+
+	return track, nil
+}
+
+// linkTrack は投稿を曲につなぐ。つながっている曲が変わらなければ何もしない。
+func linkTrack(db *gorm.DB, song *model.Song, isrc string) error {
+	track, err := findOrCreateTrack(db, *song, isrc)
+	if err != nil {
+		return err
+	}
+	if song.TrackID != nil && *song.TrackID == track.ID {
+		return nil
+	}
+
+	if err := db.Model(song).UpdateColumn("track_id", track.ID).Error; err != nil {
+		return err
+	}
+	song.TrackID = &track.ID
+
+	return nil
+}
+
+// loadSongTracks は曲一覧につながっている曲を入れる。
+func loadSongTracks(db *gorm.DB, songs []model.Song) error {
+	ids := []uint{}
+	for _, song := range songs {
+		if song.TrackID != nil {
+			ids = append(ids, *song.TrackID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	var tracks []model.Track
+	if err := db.Where("id IN (?)", ids).Find(&tracks).Error; err != nil {
+		return err
+	}
+
+	byID := map[uint]model.Track{}
+	for _, track := range tracks {
+		byID[track.ID] = track
+	}
+	for i := range songs {
+		if songs[i].TrackID == nil {
+			continue
+		}
+		if track, ok := byID[*songs[i].TrackID]; ok {
+			songs[i].Track = &track
+		}
+	}
+
+	return nil
+}
+
+// trackISRC はリクエストの track に書かれた ISRC を返す。
+func trackISRC(song model.Song) string {
+	if song.Track == nil || song.Track.ISRC == nil {
+		return ""
+	}
+
+	return *song.Track.ISRC
+}
+
+type TrackHandler struct {
+	DB *gorm.DB
+}
+
+// 曲のページを返す。この曲の投稿を新しい順に、それらへのブックマーク数と最近のコメントと合わせて返す
+// ブロック・ミュートしたユーザー、非表示の曲、見られない非公開アカウントの投稿は含めない
+func (f *TrackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	var page model.TrackPage
+	if err := f.DB.Where("id = ?", mux.Vars(r)["id"]).Find(&page.Track).Error; err != nil {
+		var error model.Error
+		error.Message = "該当する曲が見つかりません。"
+		errorInResponse(w, http.StatusNotFound, error)
+		return
+	}
+
+	p, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || p < 1 {
+		p = 1
+	}
+
+	hiddenIDs, err := hiddenUserIDs(f.DB, user.ID)
+	if err != nil {
+		var error model.Error
+		error.Message = "曲の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	visible := func() *gorm.DB {
+		return excludePrivateUsers(excludeUsers(f.DB, "songs.user_id", hiddenIDs), "songs.user_id", user.ID).
+			Where("songs.track_id = ? AND songs.hidden_at IS NULL", page.Track.ID)
+	}
+
+	if err := visible().Model(&model.Song{}).Count(&page.Track.PostCount).Error; err != nil {
+		var error model.Error
+		error.Message = "曲の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	page.Songs = []model.Song{}
+	err = visible().Order("songs.created_at desc").
+		Limit(trackSongsPerPage).Offset((p - 1) * trackSongsPerPage).
+		Find(&page.Songs).Error
+	if err != nil {
+		var error model.Error
+		error.Message = "曲の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err := loadSongDetails(f.DB, page.Songs); err != nil {
+		var error model.Error
+		error.Message = "曲の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	songIDs := visible().Model(&model.Song{}).Select("songs.id").QueryExpr()
+
+	err = f.DB.Model(&model.Bookmark{}).Where("song_id IN (?)", songIDs).Count(&page.BookmarkCount).Error
+	if err != nil {
+		var error model.Error
+		error.Message = "曲の取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	page.Comments = []model.SongComment{}
+	err = excludeUsers(f.DB, "user_id", hiddenIDs).Preload("Mentions").
+		Where("song_id IN (?) AND parent_id IS NULL AND hidden_at IS NULL", songIDs).
+		Order("created_at desc").Limit(trackCommentsShown).
+		Find(&page.Comments).Error
+	if err != nil {
+		var error model.Error
+		error.Message = "コメントの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err := attachCommentAuthors(f.DB, user.ID, page.Comments); err != nil {
+		var error model.Error
+		error.Message = "コメントの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	writeJSON(w, page)
+}
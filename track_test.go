@@ -0,0 +1,53 @@
+package main
+
+import (
+	"golang-songs/model"
+	"testing"
+)
+
+func TestFindOrCreateTrack(t *testing.T) {
+	db := newTestDB(t, &model.Track{})
+
+	tests := []struct {
+		name string
+		song model.Song
+		isrc string
+	}{
+		{"spotify", model.Song{Title: "title", Artist: "artist", SpotifyTrackId: "track-1"}, ""},
+		// 前後の空白は無視する
+		{"spotify with spaces", model.Song{Title: "other title", Artist: "artist", SpotifyTrackId: " track-1 "}, ""},
+		// Spotify の曲 ID が無く、まだ無い ISRC なら別の曲を作る
+		{"isrc", model.Song{Title: "title", Artist: "artist"}, "jpabc2000001"},
+	}
+
+	var ids []uint
+	for _, tt := range tests {
+		track, err := findOrCreateTrack(db, tt.song, tt.isrc)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		ids = append(ids, track.ID)
+	}
+	if ids[0] != ids[1] {
+		t.Errorf("tracks = %v, want the same track for the same Spotify ID", ids)
+	}
+	if ids[2] == ids[0] {
+		t.Errorf("tracks = %v, want a new track for an unknown ISRC without a Spotify ID", ids)
+	}
+
+	// Spotify の曲 ID だけだった曲に ISRC を埋めると、ISRC からも見つかる
+	track, err := findOrCreateTrack(db, model.Song{Title: "title", Artist: "artist", SpotifyTrackId: "track-1"}, "JPXYZ2000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if track.ID != ids[0] {
+		t.Fatalf("track = %d, want %d", track.ID, ids[0])
+	}
+	byISRC, err := findOrCreateTrack(db, model.Song{Title: "title", Artist: "artist"}, " jpxyz2000002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byISRC.ID != ids[0] {
+		t.Errorf("track by ISRC = %d, want %d", byISRC.ID, ids[0])
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"golang-songs/model"
+	"golang-songs/service"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	totpIssuer        = "golang-songs"
+	recoveryCodeCount = 10
+)
+
+// verifyTOTPCode は TOTP のコードを検証する。
+// 一度使ったステップ以前のコードは通さない。
+func verifyTOTPCode(db *gorm.DB, user model.User, secret string, code string) (bool, error) {
+	step, ok := service.ValidateTOTP(secret, code, time.Now())
+	if !ok || step <= user.TOTPLastStep {
+		return false, nil
+	}
+
+	result := db.Model(&model.User{}).Where("id = ? AND totp_last_step < ?", user.ID, step).Update("totp_last_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+// useRecoveryCode は未使用のリカバリーコードであれば使用済みにする。
+func useRecoveryCode(db *gorm.DB, user model.User, code string) (bool, error) {
+	result := db.Model(&model.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hashRecoveryCode(code)).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+// generateRecoveryCodes は既存のリカバリーコードを破棄して作り直す。
+// 平文を返すのはこの時だけで、DBにはハッシュだけを保存する。
+func generateRecoveryCodes(db *gorm.DB, user model.User) ([]string, error) {
+	if err := db.Where("user_id = ?", user.ID).Delete(&model.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := randomHex(5)
+		if err != nil {
+			return nil, err
+		}
+		code = code[:5] + "-" + code[5:]
+
+		if err := db.Create(&model.RecoveryCode{
+			UserID:   user.ID,
+			CodeHash: hashRecoveryCode(code)}).Error; err != nil {
+			return nil, err
+		}
+
+		codes = append(codes, code)
+	}
+
+	return codes, nil
+}
+
+type SetupTwoFactorHandler struct {
+	DB *gorm.DB
+}
+
+// 共有鍵を発行する。最初のコードを確認するまでは有効にしない
+func (f *SetupTwoFactorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	if user.TOTPEnabled {
+		var error model.Error
+		error.Message = "二段階認証は既に有効です。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	secret, err := service.GenerateTOTPSecret()
+	if err != nil {
+		var error model.Error
+		error.Message = "共有鍵の作成に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err := f.DB.Model(&user).Update("totp_secret", secret).Error; err != nil {
+		var error model.Error
+		error.Message = "ユーザー情報の更新に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(model.TwoFactorSetup{
+		Secret:     secret,
+		OtpauthURL: service.TOTPURI(totpIssuer, user.Email, secret)}); err != nil {
+		var error model.Error
+		error.Message = "JSONへの変換に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type EnableTwoFactorHandler struct {
+	DB *gorm.DB
+}
+
+// 最初のコードを確認して二段階認証を有効にし、リカバリーコードを返す
+func (f *EnableTwoFactorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.TwoFactorCodeForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		var error model.Error
+		error.Message = "二段階認証の設定が開始されていません。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	valid, err := verifyTOTPCode(f.DB, user, user.TOTPSecret, d.Code)
+	if err != nil {
+		var error model.Error
+		error.Message = "認証コードの確認に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if !valid {
+		var error model.Error
+		error.Message = "認証コードが正しくありません。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	codes, err := generateRecoveryCodes(f.DB, user)
+	if err != nil {
+		var error model.Error
+		error.Message = "リカバリーコードの作成に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err := f.DB.Model(&user).Update("totp_enabled", true).Error; err != nil {
+		var error model.Error
+		error.Message = "ユーザー情報の更新に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	v, err := json.Marshal(model.RecoveryCodes{RecoveryCodes: codes})
+	if err != nil {
+		var error model.Error
+		error.Message = "JSONへの変換に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if _, err := w.Write(v); err != nil {
+		var error model.Error
+		error.Message = "リカバリーコードの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type DisableTwoFactorHandler struct {
+	DB *gorm.DB
+}
+
+// 無効にするには認証アプリの新しいコードが必要(リカバリーコードは使えない)
+func (f *DisableTwoFactorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := authUser(r)
+	if !ok {
+		var error model.Error
+		error.Message = "該当するアカウントが見つかりません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	dec := json.NewDecoder(r.Body)
+	var d model.TwoFactorCodeForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if !user.TOTPEnabled {
+		var error model.Error
+		error.Message = "二段階認証は有効になっていません。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	valid, err := verifyTOTPCode(f.DB, user, user.TOTPSecret, d.Code)
+	if err != nil {
+		var error model.Error
+		error.Message = "認証コードの確認に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if !valid {
+		var error model.Error
+		error.Message = "認証コードが正しくありません。"
+		errorInResponse(w, http.StatusBadRequest, error)
+		return
+	}
+
+	if err := f.DB.Where("user_id = ?", user.ID).Delete(&model.RecoveryCode{}).Error; err != nil {
+		var error model.Error
+		error.Message = "リカバリーコードの削除に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err := f.DB.Model(&user).Updates(map[string]interface{}{
+		"totp_secret":    "",
+		"totp_enabled":   false,
+		"totp_last_step": 0}).Error; err != nil {
+		var error model.Error
+		error.Message = "ユーザー情報の更新に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}
+
+type LoginTwoFactorHandler struct {
+	DB *gorm.DB
+}
+
+// パスワード確認で受け取ったチャレンジトークンと認証コード(またはリカバリーコード)をJWTと交換する
+func (f *LoginTwoFactorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	dec := json.NewDecoder(r.Body)
+	var d model.TwoFactorLoginForm
+	if err := dec.Decode(&d); err != nil {
+		var error model.Error
+		error.Message = "リクエストボディのデコードに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	userID, version, err := parseChallengeToken(d.ChallengeToken)
+	if err != nil {
+		var error model.Error
+		error.Message = "トークンが無効か、有効期限が切れています。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	var user model.User
+	if err := f.DB.Where("id = ?", userID).Find(&user).Error; err != nil || user.TokenVersion != version || !user.TOTPEnabled {
+		var error model.Error
+		error.Message = "トークンが無効か、有効期限が切れています。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	// コードの総当たりもパスワードと同じ回数制限にかける
+	ip := clientIP(r)
+
+	wait, err := loginRetryAfter(f.DB, user.Email, ip)
+	if err != nil {
+		var error model.Error
+		error.Message = "ログインに失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+		var error model.Error
+		error.Message = "ログインの試行回数が多すぎます。しばらくしてから再度お試しください。"
+		errorInResponse(w, http.StatusTooManyRequests, error)
+		return
+	}
+
+	valid, err := verifyTOTPCode(f.DB, user, user.TOTPSecret, d.Code)
+	if err == nil && !valid {
+		valid, err = useRecoveryCode(f.DB, user, d.Code)
+	}
+	if err != nil {
+		var error model.Error
+		error.Message = "認証コードの確認に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if err := recordLoginAttempt(f.DB, user.Email, ip, valid); err != nil {
+		log.Println(err)
+	}
+
+	if !valid {
+		var error model.Error
+		error.Message = "認証コードが正しくありません。"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	token, err := startSession(f.DB, user, r)
+	if err != nil {
+		var error model.Error
+		error.Message = "トークンの作成に失敗しました"
+		errorInResponse(w, http.StatusUnauthorized, error)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	v, err := json.Marshal(model.JWT{Token: token})
+	if err != nil {
+		var error model.Error
+		error.Message = "JSONへの変換に失敗しました"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+
+	if _, err := w.Write(v); err != nil {
+		var error model.Error
+		error.Message = "JWTトークンの取得に失敗しました。"
+		errorInResponse(w, http.StatusInternalServerError, error)
+		return
+	}
+}